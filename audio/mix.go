@@ -0,0 +1,19 @@
+package audio
+
+// Downmix averages interleaved channels into mono
+func Downmix(samples []float32, channels int) []float32 {
+	if channels <= 1 {
+		return samples
+	}
+
+	out := make([]float32, len(samples)/channels)
+	for i := range out {
+		var sum float32
+		for _, s := range samples[i*channels : (i+1)*channels] {
+			sum += s
+		}
+		out[i] = sum / float32(channels)
+	}
+
+	return out
+}
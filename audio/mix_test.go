@@ -0,0 +1,27 @@
+package audio
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDownmix(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []float32
+		channels int
+		want     []float32
+	}{
+		{"mono", []float32{0.1, -0.2}, 1, []float32{0.1, -0.2}},
+		{"stereo", []float32{0.5, 0.25, -1, 1, 0.5, -0.25}, 2, []float32{0.375, 0, 0.125}},
+		{"three channels", []float32{0.3, 0.6, 0.9, -0.3, -0.3, -0.3}, 3, []float32{0.6, -0.3}},
+		{"partial frame", []float32{1, 0, 0.5}, 2, []float32{0.5}},
+		{"empty", nil, 2, []float32{}},
+	}
+	for _, tt := range tests {
+		got := Downmix(tt.samples, tt.channels)
+		if !slices.EqualFunc(got, tt.want, func(a, b float32) bool { return a-b < 1e-6 && b-a < 1e-6 }) {
+			t.Errorf("%s: Downmix = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
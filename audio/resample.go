@@ -0,0 +1,159 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// taps of the filter per polyphase branch when upsampling, scaled up by the
+// decimation ratio when downsampling to keep the transition band narrow
+const baseTaps = 32
+
+// Resampler converts a mono stream between sample rates with a windowed-sinc
+// polyphase filter. Input can be fed in chunks of any size.
+type Resampler struct {
+	up, down int
+	taps     int
+	// filter[p] holds the taps of phase p, newest input sample first
+	filter [][]float32
+	// offset of the filter centre in the upsampled domain, compensating its delay
+	delay int64
+
+	// input not yet consumed, history included; buf[0] is input sample start
+	buf   []float32
+	start int64
+	// input samples received and output samples produced
+	in, out int64
+}
+
+// NewResampler creates a resampler from one rate to another
+func NewResampler(from, to int) (*Resampler, error) {
+	if from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("audio: invalid sample rates %d -> %d", from, to)
+	}
+	g := gcd(from, to)
+	r := &Resampler{up: to / g, down: from / g}
+	if r.up == r.down {
+		return r, nil
+	}
+
+	r.taps = baseTaps
+	if r.down > r.up {
+		r.taps = baseTaps * (r.down + r.up - 1) / r.up
+	}
+
+	// lowpass at the lower of the two Nyquist rates, in the upsampled domain
+	n := r.taps * r.up
+	cutoff := 0.95 / float64(max(r.up, r.down))
+	r.delay = int64(n-1) / 2
+
+	r.filter = make([][]float32, r.up)
+	for p := range r.filter {
+		r.filter[p] = make([]float32, r.taps)
+		var sum float64
+		coeffs := make([]float64, r.taps)
+		for k := range coeffs {
+			j := p + k*r.up
+			x := float64(int64(j) - r.delay)
+			// Blackman window centred on the delay
+			w := 0.42 + 0.5*math.Cos(2*math.Pi*x/float64(n)) + 0.08*math.Cos(4*math.Pi*x/float64(n))
+			coeffs[k] = cutoff * sinc(cutoff*x) * w
+			sum += coeffs[k]
+		}
+		// unity gain per phase, so DC passes unchanged
+		for k, c := range coeffs {
+			if sum != 0 {
+				c /= sum
+			}
+			r.filter[p][k] = float32(c)
+		}
+	}
+
+	return r, nil
+}
+
+// Process resamples the next chunk of input. Output lags behind the input by
+// the filter length; Flush returns the rest.
+func (r *Resampler) Process(in []float32) []float32 {
+	r.in += int64(len(in))
+	if r.up == r.down {
+		return append([]float32(nil), in...)
+	}
+	r.buf = append(r.buf, in...)
+
+	return r.produce(-1)
+}
+
+// Flush returns the remaining output, padding the input with silence
+func (r *Resampler) Flush() []float32 {
+	if r.up == r.down {
+		return nil
+	}
+	want := (r.in*int64(r.up) + int64(r.down) - 1) / int64(r.down)
+	r.buf = append(r.buf, make([]float32, r.taps)...)
+
+	return r.produce(want)
+}
+
+// produce computes output samples while their input is available, up to
+// limit when it is not negative
+func (r *Resampler) produce(limit int64) []float32 {
+	var out []float32
+	up, down := int64(r.up), int64(r.down)
+	end := r.start + int64(len(r.buf))
+	for limit < 0 || r.out < limit {
+		m := r.out*down + r.delay
+		base := m / up
+		if base >= end {
+			break
+		}
+		phase := m % up
+
+		var acc float32
+		for k, c := range r.filter[phase] {
+			i := base - int64(k)
+			if i < r.start {
+				// before the stream start, or already trimmed history
+				break
+			}
+			acc += c * r.buf[i-r.start]
+		}
+		out = append(out, acc)
+		r.out++
+	}
+
+	// keep only the history the next output needs
+	next := (r.out*down+r.delay)/up - int64(r.taps) + 1
+	if drop := next - r.start; drop > 0 {
+		drop = min(drop, int64(len(r.buf)))
+		r.buf = r.buf[drop:]
+		r.start += drop
+	}
+
+	return out
+}
+
+// Resample converts a whole mono signal between sample rates
+func Resample(samples []float32, from, to int) ([]float32, error) {
+	r, err := NewResampler(from, to)
+	if err != nil {
+		return nil, err
+	}
+	out := r.Process(samples)
+
+	return append(out, r.Flush()...), nil
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
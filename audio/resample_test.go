@@ -0,0 +1,87 @@
+package audio
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func rms(samples []float32) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func TestResample(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		freq     float64
+		// wantRMS of the middle of the output, 0.354 for a tone passed unchanged
+		wantRMS float64
+		// maxError from the tone at the new rate, 0 when it is filtered out
+		maxError float64
+	}{
+		{"whisper from 48 kHz", 48000, 16000, 1000, 0.354, 0.01},
+		{"whisper from 44.1 kHz", 44100, 16000, 3000, 0.354, 0.01},
+		{"upsample", 16000, 48000, 3000, 0.354, 0.01},
+		{"odd ratio", 22050, 48000, 440, 0.354, 0.01},
+		{"same rate", 16000, 16000, 440, 0.354, 0},
+		{"above the new Nyquist rate", 48000, 16000, 12000, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := sine(tt.freq, tt.from, tt.from)
+			out, err := Resample(in, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a second of input is a second of output
+			if wantLen := (len(in)*tt.to + tt.from - 1) / tt.from; len(out) != wantLen {
+				t.Errorf("%d samples, want %d", len(out), wantLen)
+			}
+
+			middle := out[len(out)/4 : 3*len(out)/4]
+			if got := rms(middle); math.Abs(got-tt.wantRMS) > 0.01 {
+				t.Errorf("RMS %.3f, want %.3f", got, tt.wantRMS)
+			}
+			if tt.wantRMS > 0 {
+				// the filter delay is compensated, the tone stays in phase
+				ref := sine(tt.freq, tt.to, len(out))
+				var sum float64
+				for i := len(out) / 4; i < 3*len(out)/4; i++ {
+					d := float64(out[i] - ref[i])
+					sum += d * d
+				}
+				if e := math.Sqrt(sum / float64(len(middle))); e > tt.maxError {
+					t.Errorf("error %.4f from the tone, want at most %.4f", e, tt.maxError)
+				}
+			}
+
+			// streaming in chunks gives the same output
+			r, err := NewResampler(tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var chunked []float32
+			for i := 0; i < len(in); i += 777 {
+				chunked = append(chunked, r.Process(in[i:min(i+777, len(in))])...)
+			}
+			chunked = append(chunked, r.Flush()...)
+			if !slices.Equal(chunked, out) {
+				t.Errorf("chunked output differs, %d samples, want %d", len(chunked), len(out))
+			}
+		})
+	}
+}
+
+func TestResampleInvalidRates(t *testing.T) {
+	for _, rates := range [][2]int{{0, 16000}, {16000, 0}, {-8000, 16000}} {
+		if _, err := Resample(nil, rates[0], rates[1]); err == nil {
+			t.Errorf("Resample from %d to %d: no error", rates[0], rates[1])
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Package audio has pure Go helpers for PCM audio: WAV encoding and decoding,
+// resampling and channel downmixing. Samples are float32 in [-1, 1],
+// interleaved when there is more than one channel.
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	formatPCM        = 1
+	formatFloat      = 3
+	formatExtensible = 0xfffe
+
+	wavHeaderSize = 44
+	// data size written when the output can't be patched, read as "until EOF"
+	unknownSize = 0xffffffff
+)
+
+var ErrNotWav = errors.New("audio: not a WAV file")
+
+// Format describes a PCM stream
+type Format struct {
+	SampleRate int
+	Channels   int
+	// BitsPerSample is 8, 16, 24 or 32 for integer PCM, 32 for float
+	BitsPerSample int
+	Float         bool
+}
+
+func (f Format) frameSize() int {
+	return f.Channels * f.BitsPerSample / 8
+}
+
+// Writer writes 16-bit PCM WAV without buffering the audio.
+//
+// The RIFF and data sizes are only known at the end: Close patches them when
+// the destination is an io.WriteSeeker (such as a file), otherwise they are
+// left as 0xffffffff, which most decoders read as "until end of file".
+type Writer struct {
+	w       io.Writer
+	format  Format
+	written int64
+	buf     []byte
+	closed  bool
+}
+
+// NewWriter writes the WAV header for 16-bit audio with the given rate and
+// channel count
+func NewWriter(w io.Writer, sampleRate, channels int) (*Writer, error) {
+	if sampleRate <= 0 || channels <= 0 {
+		return nil, fmt.Errorf("audio: invalid format %d Hz, %d channels", sampleRate, channels)
+	}
+	ww := &Writer{w: w, format: Format{SampleRate: sampleRate, Channels: channels, BitsPerSample: 16}}
+	if _, err := w.Write(ww.header(unknownSize)); err != nil {
+		return nil, err
+	}
+
+	return ww, nil
+}
+
+func (ww *Writer) header(dataSize uint32) []byte {
+	f := ww.format
+	h := make([]byte, 0, wavHeaderSize)
+	h = append(h, "RIFF"...)
+	riffSize := uint32(unknownSize)
+	if dataSize != unknownSize {
+		riffSize = dataSize + wavHeaderSize - 8
+	}
+	h = binary.LittleEndian.AppendUint32(h, riffSize)
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, formatPCM)
+	h = binary.LittleEndian.AppendUint16(h, uint16(f.Channels))
+	h = binary.LittleEndian.AppendUint32(h, uint32(f.SampleRate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(f.SampleRate*f.frameSize()))
+	h = binary.LittleEndian.AppendUint16(h, uint16(f.frameSize()))
+	h = binary.LittleEndian.AppendUint16(h, uint16(f.BitsPerSample))
+	h = append(h, "data"...)
+	h = binary.LittleEndian.AppendUint32(h, dataSize)
+
+	return h
+}
+
+// Write encodes interleaved samples, clipping them to [-1, 1]
+func (ww *Writer) Write(samples []float32) error {
+	if ww.closed {
+		return fmt.Errorf("audio: writer closed")
+	}
+	ww.buf = ww.buf[:0]
+	for _, s := range samples {
+		ww.buf = binary.LittleEndian.AppendUint16(ww.buf, uint16(floatToInt16(s)))
+	}
+	n, err := ww.w.Write(ww.buf)
+	ww.written += int64(n)
+
+	return err
+}
+
+// Frames returns the number of sample frames written so far
+func (ww *Writer) Frames() int64 {
+	return ww.written / int64(ww.format.frameSize())
+}
+
+// Close patches the header sizes when possible. It does not close the
+// underlying writer.
+func (ww *Writer) Close() error {
+	if ww.closed {
+		return nil
+	}
+	ww.closed = true
+
+	ws, ok := ww.w.(io.WriteSeeker)
+	if !ok || ww.written > math.MaxUint32-wavHeaderSize {
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ws.Write(ww.header(uint32(ww.written))); err != nil {
+		return err
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+
+	return err
+}
+
+func floatToInt16(s float32) int16 {
+	if s > 1 {
+		s = 1
+	} else if s < -1 {
+		s = -1
+	}
+	return int16(s * math.MaxInt16)
+}
+
+// Reader decodes integer or float PCM WAV as a stream of float samples
+type Reader struct {
+	Format Format
+
+	r io.Reader
+	// bytes left in the data chunk, -1 when unknown
+	remaining int64
+	buf       []byte
+}
+
+// NewReader reads the WAV header up to the start of the sample data
+func NewReader(r io.Reader) (*Reader, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, ErrNotWav
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, ErrNotWav
+	}
+
+	wr := &Reader{r: r}
+	var haveFormat bool
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, fmt.Errorf("audio: WAV file has no data: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return nil, fmt.Errorf("audio: invalid WAV format chunk")
+			}
+			data := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			if err := wr.parseFormat(data); err != nil {
+				return nil, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return nil, fmt.Errorf("audio: WAV data before format chunk")
+			}
+			// streaming encoders leave the size unset
+			wr.remaining = size
+			if size == 0 || size == unknownSize {
+				wr.remaining = -1
+			}
+			return wr, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (wr *Reader) parseFormat(data []byte) error {
+	tag := binary.LittleEndian.Uint16(data[0:2])
+	f := Format{
+		Channels:      int(binary.LittleEndian.Uint16(data[2:4])),
+		SampleRate:    int(binary.LittleEndian.Uint32(data[4:8])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(data[14:16])),
+	}
+	if tag == formatExtensible {
+		if len(data) < 26 {
+			return fmt.Errorf("audio: invalid WAV format chunk")
+		}
+		// the sub-format GUID starts with the actual format tag
+		tag = binary.LittleEndian.Uint16(data[24:26])
+	}
+
+	switch {
+	case tag == formatPCM && (f.BitsPerSample == 8 || f.BitsPerSample == 16 || f.BitsPerSample == 24 || f.BitsPerSample == 32):
+	case tag == formatFloat && f.BitsPerSample == 32:
+		f.Float = true
+	default:
+		return fmt.Errorf("audio: unsupported WAV format %d with %d bits", tag, f.BitsPerSample)
+	}
+	if f.Channels <= 0 || f.SampleRate <= 0 {
+		return fmt.Errorf("audio: invalid WAV format %d Hz, %d channels", f.SampleRate, f.Channels)
+	}
+	wr.Format = f
+
+	return nil
+}
+
+// Read decodes up to len(samples) interleaved samples, always whole frames.
+// It returns the number of samples read and io.EOF at the end of the data.
+func (wr *Reader) Read(samples []float32) (int, error) {
+	bytesPerSample := wr.Format.BitsPerSample / 8
+	frames := len(samples) / wr.Format.Channels
+	if frames == 0 {
+		return 0, fmt.Errorf("audio: buffer smaller than a frame")
+	}
+
+	size := int64(frames * wr.Format.frameSize())
+	if wr.remaining >= 0 && size > wr.remaining {
+		size = wr.remaining - wr.remaining%int64(wr.Format.frameSize())
+	}
+	if size == 0 {
+		return 0, io.EOF
+	}
+	if int64(cap(wr.buf)) < size {
+		wr.buf = make([]byte, size)
+	}
+	buf := wr.buf[:size]
+
+	n, err := io.ReadFull(wr.r, buf)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0) {
+		err = nil
+		if n == 0 {
+			err = io.EOF
+		}
+	}
+	n -= n % wr.Format.frameSize()
+	if wr.remaining >= 0 {
+		wr.remaining -= int64(n)
+	}
+
+	count := n / bytesPerSample
+	for i := 0; i < count; i++ {
+		samples[i] = wr.decode(buf[i*bytesPerSample:])
+	}
+
+	return count, err
+}
+
+func (wr *Reader) decode(b []byte) float32 {
+	switch wr.Format.BitsPerSample {
+	case 8:
+		return float32(int(b[0])-128) / 128
+	case 16:
+		return float32(int16(binary.LittleEndian.Uint16(b))) / 32768
+	case 24:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float32(v) / (1 << 23)
+	default:
+		bits := binary.LittleEndian.Uint32(b)
+		if wr.Format.Float {
+			return math.Float32frombits(bits)
+		}
+		return float32(float64(int32(bits)) / (1 << 31))
+	}
+}
+
+// ReadAll decodes the rest of the data
+func (wr *Reader) ReadAll() ([]float32, error) {
+	var out []float32
+	buf := make([]float32, 8192*wr.Format.Channels)
+	for {
+		n, err := wr.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
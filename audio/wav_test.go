@@ -0,0 +1,258 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sine returns n samples of a tone with an amplitude of 0.5
+func sine(freq float64, rate, n int) []float32 {
+	samples := make([]float32, n)
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+func TestWavRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		channels   int
+		frames     int
+		seekable   bool
+	}{
+		{"mono file", 16000, 1, 16000, true},
+		{"stereo file", 44100, 2, 1000, true},
+		{"mono stream", 8000, 1, 800, false},
+		{"stereo stream", 48000, 2, 4801, false},
+		{"empty file", 16000, 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := sine(440, tt.sampleRate, tt.frames*tt.channels)
+			// samples out of range are clipped
+			if len(in) > 1 {
+				in[0], in[1] = 1.5, -1.5
+			}
+
+			var data []byte
+			if tt.seekable {
+				f, err := os.Create(filepath.Join(t.TempDir(), "out.wav"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				writeWav(t, f, tt.sampleRate, tt.channels, in)
+				if data, err = os.ReadFile(f.Name()); err != nil {
+					t.Fatal(err)
+				}
+				if size := binary.LittleEndian.Uint32(data[40:]); int(size) != len(in)*2 {
+					t.Errorf("data size %d, want %d", size, len(in)*2)
+				}
+			} else {
+				var b bytes.Buffer
+				writeWav(t, &b, tt.sampleRate, tt.channels, in)
+				data = b.Bytes()
+				if size := binary.LittleEndian.Uint32(data[40:]); size != unknownSize {
+					t.Errorf("data size %d, want unknown", size)
+				}
+			}
+
+			r, err := NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Format{SampleRate: tt.sampleRate, Channels: tt.channels, BitsPerSample: 16}
+			if r.Format != want {
+				t.Errorf("format %+v, want %+v", r.Format, want)
+			}
+			out, err := r.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != len(in) {
+				t.Fatalf("read %d samples, want %d", len(out), len(in))
+			}
+			for i := range in {
+				expected := max(-1, min(1, in[i]))
+				if math.Abs(float64(out[i]-expected)) > 2.0/32768 {
+					t.Fatalf("sample %d is %f, want %f", i, out[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func writeWav(t *testing.T, w io.Writer, sampleRate, channels int, samples []float32) {
+	t.Helper()
+
+	ww, err := NewWriter(w, sampleRate, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in two parts, to check the writer does not buffer
+	half := len(samples) / 2 / channels * channels
+	if err := ww.Write(samples[:half]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ww.Write(samples[half:]); err != nil {
+		t.Fatal(err)
+	}
+	if frames := ww.Frames(); frames != int64(len(samples)/channels) {
+		t.Errorf("%d frames written, want %d", frames, len(samples)/channels)
+	}
+	if err := ww.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wavFile builds a WAV file with a format chunk, other chunks and the data
+func wavFile(format []byte, data []byte, chunks ...[]byte) []byte {
+	chunk := func(id string, body []byte) []byte {
+		c := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+		c = append(c, body...)
+		if len(body)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+
+	body := []byte("WAVE")
+	body = append(body, chunk("fmt ", format)...)
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	body = append(body, chunk("data", data)...)
+
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// fmtChunk is the body of a format chunk, extensible when sub is not 0
+func fmtChunk(tag uint16, channels, sampleRate, bits int, sub uint16) []byte {
+	f := binary.LittleEndian.AppendUint16(nil, tag)
+	f = binary.LittleEndian.AppendUint16(f, uint16(channels))
+	f = binary.LittleEndian.AppendUint32(f, uint32(sampleRate))
+	f = binary.LittleEndian.AppendUint32(f, uint32(sampleRate*channels*bits/8))
+	f = binary.LittleEndian.AppendUint16(f, uint16(channels*bits/8))
+	f = binary.LittleEndian.AppendUint16(f, uint16(bits))
+	if sub != 0 {
+		f = binary.LittleEndian.AppendUint16(f, 22)
+		f = binary.LittleEndian.AppendUint16(f, uint16(bits))
+		f = binary.LittleEndian.AppendUint32(f, 0)
+		f = binary.LittleEndian.AppendUint16(f, sub)
+		f = append(f, make([]byte, 14)...)
+	}
+	return f
+}
+
+func TestReaderFormats(t *testing.T) {
+	float32LE := func(values ...float32) []byte {
+		var b []byte
+		for _, v := range values {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+		}
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		file   []byte
+		format Format
+		want   []float32
+	}{
+		{
+			name:   "8 bit",
+			file:   wavFile(fmtChunk(formatPCM, 1, 8000, 8, 0), []byte{128, 192, 0}),
+			format: Format{SampleRate: 8000, Channels: 1, BitsPerSample: 8},
+			want:   []float32{0, 0.5, -1},
+		},
+		{
+			name:   "24 bit stereo",
+			file:   wavFile(fmtChunk(formatPCM, 2, 48000, 24, 0), []byte{0, 0, 0x40, 0, 0, 0xc0}),
+			format: Format{SampleRate: 48000, Channels: 2, BitsPerSample: 24},
+			want:   []float32{0.5, -0.5},
+		},
+		{
+			name:   "32 bit",
+			file:   wavFile(fmtChunk(formatPCM, 1, 16000, 32, 0), []byte{0, 0, 0, 0x40, 0, 0, 0, 0x80}),
+			format: Format{SampleRate: 16000, Channels: 1, BitsPerSample: 32},
+			want:   []float32{0.5, -1},
+		},
+		{
+			name:   "float",
+			file:   wavFile(fmtChunk(formatFloat, 1, 22050, 32, 0), float32LE(0.25, -0.75)),
+			format: Format{SampleRate: 22050, Channels: 1, BitsPerSample: 32, Float: true},
+			want:   []float32{0.25, -0.75},
+		},
+		{
+			name:   "extensible float",
+			file:   wavFile(fmtChunk(formatExtensible, 1, 48000, 32, formatFloat), float32LE(0.125)),
+			format: Format{SampleRate: 48000, Channels: 1, BitsPerSample: 32, Float: true},
+			want:   []float32{0.125},
+		},
+		{
+			name:   "other chunks",
+			file:   wavFile(fmtChunk(formatPCM, 1, 16000, 16, 0), []byte{0, 0x40}, []byte("LIST\x03\x00\x00\x00abc\x00")),
+			format: Format{SampleRate: 16000, Channels: 1, BitsPerSample: 16},
+			want:   []float32{0.5},
+		},
+		{
+			name:   "partial frame",
+			file:   wavFile(fmtChunk(formatPCM, 2, 16000, 16, 0), []byte{0, 0x40, 0, 0xc0, 0, 0x40}),
+			format: Format{SampleRate: 16000, Channels: 2, BitsPerSample: 16},
+			want:   []float32{0.5, -0.5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Format != tt.format {
+				t.Errorf("format %+v, want %+v", r.Format, tt.format)
+			}
+			out, err := r.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != len(tt.want) {
+				t.Fatalf("samples %v, want %v", out, tt.want)
+			}
+			for i := range out {
+				if out[i] != tt.want[i] {
+					t.Fatalf("samples %v, want %v", out, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"not a wav", []byte("OggS\x00\x02 and some more bytes")},
+		{"unsupported format", wavFile(fmtChunk(2, 1, 8000, 4, 0), []byte{1, 2})},
+		{"float of 64 bits", wavFile(fmtChunk(formatFloat, 1, 8000, 64, 0), make([]byte, 8))},
+		{"no channels", wavFile(fmtChunk(formatPCM, 0, 8000, 16, 0), nil)},
+		{"no data", wavFile(fmtChunk(formatPCM, 1, 8000, 16, 0), nil)[:36]},
+	}
+	for _, tt := range tests {
+		if _, err := NewReader(bytes.NewReader(tt.file)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("short"))); !errors.Is(err, ErrNotWav) {
+		t.Errorf("short file: error %v, want ErrNotWav", err)
+	}
+}
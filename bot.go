@@ -13,29 +13,40 @@ import (
 )
 
 const (
-	cmdStart      = "/start"
-	cmdReset      = "/reset"
-	cmdModel      = "/model"
-	cmdTemp       = "/temperature"
-	cmdPrompt     = "/prompt"
-	cmdAge        = "/age"
-	cmdPromptCL   = "/defaultprompt"
-	cmdInfo = "/info"
-	cmdLang       = "/lang"
-	cmdToJapanese = "/ja"
-	cmdToEnglish  = "/en"
-	cmdToRussian  = "/ru"
-	cmdToItalian  = "/it"
-	cmdToSpanish  = "/es"
-	cmdToChinese  = "/cn"
-	cmdRoles      = "/roles"
-	cmdRole       = "/role"
-	cmdQA         = "/qa"
-	cmdUsers      = "/users"
-	cmdAddUser    = "/add"
-	cmdDelUser    = "/del"
-	cmdHelp       = "/help"
-	cmdMiniApp    = "/webapp"
+	cmdStart         = "/start"
+	cmdReset         = "/reset"
+	cmdModel         = "/model"
+	cmdTemp          = "/temperature"
+	cmdPrompt        = "/prompt"
+	cmdAge           = "/age"
+	cmdThinking      = "/thinking"
+	cmdPromptCL      = "/defaultprompt"
+	cmdInfo          = "/info"
+	cmdLang          = "/lang"
+	cmdToJapanese    = "/ja"
+	cmdToEnglish     = "/en"
+	cmdToRussian     = "/ru"
+	cmdToItalian     = "/it"
+	cmdToSpanish     = "/es"
+	cmdToChinese     = "/cn"
+	cmdRoles         = "/roles"
+	cmdRole          = "/role"
+	cmdQA            = "/qa"
+	cmdTools         = "/tools"
+	cmdUsage         = "/usage"
+	cmdSearch        = "/search"
+	cmdExport        = "/export"
+	cmdVoice         = "/voice"
+	cmdEdits         = "/edits"
+	cmdStop          = "/stop"
+	cmdNew           = "/new"
+	cmdThreads       = "/threads"
+	cmdBudget        = "/budget"
+	cmdUsers         = "/users"
+	cmdAddUser       = "/add"
+	cmdDelUser       = "/del"
+	cmdHelp          = "/help"
+	cmdMiniApp       = "/webapp"
 	msgStart         = "This bot will answer your messages using Claude AI"
 	masterPrompt     = "You are a helpful assistant. You always try to answer truthfully. If you don't know the answer, just say that you don't know, don't try to make up an answer. Don't explain yourself. Do not introduce yourself, just answer the user concisely."
 	defaultModelName = "default"
@@ -57,12 +68,25 @@ var (
 	btnDelete  = tele.Btn{Text: "Delete", Unique: "btnDelete", Data: "delete"}
 	btnCancel  = tele.Btn{Text: "Cancel", Unique: "btnRole", Data: "cancel"}
 
-	btnReset = tele.Btn{Text: "New Conversation", Unique: "btnreset", Data: "r"}
-	btnEmpty = tele.Btn{Text: "", Data: "no_data"}
+	btnTool = tele.Btn{Unique: "btnTool"}
+
+	btnReset   = tele.Btn{Text: "New Conversation", Unique: "btnreset", Data: "r"}
+	btnSources = tele.Btn{Text: "Sources", Unique: "btnSources", Data: "s"}
+	btnStop    = tele.Btn{Text: "Stop", Unique: "btnStop", Data: "s"}
+	btnEmpty   = tele.Btn{Text: "", Data: "no_data"}
+
+	// sourcesMenu is the reply menu of answers citing sources, which keep
+	// the sources button once the menu is removed
+	sourcesMenu     = &tele.ReplyMarkup{ResizeKeyboard: true, OneTimeKeyboard: true}
+	keptSourcesMenu = &tele.ReplyMarkup{}
+	stopMenu        = &tele.ReplyMarkup{}
 )
 
 func init() {
 	replyMenu.Inline(menu.Row(btnReset))
+	sourcesMenu.Inline(menu.Row(btnSources), menu.Row(btnReset))
+	keptSourcesMenu.Inline(menu.Row(btnSources))
+	stopMenu.Inline(menu.Row(btnStop))
 	removeMenu.Inline(menu.Row(btnEmpty))
 }
 
@@ -99,7 +123,7 @@ func (s *Server) run() {
 	s.loadUsers()
 
 	s.Lock()
-	b.Use(s.whitelist())
+	b.Use(s.whitelist(), s.groupFilter())
 	s.bot = b
 	s.Unlock()
 
@@ -108,19 +132,29 @@ func (s *Server) run() {
 	})
 
 	b.Handle(cmdHelp, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
 		helpText := fmt.Sprintf(`%s
 
 **General:**
 /help - %s
 /info - %s
+/usage - %s
+/search <text> - %s
+/export [md|json|html] - %s
+/voice - %s
+/edits - %s
 /reset - %s
+/stop - %s
+/new [text] - %s
+/threads - %s
 
 **Model Settings:**
 /model - %s
 /temperature - %s
 /age <days> - %s
+/thinking <tokens> - %s
+/tools - %s
 
 **Prompts & Roles:**
 /prompt <text> - %s
@@ -141,10 +175,20 @@ func (s *Server) run() {
 			chat.t("Available commands:"),
 			chat.t("Show this help message"),
 			chat.t("Show current settings"),
+			chat.t("Show spend for this month"),
+			chat.t("Search conversations"),
+			chat.t("Export conversation as a file"),
+			chat.t("Toggle voice replies"),
+			chat.t("Toggle branching on edits of older messages"),
 			chat.t("Reset conversation history"),
+			chat.t("Stop the answer being generated"),
+			chat.t("Start a new thread"),
+			chat.t("Continue a thread from the web app"),
 			chat.t("Select AI model"),
 			chat.t("Set creativity level"),
 			chat.t("Set conversation history age limit"),
+			chat.t("Set thinking budget, 0 for model default"),
+			chat.t("Toggle available tools"),
 			chat.t("Set custom system prompt"),
 			chat.t("Reset to default prompt"),
 			chat.t("Manage saved roles"),
@@ -157,10 +201,8 @@ func (s *Server) run() {
 			chat.t("Translate to Chinese"),
 			chat.t("Set bot language"))
 
-		return c.Send(ConvertMarkdownToTelegramMarkdownV2(helpText), "text", &tele.SendOptions{
-			ReplyTo:   c.Message(),
-			ParseMode: tele.ModeMarkdownV2,
-		})
+		_, err := sendAnswer(c, helpText, nil, nil)
+		return err
 	})
 
 	b.Handle(cmdMiniApp, func(c tele.Context) error {
@@ -179,7 +221,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(cmdModel, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		model := strings.TrimSpace(c.Message().Payload)
 		if model == "" {
 			rows := []tele.Row{}
@@ -200,14 +242,14 @@ func (s *Server) run() {
 		}
 		Log.WithField("user", c.Sender().Username).Info("Selected model ", model)
 		chat.ModelName = model
-		s.db.Save(&chat)
+		s.saveChat(chat)
 
 		return c.Send(chat.t("Model set to {{.model}}", &i18n.Replacements{"model": model}))
 	})
 
 	b.Handle(cmdTemp, func(c tele.Context) error {
 		menu.Inline(menu.Row(btnT0, btnT2, btnT4, btnT6, btnT8, btnT10))
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
 		return c.Send(
 			fmt.Sprintf(
@@ -221,7 +263,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(cmdRole, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		name := strings.TrimSpace(c.Message().Payload)
 		if err := ValidateRoleName(name); err != nil {
 			return c.Reply(c.Message(),
@@ -238,7 +280,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(cmdRoles, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		roles := chat.User.Roles
 
 		rows := []tele.Row{}
@@ -274,7 +316,7 @@ func (s *Server) run() {
 
 	b.Handle(&btnCreate, func(c tele.Context) error {
 		Log.WithField("user", c.Sender().Username).Info("Selected role ", c.Data())
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
 		user := chat.User
 		if c.Data() == "cancel" {
@@ -285,7 +327,7 @@ func (s *Server) run() {
 
 		if c.Data() == "___default___" {
 			chat.MasterPrompt = masterPrompt
-			s.db.Save(&chat)
+			s.saveChat(chat)
 			s.setChatRole(nil, chat.ChatID)
 
 			return c.Edit(chat.t("Default prompt set"))
@@ -327,7 +369,7 @@ func (s *Server) run() {
 
 	b.Handle(&btnUpdate, func(c tele.Context) error {
 		Log.WithField("user", c.Sender().Username).Info("Selected option ", c.Data())
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		user := chat.User
 
 		if c.Data() != "update" {
@@ -379,7 +421,7 @@ func (s *Server) run() {
 
 	b.Handle(&btnDelete, func(c tele.Context) error {
 		Log.WithField("user", c.Sender().Username).Info("Selected option ", c.Data())
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
 		if c.Data() != "delete" {
 			roleID := asUint(c.Data())
@@ -422,7 +464,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(cmdAge, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		ageStr := strings.TrimSpace(c.Message().Payload)
 		age, err := ValidateAge(ageStr)
 		if err != nil {
@@ -432,7 +474,7 @@ func (s *Server) run() {
 			)
 		}
 		chat.ConversationAge = int64(age)
-		s.db.Save(&chat)
+		s.saveChat(chat)
 
 		return c.Reply(
 			c.Message(),
@@ -440,8 +482,26 @@ func (s *Server) run() {
 		)
 	})
 
+	b.Handle(cmdThinking, func(c tele.Context) error {
+		chat := s.getChat(c)
+		budget, err := ValidateThinkingBudget(strings.TrimSpace(c.Message().Payload))
+		if err != nil {
+			return c.Reply(
+				c.Message(),
+				chat.t("Invalid thinking budget: {{.error}}", &i18n.Replacements{"error": err.Error()}),
+			)
+		}
+		chat.ThinkingBudget = budget
+		s.saveChat(chat)
+
+		return c.Reply(
+			c.Message(),
+			chat.t("Thinking budget set to {{.budget}}", &i18n.Replacements{"budget": budget}),
+		)
+	})
+
 	b.Handle(cmdPrompt, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		query := strings.TrimSpace(c.Message().Payload)
 		if err := ValidatePrompt(query); err != nil {
 			return c.Reply(
@@ -451,24 +511,24 @@ func (s *Server) run() {
 		}
 
 		chat.MasterPrompt = query
-		s.db.Save(&chat)
+		s.saveChat(chat)
 
 		return c.Reply(c.Message(), chat.t("Prompt set"))
 	})
 
 	b.Handle(cmdPromptCL, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		chat.MasterPrompt = masterPrompt
 		chat.RoleID = nil
-		s.db.Save(&chat)
+		s.saveChat(chat)
 
 		return c.Reply(c.Message(), chat.t("Default prompt set"))
 	})
 
 	b.Handle(cmdQA, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		chat.QA = !chat.QA
-		s.db.Save(&chat)
+		s.saveChat(chat)
 		status := "disabled"
 		if chat.QA {
 			status = "enabled"
@@ -478,8 +538,87 @@ func (s *Server) run() {
 		return c.Reply(c.Message(), text)
 	})
 
+	b.Handle(cmdVoice, func(c tele.Context) error {
+		chat := s.getChat(c)
+		if s.conf.TTSEndpoint == "" {
+			return c.Reply(c.Message(), chat.t("Voice replies are not configured"))
+		}
+		chat.Voice = !chat.Voice
+		s.db.Model(&Chat{}).Where("id = ?", chat.ID).Update("voice", chat.Voice)
+		status := "disabled"
+		if chat.Voice {
+			status = "enabled"
+		}
+		text := chat.t("Voice replies are {{.status}}", &i18n.Replacements{"status": chat.t(status)})
+
+		return c.Reply(c.Message(), text)
+	})
+
+	b.Handle(cmdEdits, func(c tele.Context) error {
+		chat := s.getChat(c)
+		chat.BranchEdits = !chat.BranchEdits
+		s.db.Model(&Chat{}).Where("id = ?", chat.ID).Update("branch_edits", chat.BranchEdits)
+		status := "disabled"
+		if chat.BranchEdits {
+			status = "enabled"
+		}
+		text := chat.t("Branching on edits of older messages is {{.status}}", &i18n.Replacements{"status": chat.t(status)})
+
+		return c.Reply(c.Message(), text)
+	})
+
+	b.Handle(cmdTools, func(c tele.Context) error {
+		chat := s.getChat(c)
+		model := s.getModel(chat.ModelName)
+
+		return c.Send(chat.t("Select tools"), s.toolsMenu(chat, model))
+	})
+
+	b.Handle(&btnTool, func(c tele.Context) error {
+		Log.WithField("user", c.Sender().Username).Info("Toggled tool ", c.Data())
+		chat := s.getChat(c)
+		model := s.getModel(chat.ModelName)
+
+		enabled := chat.GetEnabledToolsArray()
+		if in_array(c.Data(), enabled) {
+			var rest []string
+			for _, key := range enabled {
+				if key != c.Data() {
+					rest = append(rest, key)
+				}
+			}
+			enabled = rest
+		} else {
+			enabled = append(enabled, c.Data())
+		}
+		chat.SetEnabledToolsFromArray(s.tools.FilterKeys(enabled))
+		s.db.Model(&Chat{}).Where("id = ?", chat.ID).Update("enabled_tools", chat.EnabledTools)
+
+		return c.Edit(chat.t("Select tools"), s.toolsMenu(chat, model))
+	})
+
+	b.Handle(cmdUsage, func(c tele.Context) error {
+		chat := s.getChat(c)
+		from := startOfMonth(time.Now())
+		summary := s.getUsageSummary(chat.UserID, 0, from, from.AddDate(0, 1, 0))
+
+		return c.Reply(c.Message(), s.formatUsage(chat, summary))
+	}, s.privateOnly())
+
+	b.Handle(cmdSearch, s.onSearch, s.privateOnly())
+	b.Handle(cmdExport, s.onExport, s.privateOnly())
+
+	b.Handle(cmdNew, func(c tele.Context) error {
+		go s.onNewThread(c)
+
+		return nil
+	})
+
+	b.Handle(cmdThreads, s.onThreads, s.privateOnly())
+	b.Handle(&btnThread, s.onThreadSelected, s.privateOnly())
+
 	b.Handle(cmdInfo, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
 		prompt := chat.MasterPrompt
 		role := chat.t("default")
@@ -539,7 +678,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(cmdLang, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		langCode := strings.TrimSpace(c.Message().Payload)
 		if err := ValidateLanguageCode(langCode); err != nil {
 			return c.Reply(
@@ -548,7 +687,7 @@ func (s *Server) run() {
 			)
 		}
 		chat.Lang = langCode
-		s.db.Save(&chat)
+		s.saveChat(chat)
 		return c.Reply(
 			c.Message(),
 			fmt.Sprintf("Language set to %s", chat.Lang),
@@ -557,43 +696,63 @@ func (s *Server) run() {
 
 	b.Handle(&btnModel, func(c tele.Context) error {
 		Log.WithField("user", c.Sender().Username).Info("Selected model ", c.Data())
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		chat.ModelName = c.Data()
-		s.db.Save(&chat)
+		s.saveChat(chat)
 
 		return c.Edit(chat.t("Model set to {{.model}}", &i18n.Replacements{"model": c.Data()}))
 	})
 
 	b.Handle(&btnT0, func(c tele.Context) error {
 		Log.WithField("user", c.Sender().Username).Info("Selected temperature ", c.Data())
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		temp, err := ValidateTemperature(c.Data())
 		if err != nil {
 			Log.WithField("error", err).Warn("Invalid temperature value")
 			return c.Edit(chat.t("Invalid temperature value"))
 		}
 		chat.Temperature = temp
-		s.db.Save(&chat)
+		s.saveChat(chat)
 
 		return c.Edit(chat.t("Temperature set to {{.temp}}", &i18n.Replacements{"temp": c.Data()}))
 	})
 
 	b.Handle(&btnReset, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
-		s.deleteHistory(chat.ID)
+		s.deleteHistory(chat)
 		s.setChatLastMessageID(nil, chat.ChatID)
 
 		return c.Edit(removeMenu)
 	})
 
+	b.Handle(&btnSources, func(c tele.Context) error {
+		go s.onSources(c)
+
+		return nil
+	})
+
+	b.Handle(cmdStop, func(c tele.Context) error {
+		go s.onStop(c)
+
+		return nil
+	})
+
+	b.Handle(&btnStop, func(c tele.Context) error {
+		go s.onStop(c)
+
+		return nil
+	})
+
+	b.Handle(&btnVoiceConfirm, s.onVoiceCommandConfirm)
+
 	b.Handle(cmdReset, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		// Log.Info("Resetting chat")
-		s.deleteHistory(chat.ID)
+		s.deleteHistory(chat)
 		if chat.MessageID != nil {
 			id, _ := strconv.Atoi(*chat.MessageID)
-			sentMessage := &tele.Message{ID: id, Chat: &tele.Chat{ID: chat.ChatID}}
+			sentMessage := &tele.Message{ID: id, Chat: c.Chat()}
 
 			// Log.Infof("Resetting chat menu, sentMessage: %v", sentMessage)
 			c.Bot().Edit(sentMessage, removeMenu)
@@ -607,7 +766,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(tele.OnText, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 
 		// not handling  user input through stepper/state machine
 		if chat.User.State == nil {
@@ -652,7 +811,7 @@ func (s *Server) run() {
 	})
 
 	b.Handle(tele.OnDocument, func(c tele.Context) error {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		go s.onDocument(c)
 
 		// b.React(c.Recipient(), c.Message(), react.React(react.Eyes))
@@ -660,12 +819,30 @@ func (s *Server) run() {
 		return c.Send(chat.t("Processing document. Please wait..."))
 	})
 
+	b.Handle(tele.OnEdited, func(c tele.Context) error {
+		go s.onEdited(c)
+
+		return nil
+	})
+
 	b.Handle(tele.OnVoice, func(c tele.Context) error {
 		go s.onVoice(c)
 
 		return nil
 	})
 
+	b.Handle(tele.OnAudio, func(c tele.Context) error {
+		go s.onAudio(c)
+
+		return nil
+	})
+
+	b.Handle(tele.OnVideoNote, func(c tele.Context) error {
+		go s.onVideoNote(c)
+
+		return nil
+	})
+
 	b.Handle(tele.OnPhoto, func(c tele.Context) error {
 		go s.onPhoto(c)
 
@@ -719,9 +896,63 @@ func (s *Server) run() {
 		return nil
 	})
 
+	b.Handle(cmdBudget, func(c tele.Context) error {
+		if !in_array(c.Sender().Username, s.conf.AllowedTelegramUsers) {
+			return nil
+		}
+		args := strings.Fields(c.Message().Payload)
+		if len(args) != 2 {
+			return c.Reply(c.Message(), "Usage: /budget <username> <usd|default>")
+		}
+		if err := ValidateUsername(args[0]); err != nil {
+			return c.Reply(c.Message(), fmt.Sprintf("Invalid username: %s", err.Error()))
+		}
+		user := s.getUser(args[0])
+		if user.ID == 0 {
+			return c.Reply(c.Message(), "User not found")
+		}
+
+		var budget *float64
+		if args[1] != "default" {
+			amount, err := ValidateBudget(args[1])
+			if err != nil {
+				return c.Reply(c.Message(), fmt.Sprintf("Invalid budget: %s", err.Error()))
+			}
+			budget = &amount
+		}
+		s.db.Model(&User{}).Where("id", user.ID).Update("monthly_budget", budget)
+
+		return c.Reply(c.Message(), fmt.Sprintf("Monthly budget for %s: $%.2f", user.Username, s.getUserBudget(user.ID)))
+	})
+
 	b.Start()
 }
 
+// toolsMenu builds an inline keyboard with a toggle for every tool the model supports
+func (s *Server) toolsMenu(chat *Chat, model *AiModel) *tele.ReplyMarkup {
+	markup := &tele.ReplyMarkup{}
+	enabled := chat.GetEnabledToolsArray()
+
+	rows := []tele.Row{}
+	for _, tool := range s.tools.All() {
+		if tool.Supported != nil && !tool.Supported(model) {
+			continue
+		}
+		mark := "❌"
+		if in_array(tool.EnableKey, enabled) {
+			mark = "✅"
+		}
+		rows = append(rows, markup.Row(tele.Btn{
+			Text:   mark + " " + chat.t(tool.DisplayName),
+			Unique: btnTool.Unique,
+			Data:   tool.EnableKey,
+		}))
+	}
+	markup.Inline(rows...)
+
+	return markup
+}
+
 // Restrict returns a middleware that handles a list of provided
 // usernames with the logic defined by In and Out functions.
 // If the username is found in the Usernames field, In function will be called,
@@ -740,19 +971,31 @@ func Restrict(v RestrictConfig) tele.MiddlewareFunc {
 					return v.In(c)
 				}
 			}
+			if c.Chat() != nil {
+				for _, id := range v.Chats {
+					if id == c.Chat().ID {
+						return v.In(c)
+					}
+				}
+			}
 			return v.Out(c)
 		}
 	}
 }
 
 // Whitelist returns a middleware that skips the update for users
-// NOT specified in the usernames field.
+// NOT specified in the usernames field, unless it comes from an allowed group.
 func (s *Server) whitelist() tele.MiddlewareFunc {
 	return func(next tele.HandlerFunc) tele.HandlerFunc {
 		return Restrict(RestrictConfig{
 			Usernames: s.users,
+			Chats:     s.conf.AllowedTelegramGroups,
 			In:        next,
 			Out: func(c tele.Context) error {
+				// strangers talking in a group are none of our business
+				if isGroup(c.Chat()) {
+					return nil
+				}
 				return c.Reply(
 					c.Message(),
 					fmt.Sprintf("not allowed: %s", c.Sender().Username),
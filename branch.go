@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Chat messages form a tree: every message points to the one it follows and
+// the chat keeps the leaf of the branch in use. Edits and regenerations add
+// a sibling instead of overwriting, so earlier answers stay reachable.
+
+type BranchResponse struct {
+	ID        uint      `json:"id"`
+	Role      string    `json:"role"`
+	Content   *string   `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	Active    bool      `json:"active"`
+}
+
+// activeBranch returns the messages from the root to the chat's active leaf.
+// The walk ends early at a parent that no longer exists, e.g. pruned by age.
+func (c *Chat) activeBranch(messages []ChatMessage) []ChatMessage {
+	if c.ActiveLeafID == nil {
+		return nil
+	}
+
+	byID := make(map[uint]int, len(messages))
+	for i, msg := range messages {
+		byID[msg.ID] = i
+	}
+
+	var branch []ChatMessage
+	for next := c.ActiveLeafID; next != nil && len(branch) <= len(messages); {
+		i, ok := byID[*next]
+		if !ok {
+			break
+		}
+		branch = append(branch, messages[i])
+		next = messages[i].ParentID
+	}
+
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+
+	return branch
+}
+
+// messageChildren maps each message ID to its children in creation order,
+// roots are listed under 0
+func messageChildren(messages []ChatMessage) map[uint][]uint {
+	children := make(map[uint][]uint)
+	for _, msg := range messages {
+		var parent uint
+		if msg.ParentID != nil {
+			parent = *msg.ParentID
+		}
+		children[parent] = append(children[parent], msg.ID)
+	}
+	for _, ids := range children {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+
+	return children
+}
+
+// siblingIDs returns the IDs of the message and its alternatives
+func siblingIDs(children map[uint][]uint, msg ChatMessage) []uint {
+	var parent uint
+	if msg.ParentID != nil {
+		parent = *msg.ParentID
+	}
+
+	return children[parent]
+}
+
+// latestLeaf follows the most recent child from the message down to a leaf
+func latestLeaf(children map[uint][]uint, id uint) uint {
+	for {
+		next := children[id]
+		if len(next) == 0 {
+			return id
+		}
+		id = next[len(next)-1]
+	}
+}
+
+// subtreeIDs returns the message and all of its descendants
+func subtreeIDs(children map[uint][]uint, id uint) []uint {
+	ids := []uint{id}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, children[ids[i]]...)
+	}
+
+	return ids
+}
+
+// appendMessage stores the message as a child of the chat's active leaf
+// and makes it the new leaf
+func (s *Server) appendMessage(db *gorm.DB, chat *Chat, msg *ChatMessage) error {
+	msg.ParentID = chat.ActiveLeafID
+	msg.ChatRecordID = &chat.ID
+	if err := db.Create(msg).Error; err != nil {
+		return err
+	}
+
+	return s.setActiveLeaf(db, chat, &msg.ID)
+}
+
+// setActiveLeaf switches the chat to the branch ending at the message
+func (s *Server) setActiveLeaf(db *gorm.DB, chat *Chat, id *uint) error {
+	var leaf *uint
+	if id != nil {
+		leaf = new(uint)
+		*leaf = *id
+	}
+	chat.ActiveLeafID = leaf
+
+	return db.Model(&Chat{}).Where("id = ?", chat.ID).UpdateColumn("active_leaf_id", leaf).Error
+}
+
+// loadThreadMessages returns all messages of a webapp thread, across branches
+func (s *Server) loadThreadMessages(db *gorm.DB, chat *Chat) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	err := db.Where("chat_id = ?", chat.ChatID).Order("id ASC").Find(&messages).Error
+
+	return messages, err
+}
+
+// migrateMessageTree links the messages of chats created before branching
+// into a single branch, in creation order. Telegram chats store their
+// history under the chat record ID, webapp threads under ChatID.
+func migrateMessageTree(db *gorm.DB) error {
+	historyKey := "CASE WHEN chats.thread_id IS NULL THEN chats.id ELSE chats.chat_id END"
+
+	err := db.Exec(`UPDATE chat_messages SET parent_id = (
+			SELECT MAX(prev.id) FROM chat_messages prev
+			WHERE prev.chat_id = chat_messages.chat_id AND prev.id < chat_messages.id
+		)
+		WHERE parent_id IS NULL
+		AND chat_id IN (SELECT ` + historyKey + ` FROM chats WHERE active_leaf_id IS NULL)`).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Exec(`UPDATE chats SET active_leaf_id = (
+			SELECT MAX(id) FROM chat_messages WHERE chat_messages.chat_id = ` + historyKey + `
+		)
+		WHERE active_leaf_id IS NULL`).Error
+}
+
+// getMessageBranches lists the alternatives of a message, including itself
+func (s *Server) getMessageBranches(w http.ResponseWriter, r *http.Request, messageID uint) {
+	user := getUserFromContext(r)
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	message, chat, err := s.findUserChatMessage(s.db, user.ID, messageID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			s.writeJSONError(w, http.StatusNotFound, "Message not found")
+		} else {
+			s.writeJSONError(w, http.StatusInternalServerError, "Failed to find message")
+		}
+		return
+	}
+
+	messages, err := s.loadThreadMessages(s.db, chat)
+	if err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to fetch messages")
+		return
+	}
+
+	active := make(map[uint]bool)
+	for _, msg := range chat.activeBranch(messages) {
+		active[msg.ID] = true
+	}
+	byID := make(map[uint]ChatMessage, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	var branches []BranchResponse
+	for _, id := range siblingIDs(messageChildren(messages), *message) {
+		msg := byID[id]
+		branches = append(branches, BranchResponse{
+			ID:        msg.ID,
+			Role:      msg.Role,
+			Content:   msg.Content,
+			CreatedAt: msg.CreatedAt,
+			Active:    active[msg.ID],
+		})
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string][]BranchResponse{"branches": branches})
+}
+
+// activateBranch makes the message part of the active branch, continuing
+// with its most recent descendants, and returns the new branch
+func (s *Server) activateBranch(w http.ResponseWriter, r *http.Request, messageID uint) {
+	user := getUserFromContext(r)
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	message, chat, err := s.findUserChatMessage(s.db, user.ID, messageID)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			s.writeJSONError(w, http.StatusNotFound, "Message not found")
+		} else {
+			s.writeJSONError(w, http.StatusInternalServerError, "Failed to find message")
+		}
+		return
+	}
+
+	messages, err := s.loadThreadMessages(s.db, chat)
+	if err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to fetch messages")
+		return
+	}
+
+	leaf := latestLeaf(messageChildren(messages), message.ID)
+	if err := s.setActiveLeaf(s.db, chat, &leaf); err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to switch branch")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string][]MessageResponse{"messages": branchMessageResponses(chat, messages)})
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,32 +27,34 @@ func (c *Chat) addToolResultToDialog(id, content string) {
 		})
 }
 
-func (c *Chat) addImageToDialog(text, path string) {
+func (c *Chat) addImageToDialog(text, path string, sender *string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	c.History = append(c.History,
 		ChatMessage{
-			Role:      "user",
-			Content:   &text,
-			ImagePath: &path,
-			ChatID:    c.ChatID,
-			CreatedAt: time.Now(),
+			Role:       "user",
+			Content:    &text,
+			ImagePath:  &path,
+			SenderName: sender,
+			ChatID:     c.ChatID,
+			CreatedAt:  time.Now(),
 		})
 }
 
-func (c *Chat) addFileToDialog(text, path, filename string) {
+func (c *Chat) addFileToDialog(text, path, filename string, sender *string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	c.History = append(c.History,
 		ChatMessage{
-			Role:      "user",
-			Content:   &text,
-			ImagePath: &path,
-			Filename:  &filename,
-			ChatID:    c.ChatID,
-			CreatedAt: time.Now(),
+			Role:       "user",
+			Content:    &text,
+			ImagePath:  &path,
+			Filename:   &filename,
+			SenderName: sender,
+			ChatID:     c.ChatID,
+			CreatedAt:  time.Now(),
 		})
 }
 
@@ -66,18 +70,6 @@ func (c *Chat) addUserMessage(text string) {
 		})
 }
 
-func (c *Chat) addAssistantMessage(text string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.History = append(c.History,
-		ChatMessage{
-			Role:      "assistant",
-			Content:   &text,
-			ChatID:    c.ChatID,
-			CreatedAt: time.Now(),
-		})
-}
-
 func (c *Chat) addMessageToDialog(msg ChatMessage) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -92,6 +84,15 @@ func (c *Chat) getDialog(request *string) []*anthropic.Message {
 		c.addUserMessage(*request)
 	}
 
+	// Tool calls are only replayed when their results were stored too,
+	// otherwise the API rejects the dangling tool_use blocks
+	toolResults := make(map[string]bool)
+	for _, h := range c.History {
+		if h.ToolCallID != nil {
+			toolResults[*h.ToolCallID] = true
+		}
+	}
+
 	var history []*anthropic.Message
 	for _, h := range c.History {
 		if c.ConversationAge > 0 && h.CreatedAt.Before(time.Now().AddDate(0, 0, -int(c.ConversationAge))) {
@@ -116,13 +117,22 @@ func (c *Chat) getDialog(request *string) []*anthropic.Message {
 
 		var content []anthropic.Content
 
+		// In groups the model needs to know who is talking
+		text := ""
+		if h.Content != nil {
+			text = *h.Content
+		}
+		if h.SenderName != nil {
+			text = *h.SenderName + ": " + text
+		}
+
 		if h.Filename != nil && h.ImagePath != nil {
 			fileData, err := os.ReadFile(*h.ImagePath)
 			if err != nil {
 				Log.Warn("Error reading file", "error=", err)
 				continue
 			}
-			content = append(content, anthropic.NewTextContent(*h.Content))
+			content = append(content, anthropic.NewTextContent(text))
 			content = append(content, &anthropic.DocumentContent{
 				Source: anthropic.RawData(http.DetectContentType(fileData), fileData),
 			})
@@ -132,23 +142,48 @@ func (c *Chat) getDialog(request *string) []*anthropic.Message {
 				Log.Warn("Error reading image", "error=", err)
 				continue
 			}
-			content = append(content, anthropic.NewTextContent(*h.Content))
+			content = append(content, anthropic.NewTextContent(text))
 			content = append(content, &anthropic.ImageContent{
 				Source: anthropic.RawData(http.DetectContentType(imageData), imageData),
 			})
 		} else if h.Content != nil && *h.Content != "" {
-			content = append(content, anthropic.NewTextContent(*h.Content))
+			content = append(content, anthropic.NewTextContent(text))
 		}
 
 		// Handle tool calls in assistant messages
 		if role == "assistant" && len(h.ToolCalls) > 0 {
+			replayed := false
 			for _, tc := range h.ToolCalls {
+				if !toolResults[tc.ID] {
+					continue
+				}
 				content = append(content, &anthropic.ToolUseContent{
 					ID:    tc.ID,
 					Name:  tc.Function.Name,
 					Input: json.RawMessage(tc.Function.Arguments),
 				})
+				replayed = true
 			}
+
+			// With extended thinking the API expects the signed thinking
+			// blocks in front of the tool calls they led to
+			if replayed && len(h.Thinking) > 0 {
+				var thinking []anthropic.Content
+				for _, block := range h.Thinking {
+					if block.Signature == "" {
+						continue
+					}
+					thinking = append(thinking, &anthropic.ThinkingContent{
+						Thinking:  block.Thinking,
+						Signature: block.Signature,
+					})
+				}
+				content = append(thinking, content...)
+			}
+		}
+
+		if len(content) == 0 {
+			continue
 		}
 
 		history = append(history, anthropic.NewMessage(role, content))
@@ -168,6 +203,48 @@ func (c *Chat) getDialog(request *string) []*anthropic.Message {
 	return history
 }
 
+// systemPrompt returns the role or master prompt with the current date appended
+func (c *Chat) systemPrompt() string {
+	system := c.MasterPrompt
+	if c.RoleID != nil {
+		system = c.Role.Prompt
+	}
+
+	return system + fmt.Sprintf("\n\nCurrent date: %s", time.Now().Format("2006-01-02"))
+}
+
+// historyID is the chat_id of the chat's messages: Telegram chats keep their
+// history under the record ID, threads under ChatID
+func (c *Chat) historyID() int64 {
+	if c.ThreadID != nil {
+		return c.ChatID
+	}
+	return int64(c.ID)
+}
+
+// payerID is the user charged for the chat's API calls: the sender of a
+// group message, otherwise the owner of the chat
+func (c *Chat) payerID() uint {
+	if c.SenderID != 0 {
+		return c.SenderID
+	}
+	return c.UserID
+}
+
+// lastQuestion returns the index of the latest question in the history, -1
+// when there is none
+func (c *Chat) lastQuestion() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := len(c.History) - 1; i >= 0; i-- {
+		if c.History[i].Role == "user" && c.History[i].ToolCallID == nil {
+			return i
+		}
+	}
+
+	return -1
+}
+
 func (c *Chat) t(key string, replacements ...*i18n.Replacements) string {
 	return l.GetWithLocale(c.Lang, key, replacements...)
 }
@@ -194,7 +271,11 @@ func (c *Chat) getMessageID() *string {
 func (c *Chat) removeMenu(context tele.Context) {
 	c.mutex.Lock()
 	if c.MessageID != nil {
-		_, _ = context.Bot().EditReplyMarkup(tele.StoredMessage{MessageID: *c.MessageID, ChatID: c.ChatID}, removeMenu)
+		markup := removeMenu
+		if id, err := strconv.Atoi(*c.MessageID); err == nil && c.hasSources(id) {
+			markup = keptSourcesMenu
+		}
+		_, _ = context.Bot().EditReplyMarkup(tele.StoredMessage{MessageID: *c.MessageID, ChatID: context.Chat().ID}, markup)
 		c.MessageID = nil
 	}
 	c.mutex.Unlock()
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/tectiv3/chatgpt-bot/markdown"
+	tele "gopkg.in/telebot.v3"
+)
+
+// maxMessageLength is Telegram's limit for a text message, in UTF-16 code units
+const maxMessageLength = 4096
+
+// cut priorities, the chunker prefers the highest one that fits
+const (
+	cutAnywhere = iota
+	cutSpace
+	cutLine
+	cutParagraph
+)
+
+// splitFormatted splits a formatted text into messages of at most limit
+// UTF-16 code units. It cuts at paragraphs first, then lines and spaces,
+// never inside a link. Spans crossing a cut continue in the next message.
+func splitFormatted(f *markdown.Formatted, limit int) []*markdown.Formatted {
+	var chunks []*markdown.Formatted
+	text := f.Text
+	start := 0
+	for {
+		start = skipSpace(f, start)
+		if start >= len(text) {
+			return chunks
+		}
+
+		// end is as far as the chunk can reach, half is its middle
+		end, half, units := start, start, 0
+		for end < len(text) {
+			r, size := utf8.DecodeRuneInString(text[end:])
+			if units+utf16Len(r) > limit {
+				break
+			}
+			units += utf16Len(r)
+			end += size
+			if units <= limit/2 {
+				half = end
+			}
+		}
+		if end == len(text) {
+			return appendChunk(chunks, f, start, end)
+		}
+
+		// the best cut in the second half of the chunk, or anywhere in it
+		cut := bestCut(f, half, end)
+		if cut < 0 {
+			cut = bestCut(f, start+1, end)
+		}
+		if cut < 0 {
+			// a single word longer than a message
+			cut = end
+		}
+		chunks = appendChunk(chunks, f, start, cut)
+		start = cut
+	}
+}
+
+// bestCut finds the best place between from and to to cut the text at, -1
+// when there is none
+func bestCut(f *markdown.Formatted, from, to int) int {
+	cut, best := -1, cutAnywhere
+	for i := to; i >= from && i > 0; i-- {
+		priority := cutPriority(f.Text, i)
+		if priority > best && !inSpan(f, i, markdown.TextLink) {
+			cut, best = i, priority
+		}
+	}
+	return cut
+}
+
+// cutPriority rates a cut before the i-th byte of the text
+func cutPriority(text string, i int) int {
+	switch {
+	case text[i] == ' ':
+		return cutSpace
+	case text[i] != '\n':
+		return cutAnywhere
+	case text[i-1] == '\n' || strings.HasPrefix(text[i:], "\n\n"):
+		return cutParagraph
+	default:
+		return cutLine
+	}
+}
+
+// inSpan reports whether a cut at i would split a span of the style
+func inSpan(f *markdown.Formatted, i int, style markdown.Style) bool {
+	for _, span := range f.Spans {
+		if span.Style == style && span.Offset < i && i < span.Offset+span.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// skipSpace skips the line breaks and spaces a message does not start with.
+// The indentation of a code block continuing in the message is kept.
+func skipSpace(f *markdown.Formatted, i int) int {
+	for i < len(f.Text) && f.Text[i] == '\n' {
+		i++
+	}
+	if inSpan(f, i+1, markdown.Preformatted) {
+		return i
+	}
+	for i < len(f.Text) && (f.Text[i] == '\n' || f.Text[i] == ' ') {
+		i++
+	}
+	return i
+}
+
+// appendChunk adds the text between start and end, with the spans clipped
+// to it
+func appendChunk(chunks []*markdown.Formatted, f *markdown.Formatted, start, end int) []*markdown.Formatted {
+	text := strings.TrimRight(f.Text[start:end], " \n")
+	if strings.TrimSpace(text) == "" {
+		return chunks
+	}
+	end = start + len(text)
+
+	chunk := &markdown.Formatted{Text: text}
+	for _, span := range f.Spans {
+		from, to := max(span.Offset, start), min(span.Offset+span.Length, end)
+		if from >= to || strings.TrimSpace(f.Text[from:to]) == "" {
+			continue
+		}
+		span.Offset, span.Length = from-start, to-from
+		chunk.Spans = append(chunk.Spans, span)
+	}
+
+	return append(chunks, chunk)
+}
+
+// entityTypes maps the span styles to Telegram entities
+var entityTypes = map[markdown.Style]tele.EntityType{
+	markdown.Bold:         tele.EntityBold,
+	markdown.Italic:       tele.EntityItalic,
+	markdown.Strike:       tele.EntityStrikethrough,
+	markdown.Hidden:       tele.EntitySpoiler,
+	markdown.Monospace:    tele.EntityCode,
+	markdown.Preformatted: tele.EntityCodeBlock,
+	markdown.TextLink:     tele.EntityTextLink,
+	markdown.Quote:        tele.EntityBlockquote,
+}
+
+// messageEntities converts the spans of a text to Telegram entities, which
+// count in UTF-16 code units
+func messageEntities(f *markdown.Formatted) tele.Entities {
+	var entities tele.Entities
+	for _, span := range f.Spans {
+		offset := utf16Units(f.Text[:span.Offset])
+		entities = append(entities, tele.MessageEntity{
+			Type:     entityTypes[span.Style],
+			Offset:   offset,
+			Length:   utf16Units(f.Text[span.Offset : span.Offset+span.Length]),
+			URL:      span.URL,
+			Language: span.Language,
+		})
+	}
+	return entities
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+func utf16Units(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// sendAnswer sends a Markdown answer as text with message entities, see
+// sendFormatted
+func sendAnswer(c tele.Context, answer string, edit []tele.Editable, markup *tele.ReplyMarkup) ([]*tele.Message, error) {
+	return sendFormatted(c, markdown.Format(answer), edit, markup)
+}
+
+// sendFormatted sends a formatted text in as many messages as it takes,
+// editing the given messages into the first ones and deleting those left
+// over. Only the last message gets the markup. A message whose entities
+// Telegram rejects is sent as plain text instead. It returns the messages
+// sent, in order.
+func sendFormatted(c tele.Context, text *markdown.Formatted, edit []tele.Editable, markup *tele.ReplyMarkup) ([]*tele.Message, error) {
+	chunks := splitFormatted(text, maxMessageLength)
+	opts := replyOptions(c, tele.ModeDefault)
+
+	var sent []*tele.Message
+	for i, chunk := range chunks {
+		var menu *tele.ReplyMarkup
+		if i == len(chunks)-1 {
+			menu = markup
+		}
+		opts.Entities = messageEntities(chunk)
+
+		var msg *tele.Message
+		var err error
+		if i < len(edit) {
+			msg, err = c.Bot().Edit(edit[i], chunk.Text, &tele.SendOptions{Entities: opts.Entities}, menu)
+			if errors.Is(err, tele.ErrSameMessageContent) || errors.Is(err, tele.ErrMessageNotModified) {
+				// the part did not change
+				id, _ := edit[i].MessageSig()
+				msg, err = &tele.Message{Chat: c.Chat()}, nil
+				msg.ID, _ = strconv.Atoi(id)
+			}
+			if err != nil {
+				Log.Warn("Failed to edit the answer: ", err)
+			}
+		}
+		if msg == nil {
+			msg, err = c.Bot().Send(c.Chat(), chunk.Text, opts, menu)
+		}
+		if err != nil && len(opts.Entities) > 0 {
+			Log.Warn(err)
+			plain := *opts
+			plain.Entities = nil
+			msg, err = c.Bot().Send(c.Chat(), chunk.Text, &plain, menu)
+		}
+		if err != nil {
+			return sent, err
+		}
+		sent = append(sent, msg)
+		// in a group only the first message replies to the question
+		opts.ReplyTo = nil
+	}
+
+	for i := len(chunks); i < len(edit); i++ {
+		if err := c.Bot().Delete(edit[i]); err != nil {
+			Log.Warn("Failed to delete a part of the old answer: ", err)
+		}
+	}
+
+	return sent, nil
+}
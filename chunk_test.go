@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tectiv3/chatgpt-bot/markdown"
+	tele "gopkg.in/telebot.v3"
+)
+
+// joinChunks puts the chunks back together, a line break between each
+func joinChunks(chunks []*markdown.Formatted) string {
+	var texts []string
+	for _, chunk := range chunks {
+		texts = append(texts, chunk.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+func TestSplitFormatted(t *testing.T) {
+	paragraph := strings.Repeat("word ", 15) + "end."
+	code := "func main() {\n" + strings.Repeat("\tfmt.Println(\"x\")\n", 12) + "}"
+
+	tests := []struct {
+		name   string
+		src    string
+		limit  int
+		chunks int
+		check  func(t *testing.T, chunks []*markdown.Formatted)
+	}{
+		{
+			name:   "fits",
+			src:    "Hello **world**",
+			limit:  100,
+			chunks: 1,
+		},
+		{
+			name:   "paragraphs",
+			src:    paragraph + "\n\n" + paragraph + "\n\n" + paragraph,
+			limit:  2*len(paragraph) + 10,
+			chunks: 2,
+			check: func(t *testing.T, chunks []*markdown.Formatted) {
+				if chunks[0].Text != paragraph+"\n\n"+paragraph || chunks[1].Text != paragraph {
+					t.Errorf("not cut between paragraphs: %q", joinChunks(chunks))
+				}
+			},
+		},
+		{
+			name:   "bold across a cut",
+			src:    "**" + paragraph + " " + paragraph + "**",
+			limit:  len(paragraph) + 10,
+			chunks: 2,
+			check: func(t *testing.T, chunks []*markdown.Formatted) {
+				for i, chunk := range chunks {
+					if len(chunk.Spans) != 1 || chunk.Spans[0].Style != markdown.Bold ||
+						chunk.Spans[0].Offset != 0 || chunk.Spans[0].Length != len(chunk.Text) {
+						t.Errorf("chunk %d spans = %+v, want bold all over", i, chunk.Spans)
+					}
+				}
+			},
+		},
+		{
+			name:   "code block continues",
+			src:    "Code:\n\n```go\n" + code + "\n```",
+			limit:  120,
+			chunks: 3,
+			check: func(t *testing.T, chunks []*markdown.Formatted) {
+				for i, chunk := range chunks[1:] {
+					span := chunk.Spans[0]
+					if span.Style != markdown.Preformatted || span.Language != "go" || span.Offset != 0 {
+						t.Errorf("chunk %d does not continue the code block: %+v", i+1, chunk.Spans)
+					}
+					// the tab of the first line survives the cut
+					if !strings.HasPrefix(chunk.Text, "\t") && chunk.Text != "}" {
+						t.Errorf("chunk %d starts with %q", i+1, chunk.Text)
+					}
+				}
+				if got := strings.ReplaceAll(joinChunks(chunks), "\n\n", "\n"); !strings.Contains(got, code) {
+					t.Errorf("code changed:\n%s", got)
+				}
+			},
+		},
+		{
+			name:   "indented code continues",
+			src:    "```python\ndef f():\n" + strings.Repeat("    return 1\n", 20) + "```",
+			limit:  100,
+			chunks: 3,
+			check: func(t *testing.T, chunks []*markdown.Formatted) {
+				for i, chunk := range chunks[1:] {
+					if !strings.HasPrefix(chunk.Text, "    return") {
+						t.Errorf("chunk %d lost its indentation: %q", i+1, chunk.Text)
+					}
+				}
+			},
+		},
+		{
+			name:   "link kept whole",
+			src:    strings.Repeat("a ", 20) + "[a link with many words](https://example.com) after",
+			limit:  50,
+			chunks: 2,
+			check: func(t *testing.T, chunks []*markdown.Formatted) {
+				link := chunks[1].Spans[0]
+				if link.Style != markdown.TextLink || chunks[1].Text[link.Offset:link.Offset+link.Length] != "a link with many words" {
+					t.Errorf("link split: %q %+v", chunks[1].Text, chunks[1].Spans)
+				}
+			},
+		},
+		{
+			name:   "word longer than a message",
+			src:    strings.Repeat("x", 25),
+			limit:  10,
+			chunks: 3,
+		},
+		{
+			name:   "utf-16 units",
+			src:    strings.Repeat("😀", 8),
+			limit:  10,
+			chunks: 2,
+			check: func(t *testing.T, chunks []*markdown.Formatted) {
+				if chunks[0].Text != strings.Repeat("😀", 5) {
+					t.Errorf("first chunk %q, want 5 emoji of 2 units", chunks[0].Text)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitFormatted(markdown.Format(tt.src), tt.limit)
+			if len(chunks) != tt.chunks {
+				t.Fatalf("%d chunks, want %d: %q", len(chunks), tt.chunks, joinChunks(chunks))
+			}
+			for i, chunk := range chunks {
+				if n := utf16Units(chunk.Text); n > tt.limit {
+					t.Errorf("chunk %d has %d units, over the limit of %d", i, n, tt.limit)
+				}
+				for _, span := range chunk.Spans {
+					if span.Offset < 0 || span.Length <= 0 || span.Offset+span.Length > len(chunk.Text) {
+						t.Errorf("chunk %d: span %+v out of its text", i, span)
+					}
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, chunks)
+			}
+		})
+	}
+}
+
+func TestMessageEntities(t *testing.T) {
+	f := markdown.Format("😀 **bold** [link](https://example.com)\n\n```go\nx := 1\n```")
+	want := tele.Entities{
+		{Type: tele.EntityBold, Offset: 3, Length: 4},
+		{Type: tele.EntityTextLink, Offset: 8, Length: 4, URL: "https://example.com"},
+		{Type: tele.EntityCodeBlock, Offset: 14, Length: 6, Language: "go"},
+	}
+
+	got := messageEntities(f)
+	if len(got) != len(want) {
+		t.Fatalf("entities = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Type != want[i].Type || got[i].Offset != want[i].Offset || got[i].Length != want[i].Length ||
+			got[i].URL != want[i].URL || got[i].Language != want[i].Language {
+			t.Errorf("entity %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
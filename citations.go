@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tectiv3/chatgpt-bot/markdown"
+	tele "gopkg.in/telebot.v3"
+)
+
+// maxSourceTitle is the length titles are cut to in the sources section
+const maxSourceTitle = 60
+
+// sourceKey identifies the source of a citation, pages cited several times
+// are listed once
+func sourceKey(c Citation) string {
+	if c.URL != "" {
+		return c.URL
+	}
+	return c.Title
+}
+
+// sourceList returns the distinct sources of the citations in the order
+// they are first cited in
+func sourceList(citations []Citation) []Citation {
+	var sources []Citation
+	seen := map[string]bool{}
+	for _, c := range citations {
+		key := sourceKey(c)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		sources = append(sources, c)
+	}
+	return sources
+}
+
+// sourceNumber returns the footnote number of the citation's source, 0 when
+// it is not listed
+func sourceNumber(sources []Citation, c Citation) int {
+	for i, source := range sources {
+		if sourceKey(source) == sourceKey(c) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// withFootnotes marks the cited parts of the Markdown answer with the
+// numbers of their sources
+func withFootnotes(answer string, cited []CitedText, sources []Citation) string {
+	code := codeRanges(answer)
+	// markers are inserted from the end, so the offsets before stay valid
+	for i := len(cited) - 1; i >= 0; i-- {
+		end := footnoteEnd(answer, cited[i].End, code)
+
+		var marks strings.Builder
+		seen := map[int]bool{}
+		for _, c := range cited[i].Citations {
+			if n := sourceNumber(sources, c); n > 0 && !seen[n] {
+				seen[n] = true
+				fmt.Fprintf(&marks, `\[%d\]`, n)
+			}
+		}
+		answer = answer[:end] + marks.String() + answer[end:]
+	}
+
+	return answer
+}
+
+// codeRange is a code block or span of a Markdown text, where a marker
+// would show as it is
+type codeRange struct {
+	start, end int
+	block      bool
+}
+
+// codeRanges finds the fenced code blocks of a Markdown text and the code
+// spans between them
+func codeRanges(text string) []codeRange {
+	var ranges []codeRange
+	var fence string
+	fenceStart, from := 0, 0
+	for pos := 0; pos < len(text); {
+		lineEnd := strings.IndexByte(text[pos:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(text)
+		} else {
+			lineEnd += pos
+		}
+		line := strings.TrimSpace(text[pos:lineEnd])
+
+		switch {
+		case fence == "":
+			if run := fenceRun(line); run != "" {
+				ranges = append(ranges, codeSpans(text, from, pos)...)
+				fence, fenceStart = run, pos
+			}
+		case strings.HasPrefix(line, fence) && strings.Trim(line, fence[:1]) == "":
+			ranges = append(ranges, codeRange{start: fenceStart, end: lineEnd, block: true})
+			fence, from = "", lineEnd
+		}
+		pos = lineEnd + 1
+	}
+	if fence != "" {
+		return append(ranges, codeRange{start: fenceStart, end: len(text), block: true})
+	}
+
+	return append(ranges, codeSpans(text, from, len(text))...)
+}
+
+// fenceRun returns the backticks or tildes opening a code block on the line
+func fenceRun(line string) string {
+	for _, c := range "`~" {
+		run := strings.TrimLeft(line, string(c))
+		if n := len(line) - len(run); n >= 3 && (c == '~' || !strings.ContainsRune(run, '`')) {
+			return line[:n]
+		}
+	}
+	return ""
+}
+
+// codeSpans finds the code spans between from and to, a run of backticks
+// closed by a run of the same length
+func codeSpans(text string, from, to int) []codeRange {
+	var ranges []codeRange
+	for i := from; i < to; {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		n := i
+		for n < to && text[n] == '`' {
+			n++
+		}
+		// the span ends at the next run of as many backticks
+		end := -1
+		for j := n; j < to; {
+			if text[j] != '`' {
+				j++
+				continue
+			}
+			k := j
+			for k < to && text[k] == '`' {
+				k++
+			}
+			if k-j == n-i {
+				end = k
+				break
+			}
+			j = k
+		}
+		if end < 0 {
+			i = n
+			continue
+		}
+		ranges = append(ranges, codeRange{start: i, end: end})
+		i = end
+	}
+	return ranges
+}
+
+// footnoteEnd returns where the marker of a cited part ending at end goes:
+// after the word it ends in, before a code block and after a code span
+func footnoteEnd(answer string, end int, code []codeRange) int {
+	end = min(end, len(answer))
+	for end > 0 && end < len(answer) && isWordByte(answer[end-1]) && isWordByte(answer[end]) {
+		end++
+	}
+	for _, r := range code {
+		if r.start < end && end < r.end {
+			if r.block {
+				end = r.start
+			} else {
+				end = r.end
+			}
+			break
+		}
+	}
+	// the marker follows the cited words, not the line break after them
+	for end > 0 && strings.ContainsRune(" \n", rune(answer[end-1])) {
+		end--
+	}
+
+	return end
+}
+
+// isWordByte reports whether the byte is part of a word, a letter, digit or
+// a byte of a multibyte character
+func isWordByte(b byte) bool {
+	return b >= utf8.RuneSelf || b == '_' || unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b))
+}
+
+// sourceTitle returns the title of a source, the host of its URL when it has
+// none
+func sourceTitle(source Citation) string {
+	title := strings.TrimSpace(source.Title)
+	if title == "" {
+		if u, err := url.Parse(source.URL); err == nil && u.Host != "" {
+			title = strings.TrimPrefix(u.Host, "www.")
+		} else {
+			title = source.URL
+		}
+	}
+	if runes := []rune(title); len(runes) > maxSourceTitle {
+		title = string(runes[:maxSourceTitle-1]) + "…"
+	}
+
+	return title
+}
+
+// appendSources adds the numbered sources under an answer
+func appendSources(text *markdown.Formatted, heading string, sources []Citation) {
+	text.Append("\n\n", 0)
+	text.Append(heading, markdown.Bold)
+	for i, source := range sources {
+		text.Append(fmt.Sprintf("\n%d. ", i+1), 0)
+		text.AppendLink(sourceTitle(source), source.URL)
+	}
+}
+
+// answerMenu is the menu of an answer, with the sources button when it
+// cites any
+func answerMenu(sources []Citation) *tele.ReplyMarkup {
+	if len(sources) > 0 {
+		return sourcesMenu
+	}
+	return replyMenu
+}
+
+// hasSources reports whether the answer sent as the Telegram message cites
+// any sources, the caller holds the chat's mutex
+func (c *Chat) hasSources(messageID int) bool {
+	for i := len(c.History) - 1; i >= 0; i-- {
+		h := c.History[i]
+		if h.Role == "assistant" && h.TelegramMessageID != nil && *h.TelegramMessageID == messageID {
+			return len(h.Citations) > 0
+		}
+	}
+	return false
+}
+
+// onSources sends the text cited from each source of an answer
+func (s *Server) onSources(c tele.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
+		}
+	}()
+
+	chat := s.getChat(c)
+	answer := s.storedMessage(chat, c.Message().ID)
+	if answer == nil || len(answer.Citations) == 0 {
+		_ = c.Respond(&tele.CallbackResponse{Text: chat.t("Sources are no longer available")})
+		return
+	}
+	_ = c.Respond()
+
+	text := &markdown.Formatted{}
+	for i, source := range sourceList(answer.Citations) {
+		if i > 0 {
+			text.Append("\n\n", 0)
+		}
+		text.Append(fmt.Sprintf("%d. ", i+1), 0)
+		text.AppendLink(sourceTitle(source), source.URL)
+
+		quoted := map[string]bool{}
+		for _, cit := range answer.Citations {
+			cited := strings.TrimSpace(cit.CitedText)
+			if sourceKey(cit) != sourceKey(source) || cited == "" || quoted[cited] {
+				continue
+			}
+			quoted[cited] = true
+			text.Append("\n", 0)
+			text.Append(cited, markdown.Quote)
+		}
+	}
+
+	if _, err := sendFormatted(c, text, nil, nil); err != nil {
+		Log.WithField("user", c.Sender().Username).Warn(err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tectiv3/anthropic-go"
+)
+
+func TestWithFootnotes(t *testing.T) {
+	paris := Citation{URL: "https://example.com/paris", Title: "Paris"}
+	france := Citation{URL: "https://example.com/france", Title: "France"}
+	sources := []Citation{paris, france}
+
+	tests := []struct {
+		name   string
+		answer string
+		// cited ends after the first occurrence of each of these
+		after []string
+		cites [][]Citation
+		want  string
+	}{
+		{
+			name:   "sentence",
+			answer: "Paris is the capital. It is large.",
+			after:  []string{"capital"},
+			cites:  [][]Citation{{paris}},
+			want:   `Paris is the capital\[1\]. It is large.`,
+		},
+		{
+			name:   "sources of a part",
+			answer: "Paris is the capital.\n\nNext paragraph.",
+			after:  []string{"capital.\n\n"},
+			cites:  [][]Citation{{paris, france, paris}},
+			want:   "Paris is the capital." + `\[1\]\[2\]` + "\n\nNext paragraph.",
+		},
+		{
+			name:   "several parts",
+			answer: "Paris is big. France is old.",
+			after:  []string{"big.", "old."},
+			cites:  [][]Citation{{paris}, {france}},
+			want:   `Paris is big.\[1\] France is old.\[2\]`,
+		},
+		{
+			name:   "mid-word",
+			answer: "The Parisian metro is old.",
+			after:  []string{"Paris"},
+			cites:  [][]Citation{{paris}},
+			want:   `The Parisian\[1\] metro is old.`,
+		},
+		{
+			name:   "code span",
+			answer: "Run `go build ./...` first.",
+			after:  []string{"build"},
+			cites:  [][]Citation{{paris}},
+			want:   "Run `go build ./...`" + `\[1\]` + " first.",
+		},
+		{
+			name:   "code block",
+			answer: "Build it:\n\n```make\nall:\n\tgo build\n```\n\nDone.",
+			after:  []string{"all:"},
+			cites:  [][]Citation{{paris}},
+			want:   "Build it:" + `\[1\]` + "\n\n```make\nall:\n\tgo build\n```\n\nDone.",
+		},
+		{
+			name:   "unknown source",
+			answer: "Paris is big.",
+			after:  []string{"big."},
+			cites:  [][]Citation{{{URL: "https://example.com/other"}}},
+			want:   "Paris is big.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cited []CitedText
+			for i, after := range tt.after {
+				end := strings.Index(tt.answer, after) + len(after)
+				cited = append(cited, CitedText{End: end, Citations: tt.cites[i]})
+			}
+			if got := withFootnotes(tt.answer, cited, sources); got != tt.want {
+				t.Errorf("withFootnotes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// anthropicEvents writes the events of a Messages API stream
+func anthropicEvents(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		var kind struct {
+			Type string `json:"type"`
+		}
+		_ = json.Unmarshal([]byte(event), &kind)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind.Type, event)
+	}
+}
+
+func TestStreamAnswerCitations(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			// a sentence, then the tool call
+			anthropicEvents(w,
+				`{"type":"message_start","message":{"id":"m1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":10}}}`,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me check "}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"the page."}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"tu_1","name":"make_summary","input":{}}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"url\":\"https://example.com/paris\"}"}}`,
+				`{"type":"content_block_stop","index":1}`,
+				`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":20}}`,
+				`{"type":"message_stop"}`,
+			)
+		default:
+			// the answer, its middle block backed by a citation
+			anthropicEvents(w,
+				`{"type":"message_start","message":{"id":"m2","type":"message","role":"assistant","content":[],"usage":{"input_tokens":30}}}`,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"  The page says "}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"citations_delta","citation":{"type":"web_search_result_location","url":"https://example.com/paris","title":"Paris","cited_text":"Paris is the capital of France.","encrypted_index":"x"}}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"Paris is the "}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"capital of France"}}`,
+				`{"type":"content_block_stop","index":1}`,
+				`{"type":"content_block_start","index":2,"content_block":{"type":"text","text":""}}`,
+				`{"type":"content_block_delta","index":2,"delta":{"type":"text_delta","text":", with `+"`"+`2.1M`+"`"+` people."}}`,
+				`{"type":"content_block_stop","index":2}`,
+				`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}`,
+				`{"type":"message_stop"}`,
+			)
+		}
+	}))
+	defer server.Close()
+
+	s := &Server{
+		db:    testDB(t, &UsageRecord{}),
+		conf:  config{Models: []AiModel{{ModelID: "claude", Name: "Claude", BaseURL: server.URL}}},
+		tools: NewToolRegistry(),
+	}
+	s.tools.Register(&Tool{
+		Definition: &MakeSummaryTool{},
+		EnableKey:  "summary",
+		Execute: func(ctx context.Context, input json.RawMessage) (string, error) {
+			return "Paris is the capital of France.", nil
+		},
+	})
+
+	var streamed strings.Builder
+	chat := &Chat{ModelName: "Claude", EnabledTools: "summary"}
+	question := []*anthropic.Message{anthropic.NewUserTextMessage("What is the capital of France?")}
+	result, err := s.streamAnswer(context.Background(), chat, question, func(event StreamEvent) {
+		if event.Type == StreamEventTextDelta {
+			streamed.WriteString(event.Text)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "Let me check the page.\n\n  The page says Paris is the capital of France, with `2.1M` people."
+	if result.Text != want || streamed.String() != want {
+		t.Fatalf("text = %q, streamed %q, want %q", result.Text, streamed.String(), want)
+	}
+	if len(result.Rounds) != 1 || result.Rounds[0].Results[0] != "Paris is the capital of France." {
+		t.Errorf("rounds = %+v, want one round with the summary", result.Rounds)
+	}
+	if len(result.Cited) != 1 || result.Text[:result.Cited[0].End] != strings.TrimSuffix(want, ", with `2.1M` people.") {
+		t.Fatalf("cited = %+v, want the part up to France", result.Cited)
+	}
+
+	sources := sourceList(result.Citations)
+	if got := withFootnotes(result.Text, result.Cited, sources); got != strings.Replace(want, "France", `France\[1\]`, 1) {
+		t.Errorf("footnotes = %q", got)
+	}
+}
@@ -1,17 +1,42 @@
 package main
 
-import tele "gopkg.in/telebot.v3"
+import (
+	tele "gopkg.in/telebot.v3"
+	"gorm.io/gorm"
+)
+
+// getChat returns the chat an update belongs to: the thread of its forum
+// topic, the thread picked with /threads, or the Telegram chat itself
+func (s *Server) getChat(c tele.Context) *Chat {
+	chat := s.getTelegramChat(c.Chat(), c.Sender())
+	if m := c.Message(); m != nil && m.TopicMessage {
+		thread := s.getTopicThread(chat, m)
+		thread.SenderID = chat.SenderID
+		return thread
+	}
+	if chat.ActiveThreadID != nil {
+		if thread := s.getThread(chat.UserID, *chat.ActiveThreadID); thread != nil {
+			thread.SenderID = chat.SenderID
+			return thread
+		}
+	}
 
-// getChat returns chat from db or creates a new one
-func (s *Server) getChat(c *tele.Chat, u *tele.User) *Chat {
+	return chat
+}
+
+// getTelegramChat returns chat from db or creates a new one
+func (s *Server) getTelegramChat(c *tele.Chat, u *tele.User) *Chat {
 	var chat Chat
 
-	s.db.Preload("User").Preload("User.Roles").Preload("Role").Preload("History").FirstOrCreate(&chat, Chat{ChatID: c.ID})
+	s.db.Preload("User").Preload("User.Roles").Preload("Role").Preload("History").
+		Where("thread_id IS NULL").
+		FirstOrCreate(&chat, Chat{ChatID: c.ID})
 	if len(chat.MasterPrompt) == 0 {
 		chat.MasterPrompt = masterPrompt
 		chat.ModelName = defaultModelName
 		chat.Temperature = 0.8
 		chat.ConversationAge = 1
+		chat.SetEnabledToolsFromArray(s.tools.DefaultEnabled())
 		s.db.Save(&chat)
 	}
 
@@ -29,9 +54,12 @@ func (s *Server) getChat(c *tele.Chat, u *tele.User) *Chat {
 		chat.Lang = u.LanguageCode
 		s.db.Save(&chat)
 	}
+	// a group is owned by whoever talked first, its members pay for themselves
+	if isGroup(c) && u != nil {
+		chat.SenderID = s.getUser(u.Username).ID
+	}
 
-	// s.db.Find(&chat.History, "chat_id = ?", chat.ID)
-	// log.Printf("History %d, chatid %d\n", len(chat.History), chat.ID)
+	chat.History = chat.activeBranch(chat.History)
 
 	return &chat
 }
@@ -39,7 +67,8 @@ func (s *Server) getChat(c *tele.Chat, u *tele.User) *Chat {
 func (s *Server) getChatByID(chatID int64) *Chat {
 	var chat Chat
 	s.db.First(&chat, Chat{ChatID: chatID})
-	s.db.Find(&chat.History, "chat_id = ?", chat.ID)
+	s.db.Find(&chat.History, "chat_id = ?", chat.historyID())
+	chat.History = chat.activeBranch(chat.History)
 
 	return &chat
 }
@@ -73,14 +102,15 @@ func (s *Server) delUser(username string) {
 	var chat Chat
 	s.db.First(&chat, Chat{UserID: user.ID})
 	if chat.ID != 0 {
-		s.deleteHistory(chat.ID)
+		s.deleteHistory(&chat)
 		s.db.Unscoped().Delete(&Chat{}, chat.ID)
 	}
 	s.db.Unscoped().Delete(&User{}, user.ID)
 }
 
-func (s *Server) deleteHistory(chatID uint) {
-	s.db.Where("chat_id = ?", chatID).Delete(&ChatMessage{})
+func (s *Server) deleteHistory(chat *Chat) {
+	s.db.Where("chat_id = ?", chat.historyID()).Delete(&ChatMessage{})
+	s.db.Model(&Chat{}).Where("id = ?", chat.ID).UpdateColumn("active_leaf_id", nil)
 }
 
 func (s *Server) loadUsers() {
@@ -155,3 +185,21 @@ func (s *Server) StoreCitations(message *ChatMessage, citations []Citation) {
 		}
 	}
 }
+
+// runMigration applies a data migration unless it has been applied already
+func runMigration(db *gorm.DB, name string, migrate func(db *gorm.DB) error) error {
+	var done int64
+	if err := db.Model(&Migration{}).Where("name = ?", name).Count(&done).Error; err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := migrate(tx); err != nil {
+			return err
+		}
+		return tx.Create(&Migration{Name: name}).Error
+	})
+}
@@ -16,10 +16,10 @@ if [ "$#" -eq 3 ]; then
 fi
 if [ $ARCH == "arm" ]; then
     echo "Building for ARM"
-    env CGO_LDFLAGS="-Llib_arm -lopus -logg" GOOS=linux GOARCH=arm64 CGO_ENABLED=1 CC=aarch64-unknown-linux-gnu-gcc go build
+    env CGO_LDFLAGS="-Llib_arm -lopus -logg" GOOS=linux GOARCH=arm64 CGO_ENABLED=1 CC=aarch64-unknown-linux-gnu-gcc go build -tags sqlite_fts5
 else
     echo "Building for x86"
-    env CGO_LDFLAGS="-Llib_x86 -lopus -logg" GOOS=linux GOARCH=amd64 CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build
+    env CGO_LDFLAGS="-Llib_x86 -lopus -logg" GOOS=linux GOARCH=amd64 CGO_ENABLED=1 CC=x86_64-linux-gnu-gcc go build -tags sqlite_fts5
 fi
 ssh $SSH_HOST "sudo service gptbot stop" > /dev/null 2>&1
 scp chatgpt-bot $SSH_HOST:$DEPLOY_PATH
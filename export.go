@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	exportVersion     = 1
+	maxImportSize     = 50 << 20 // 50MB, attachments are embedded
+	maxImportMessages = 5000
+)
+
+// ThreadExport is the JSON export format, also accepted by the import endpoint.
+// Only the active branch of a conversation is exported.
+type ThreadExport struct {
+	Version           int             `json:"version"`
+	ExportedAt        time.Time       `json:"exported_at"`
+	Title             string          `json:"title"`
+	Settings          ThreadSettings  `json:"settings"`
+	TotalInputTokens  int             `json:"total_input_tokens"`
+	TotalOutputTokens int             `json:"total_output_tokens"`
+	Messages          []ExportMessage `json:"messages"`
+}
+
+type ExportMessage struct {
+	Role        string    `json:"role"`
+	SenderName  *string   `json:"sender_name,omitempty"`
+	Content     string    `json:"content"`
+	CreatedAt   time.Time `json:"created_at"`
+	MessageType string    `json:"message_type"`
+	// Summarized messages were replaced by a summary and are not sent to the model
+	Summarized bool `json:"summarized,omitempty"`
+
+	ToolCallID *string           `json:"tool_call_id,omitempty"`
+	ToolCalls  ToolCalls         `json:"tool_calls,omitempty"`
+	Citations  Citations         `json:"citations,omitempty"`
+	Thinking   ThinkingBlocks    `json:"thinking,omitempty"`
+	Attachment *ExportAttachment `json:"attachment,omitempty"`
+
+	InputTokens    *int    `json:"input_tokens,omitempty"`
+	OutputTokens   *int    `json:"output_tokens,omitempty"`
+	ModelUsed      *string `json:"model_used,omitempty"`
+	ResponseTimeMs *int64  `json:"response_time_ms,omitempty"`
+	FinishReason   *string `json:"finish_reason,omitempty"`
+}
+
+type ExportAttachment struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	// Data is the base64 encoded file, empty when the file no longer exists
+	Data string `json:"data,omitempty"`
+}
+
+// chatSettings returns the thread settings of a chat
+func chatSettings(chat *Chat) ThreadSettings {
+	return ThreadSettings{
+		ModelName:      chat.ModelName,
+		Temperature:    chat.Temperature,
+		RoleID:         chat.RoleID,
+		Lang:           chat.Lang,
+		MasterPrompt:   chat.MasterPrompt,
+		ContextLimit:   chat.ContextLimit,
+		EnabledTools:   chat.GetEnabledToolsArray(),
+		ThinkingBudget: chat.ThinkingBudget,
+	}
+}
+
+// newThreadExport converts the chat and its messages into the export format
+func newThreadExport(chat *Chat, title string, messages []ChatMessage) ThreadExport {
+	export := ThreadExport{
+		Version:           exportVersion,
+		ExportedAt:        time.Now(),
+		Title:             title,
+		Settings:          chatSettings(chat),
+		TotalInputTokens:  chat.TotalInputTokens,
+		TotalOutputTokens: chat.TotalOutputTokens,
+		Messages:          make([]ExportMessage, 0, len(messages)),
+	}
+
+	for _, msg := range messages {
+		em := ExportMessage{
+			Role:        msg.Role,
+			SenderName:  msg.SenderName,
+			CreatedAt:   msg.CreatedAt,
+			MessageType: msg.MessageType,
+			Summarized:  !msg.IsLive,
+
+			ToolCallID: msg.ToolCallID,
+			ToolCalls:  msg.ToolCalls,
+			Citations:  msg.Citations,
+			Thinking:   msg.Thinking,
+
+			InputTokens:    msg.InputTokens,
+			OutputTokens:   msg.OutputTokens,
+			ModelUsed:      msg.ModelUsed,
+			ResponseTimeMs: msg.ResponseTimeMs,
+			FinishReason:   msg.FinishReason,
+		}
+		if msg.Content != nil {
+			em.Content = *msg.Content
+		}
+		if msg.ImagePath != nil && *msg.ImagePath != "" {
+			em.Attachment = exportAttachment(*msg.ImagePath, msg.Filename)
+		}
+		export.Messages = append(export.Messages, em)
+	}
+
+	return export
+}
+
+// exportAttachment embeds an uploaded file
+func exportAttachment(path string, filename *string) *ExportAttachment {
+	path = strings.TrimPrefix(path, "/")
+	attachment := &ExportAttachment{Name: filepath.Base(path)}
+	if filename != nil && *filename != "" {
+		attachment.Name = *filename
+	}
+
+	// parameters like charset are dropped, the import matches plain types
+	attachment.MimeType, _, _ = strings.Cut(mime.TypeByExtension(filepath.Ext(path)), ";")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		Log.WithField("path", path).Warn("Attachment not found for export")
+		return attachment
+	}
+
+	if attachment.MimeType == "" {
+		attachment.MimeType, _, _ = strings.Cut(http.DetectContentType(data), ";")
+	}
+	attachment.Data = base64.StdEncoding.EncodeToString(data)
+
+	return attachment
+}
+
+// render returns the export in the given format, md, json or html
+func (e ThreadExport) render(format string) (body []byte, contentType, ext string, err error) {
+	switch format {
+	case "", "md", "markdown":
+		return []byte(e.Markdown()), "text/markdown; charset=utf-8", "md", nil
+	case "json":
+		body, err = json.MarshalIndent(e, "", "  ")
+		return body, "application/json", "json", err
+	case "html":
+		var buf bytes.Buffer
+		err = exportTemplate.Execute(&buf, e)
+		return buf.Bytes(), "text/html; charset=utf-8", "html", err
+	default:
+		return nil, "", "", fmt.Errorf("unknown format %q, expected md, json or html", format)
+	}
+}
+
+// speaker names the author of an exported message
+func (m ExportMessage) speaker() string {
+	switch {
+	case m.ToolCallID != nil:
+		return "Tool result"
+	case m.MessageType == "summary":
+		return "Summary"
+	case m.Role == "user" && m.SenderName != nil:
+		return *m.SenderName
+	case m.Role == "user":
+		return "User"
+	case m.Role == "assistant":
+		return "Assistant"
+	default:
+		return "System"
+	}
+}
+
+// meta lists the time, model and usage of an exported message
+func (m ExportMessage) meta() string {
+	parts := []string{m.CreatedAt.Format("2006-01-02 15:04")}
+	if m.ModelUsed != nil && m.Role == "assistant" {
+		parts = append(parts, *m.ModelUsed)
+	}
+	if m.InputTokens != nil && m.OutputTokens != nil && *m.OutputTokens > 0 {
+		parts = append(parts, fmt.Sprintf("%d in / %d out tokens", *m.InputTokens, *m.OutputTokens))
+	}
+	if m.ResponseTimeMs != nil && *m.ResponseTimeMs > 0 {
+		parts = append(parts, fmt.Sprintf("%.1fs", float64(*m.ResponseTimeMs)/1000))
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+// codeFence returns a backtick fence longer than any run of backticks in s
+func codeFence(s string) string {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// Markdown renders the export as a Markdown document
+func (e ThreadExport) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", e.Title)
+	fmt.Fprintf(&b, "_Exported %s · %s · %d in / %d out tokens_\n",
+		e.ExportedAt.Format("2006-01-02 15:04"), e.Settings.ModelName, e.TotalInputTokens, e.TotalOutputTokens)
+
+	for _, m := range e.Messages {
+		fmt.Fprintf(&b, "\n---\n\n**%s** · %s\n\n", m.speaker(), m.meta())
+
+		if m.ToolCallID != nil {
+			fence := codeFence(m.Content)
+			fmt.Fprintf(&b, "%s\n%s\n%s\n", fence, m.Content, fence)
+			continue
+		}
+		if m.Content != "" {
+			b.WriteString(m.Content + "\n")
+		}
+		if m.Attachment != nil {
+			fmt.Fprintf(&b, "\n📎 %s\n", m.Attachment.Name)
+		}
+		for _, call := range m.ToolCalls {
+			fmt.Fprintf(&b, "\n🔧 `%s` %s\n", call.Function.Name, call.Function.Arguments)
+		}
+		if len(m.Citations) > 0 {
+			b.WriteString("\nSources:\n")
+			for i, c := range m.Citations {
+				fmt.Fprintf(&b, "%d. [%s](%s)\n", i+1, c.Title, c.URL)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// DataURL returns the attachment as an inline image, empty for other files
+func (a *ExportAttachment) DataURL() template.URL {
+	if a == nil || a.Data == "" || !strings.HasPrefix(a.MimeType, "image/") {
+		return ""
+	}
+
+	return template.URL("data:" + a.MimeType + ";base64," + a.Data)
+}
+
+var exportTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"speaker": func(m ExportMessage) string { return m.speaker() },
+	"meta":    func(m ExportMessage) string { return m.meta() },
+	"date":    func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, sans-serif; max-width: 760px; margin: 2em auto; padding: 0 1em; color: #222; }
+.meta { color: #888; font-size: 0.85em; }
+.message { border-top: 1px solid #eee; padding: 1em 0; }
+.user .content { background: #eef4ff; padding: 0.75em; border-radius: 8px; }
+.content { white-space: pre-wrap; word-wrap: break-word; }
+pre { background: #f6f6f6; padding: 0.75em; overflow-x: auto; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">Exported {{date .ExportedAt}} · {{.Settings.ModelName}} · {{.TotalInputTokens}} in / {{.TotalOutputTokens}} out tokens</p>
+{{range .Messages}}
+<div class="message {{.Role}}">
+<p><strong>{{speaker .}}</strong> <span class="meta">· {{meta .}}</span></p>
+{{if .ToolCallID}}<details><summary>Output</summary><pre>{{.Content}}</pre></details>{{else}}
+{{if .Thinking}}<details><summary>Thinking</summary><pre>{{.Thinking.Text}}</pre></details>{{end}}
+{{if .Content}}<div class="content">{{.Content}}</div>{{end}}
+{{with .Attachment}}{{if .DataURL}}<p><img src="{{.DataURL}}" alt="{{.Name}}"></p>{{else}}<p>📎 {{.Name}}</p>{{end}}{{end}}
+{{range .ToolCalls}}<p>🔧 <code>{{.Function.Name}}</code> <code>{{.Function.Arguments}}</code></p>{{end}}
+{{if .Citations}}<p>Sources:</p><ol>{{range .Citations}}<li><a href="{{.URL}}">{{.Title}}</a></li>{{end}}</ol>{{end}}
+{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// exportFileNameReplacer drops characters that are not allowed in file names
+var exportFileNameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_",
+)
+
+// exportThread sends the active branch of a thread as a file download
+func (s *Server) exportThread(w http.ResponseWriter, r *http.Request, threadID string) {
+	user := getUserFromContext(r)
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	var chat Chat
+	err := s.db.Where("user_id = ? AND thread_id = ?", user.ID, threadID).First(&chat).Error
+	if err != nil {
+		s.writeJSONError(w, http.StatusNotFound, "Thread not found")
+		return
+	}
+
+	messages, err := s.loadThreadMessages(s.db, &chat)
+	if err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to fetch messages")
+		return
+	}
+
+	title := "Thread"
+	if chat.ThreadTitle != nil {
+		title = *chat.ThreadTitle
+	}
+	export := newThreadExport(&chat, title, chat.activeBranch(messages))
+	body, contentType, ext, err := export.render(r.URL.Query().Get("format"))
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": exportFileNameReplacer.Replace(title) + "." + ext,
+	}))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// importThread recreates a thread from the JSON export format
+func (s *Server) importThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user := getUserFromContext(r)
+	logger := getLogger(r.Context())
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	if !s.rateLimiter.Allow(user.ID) {
+		s.writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded. Please wait before creating another thread")
+		return
+	}
+
+	var export ThreadExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&export); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid export file")
+		return
+	}
+
+	if export.Version != exportVersion {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported export version %d", export.Version))
+		return
+	}
+	export.Title = strings.TrimSpace(export.Title)
+	if err := validateString(export.Title, 1, 200); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid title: %v", err))
+		return
+	}
+	if len(export.Messages) == 0 || len(export.Messages) > maxImportMessages {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("An import must have 1 to %d messages", maxImportMessages))
+		return
+	}
+	if export.Settings.ContextLimit == 0 {
+		export.Settings.ContextLimit = 40000
+	}
+	if err := validateThreadSettings(&export.Settings); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid settings: %v", err))
+		return
+	}
+	for i, m := range export.Messages {
+		if err := validateImportMessage(m); err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid message %d: %v", i+1, err))
+			return
+		}
+	}
+
+	// Roles belong to the user who exported the thread
+	if export.Settings.RoleID != nil {
+		var role Role
+		if err := s.db.Where("id = ? AND user_id = ?", *export.Settings.RoleID, user.ID).First(&role).Error; err != nil {
+			export.Settings.RoleID = nil
+		}
+	}
+
+	threadID := uuid.New().String()
+	chat := Chat{
+		UserID:         user.ID,
+		ChatID:         newThreadChatID(),
+		ThreadID:       &threadID,
+		ThreadTitle:    &export.Title,
+		Temperature:    export.Settings.Temperature,
+		ModelName:      export.Settings.ModelName,
+		RoleID:         export.Settings.RoleID,
+		Lang:           export.Settings.Lang,
+		MasterPrompt:   export.Settings.MasterPrompt,
+		Stream:         true,
+		ContextLimit:   export.Settings.ContextLimit,
+		ThinkingBudget: export.Settings.ThinkingBudget,
+	}
+	if chat.ModelName == "" {
+		chat.ModelName = defaultModelName
+	}
+	chat.SetEnabledToolsFromArray(s.tools.FilterKeys(export.Settings.EnabledTools))
+
+	tx := s.db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err := tx.Create(&chat).Error; err != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to create thread")
+		return
+	}
+
+	var saved []string
+	for _, m := range export.Messages {
+		msg := ChatMessage{
+			ChatID:      chat.ChatID,
+			Role:        m.Role,
+			Content:     &m.Content,
+			CreatedAt:   m.CreatedAt,
+			IsLive:      !m.Summarized,
+			MessageType: m.MessageType,
+
+			ToolCallID: m.ToolCallID,
+			ToolCalls:  m.ToolCalls,
+			Citations:  m.Citations,
+			Thinking:   m.Thinking,
+
+			InputTokens:    m.InputTokens,
+			OutputTokens:   m.OutputTokens,
+			ModelUsed:      m.ModelUsed,
+			ResponseTimeMs: m.ResponseTimeMs,
+			FinishReason:   m.FinishReason,
+		}
+		if msg.MessageType == "" {
+			msg.MessageType = "normal"
+		}
+		if msg.CreatedAt.IsZero() {
+			msg.CreatedAt = time.Now()
+		}
+
+		if a := m.Attachment; a != nil && a.Data != "" {
+			path, err := s.saveBase64Image(a.Data, a.Name, a.MimeType)
+			if err != nil {
+				tx.Rollback()
+				removeFiles(saved)
+				s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid attachment %s: %v", a.Name, err))
+				return
+			}
+			saved = append(saved, path)
+			name := a.Name
+			msg.ImagePath = &path
+			msg.Filename = &name
+		}
+
+		if msg.InputTokens != nil {
+			chat.TotalInputTokens += *msg.InputTokens
+		}
+		if msg.OutputTokens != nil {
+			chat.TotalOutputTokens += *msg.OutputTokens
+		}
+
+		if err := s.appendMessage(tx, &chat, &msg); err != nil {
+			tx.Rollback()
+			removeFiles(saved)
+			logger.WithField("error", err).Error("Failed to import message")
+			s.writeJSONError(w, http.StatusInternalServerError, "Failed to import messages")
+			return
+		}
+	}
+
+	if err := tx.Model(&chat).UpdateColumns(map[string]interface{}{
+		"total_input_tokens":  chat.TotalInputTokens,
+		"total_output_tokens": chat.TotalOutputTokens,
+	}).Error; err != nil {
+		tx.Rollback()
+		removeFiles(saved)
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to update thread tokens")
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		removeFiles(saved)
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to commit import")
+		return
+	}
+
+	s.writeJSONSuccess(w, "Thread imported successfully", map[string]interface{}{
+		"thread_id": threadID,
+		"title":     export.Title,
+	})
+}
+
+// validateImportMessage checks a message of an import
+func validateImportMessage(m ExportMessage) error {
+	switch m.Role {
+	case "user", "assistant", "system":
+	default:
+		return fmt.Errorf("unknown role %q", m.Role)
+	}
+
+	switch m.MessageType {
+	case "", "normal", "image", "file", "summary", "system":
+	default:
+		return fmt.Errorf("unknown message type %q", m.MessageType)
+	}
+
+	if a := m.Attachment; a != nil && a.Data != "" {
+		if getFileExtension(a.MimeType) == ".bin" {
+			return fmt.Errorf("unsupported attachment type %q", a.MimeType)
+		}
+		if base64.StdEncoding.DecodedLen(len(a.Data)) > MaxFileSize {
+			return fmt.Errorf("attachment %s is larger than %d bytes", a.Name, MaxFileSize)
+		}
+	}
+
+	return nil
+}
+
+// removeFiles deletes the attachments of a failed import
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		_ = os.Remove(path)
+	}
+}
+
+// onExport sends the Telegram conversation as a document, /export [md|json|html]
+func (s *Server) onExport(c tele.Context) error {
+	chat := s.getChat(c)
+	if len(chat.History) == 0 {
+		return c.Reply(c.Message(), chat.t("Nothing to export"))
+	}
+
+	format := strings.ToLower(strings.TrimSpace(c.Message().Payload))
+	title := chat.t("Conversation")
+	if chat.ThreadID != nil {
+		title = threadTitle(chat)
+	}
+	export := newThreadExport(chat, title, chat.History)
+	body, contentType, ext, err := export.render(format)
+	if err != nil {
+		return c.Reply(c.Message(), chat.t("Usage: /export [md|json|html]"))
+	}
+
+	contentType, _, _ = strings.Cut(contentType, ";")
+	file := tele.FromReader(bytes.NewReader(body))
+	fileName := fmt.Sprintf("chat_%s.%s", time.Now().Format("20060102-150405"), ext)
+
+	return c.Send(&tele.Document{File: file, FileName: fileName, MIME: contentType})
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime/debug"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-shiori/go-readability"
 	"github.com/tectiv3/anthropic-go"
 	"github.com/tectiv3/chatgpt-bot/i18n"
 	tele "gopkg.in/telebot.v3"
+	"gorm.io/gorm"
 )
 
 // ToolCallNotifier is an interface for notifying about tool call events
@@ -29,9 +31,10 @@ type TelegramToolCallNotifier struct {
 	draftID int
 }
 
+// OnFunctionCall receives the tool's display name, which is translated for the chat
 func (t *TelegramToolCallNotifier) OnFunctionCall(functionName string, arguments string) {
 	message := fmt.Sprintf(t.chat.t("Action: {{.tool}}\nAction input: %s", &i18n.Replacements{"tool": t.chat.t(functionName)}), arguments)
-	_ = t.bot.SendMessageDraft(t.c.Sender(), t.draftID, message)
+	_ = sendDraft(t.c, t.draftID, message)
 }
 
 func (t *TelegramToolCallNotifier) OnFunctionResult(functionName string, result string) {
@@ -43,19 +46,36 @@ func (t *TelegramToolCallNotifier) SendMessage(message string) error {
 	return err
 }
 
-// WebappToolCallNotifier implements ToolCallNotifier for web app (no-op for now)
-type WebappToolCallNotifier struct{}
+// WebappToolCallNotifier implements ToolCallNotifier for the web app by
+// sending status updates for the streaming message over SSE
+type WebappToolCallNotifier struct {
+	chat    *Chat
+	msg     *ChatMessage
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
 
-func (w *WebappToolCallNotifier) OnFunctionCall(functionName string, arguments string) {
-	// Web app handles notifications through SSE stream
+func (n *WebappToolCallNotifier) OnFunctionCall(functionName string, arguments string) {
+	_ = n.SendMessage(fmt.Sprintf(n.chat.t("Action: {{.tool}}\nAction input: %s", &i18n.Replacements{"tool": n.chat.t(functionName)}), arguments))
 }
 
-func (w *WebappToolCallNotifier) OnFunctionResult(functionName string, result string) {
-	// Web app handles notifications through SSE stream
+func (n *WebappToolCallNotifier) OnFunctionResult(functionName string, result string) {
+	// The answer text that follows replaces the status message
 }
 
-func (w *WebappToolCallNotifier) SendMessage(message string) error {
-	// Web app doesn't send messages directly
+func (n *WebappToolCallNotifier) SendMessage(message string) error {
+	if n.w == nil || n.flusher == nil {
+		return nil
+	}
+
+	writeSSE(n.w, n.flusher, MessageResponse{
+		ID:          n.msg.ID,
+		Role:        "assistant",
+		Content:     &message,
+		CreatedAt:   n.msg.CreatedAt,
+		IsLive:      true,
+		MessageType: "normal",
+	})
 	return nil
 }
 
@@ -82,90 +102,217 @@ func (t *MakeSummaryTool) Schema() *anthropic.Schema {
 	}
 }
 
-// getTools returns the custom tools available for Anthropic
-func (s *Server) getTools() []anthropic.ToolInterface {
-	return []anthropic.ToolInterface{&MakeSummaryTool{}}
+// Tool bundles a tool definition with everything the bot needs to expose it:
+// how to execute it, how to label it for the user and which key toggles it
+// in Chat.EnabledTools.
+type Tool struct {
+	Definition anthropic.ToolInterface
+	// EnableKey is the value stored in Chat.EnabledTools when the tool is on
+	EnableKey string
+	// DisplayName is an i18n key shown in notifications and tool toggles
+	DisplayName string
+	// Icon is the FontAwesome class used by the webapp toggle
+	Icon string
+	// Default marks tools enabled for newly created threads
+	Default bool
+	// Supported reports whether the tool can be used with a model; nil means always
+	Supported func(model *AiModel) bool
+	// Execute runs a client-side tool call; nil for server-side tools like web search
+	Execute func(ctx context.Context, input json.RawMessage) (string, error)
 }
 
-// processToolCalls executes tool_use content blocks and adds results to chat history.
-// Does NOT recurse into streaming — the caller loops instead.
-func (s *Server) processToolCalls(
-	chat *Chat, c tele.Context,
-	response *anthropic.Response, toolUses []anthropic.Content,
-	draftID int,
-) {
-	notifier := &TelegramToolCallNotifier{chat: chat, c: c, bot: s.bot, draftID: draftID}
-
-	var textParts []string
-	for _, content := range response.Content {
-		if tc, ok := content.(*anthropic.TextContent); ok {
-			textParts = append(textParts, tc.Text)
+// ToolRegistry holds the tools available to the bot in registration order
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools []*Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{}
+}
+
+// Register adds a tool, replacing any previously registered tool with the same name
+func (r *ToolRegistry) Register(tool *Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, t := range r.tools {
+		if t.Definition.Name() == tool.Definition.Name() {
+			r.tools[i] = tool
+			return
 		}
 	}
+	r.tools = append(r.tools, tool)
+}
+
+// Get returns the tool with the given name or nil
+func (r *ToolRegistry) Get(name string) *Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	var toolCalls []ToolCall
-	for _, tu := range toolUses {
-		if tuc, ok := tu.(*anthropic.ToolUseContent); ok {
-			toolCalls = append(toolCalls, ToolCall{
-				ID:   tuc.ID,
-				Type: "function",
-				Function: ToolCallFunction{
-					Name:      tuc.Name,
-					Arguments: string(tuc.Input),
-				},
-			})
+	for _, t := range r.tools {
+		if t.Definition.Name() == name {
+			return t
 		}
 	}
+	return nil
+}
 
-	assistantText := strings.Join(textParts, "")
-	chat.addMessageToDialog(ChatMessage{
-		Role:      "assistant",
-		Content:   &assistantText,
-		ToolCalls: toolCalls,
-	})
+// All returns a copy of the registered tools
+func (r *ToolRegistry) All() []*Tool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]*Tool(nil), r.tools...)
+}
 
-	for _, tu := range toolUses {
-		tuc, ok := tu.(*anthropic.ToolUseContent)
-		if !ok {
+// DefaultEnabled returns the enable keys of tools that are on by default
+func (r *ToolRegistry) DefaultEnabled() []string {
+	var keys []string
+	for _, t := range r.All() {
+		if t.Default {
+			keys = append(keys, t.EnableKey)
+		}
+	}
+	return keys
+}
+
+// FilterKeys drops enable keys that don't belong to any registered tool
+func (r *ToolRegistry) FilterKeys(keys []string) []string {
+	known := make(map[string]bool)
+	for _, t := range r.All() {
+		known[t.EnableKey] = true
+	}
+
+	filtered := []string{}
+	for _, key := range keys {
+		if known[key] && !in_array(key, filtered) {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
+// Definitions returns the tool definitions usable with the model.
+// A nil enabled list means every supported tool is returned.
+func (r *ToolRegistry) Definitions(model *AiModel, enabled []string) []anthropic.ToolInterface {
+	var defs []anthropic.ToolInterface
+	for _, t := range r.All() {
+		if enabled != nil && !in_array(t.EnableKey, enabled) {
+			continue
+		}
+		if t.Supported != nil && !t.Supported(model) {
 			continue
 		}
+		defs = append(defs, t.Definition)
+	}
+	return defs
+}
+
+// registerTools fills the registry with the built-in tools and the tools
+// of the configured MCP servers
+func (s *Server) registerTools() {
+	s.tools = NewToolRegistry()
+
+	s.tools.Register(&Tool{
+		Definition:  anthropic.NewWebSearchTool(anthropic.WebSearchToolOptions{MaxUses: 5}),
+		EnableKey:   "search",
+		DisplayName: "Web search",
+		Icon:        "fas fa-search",
+		Default:     true,
+		Supported:   func(model *AiModel) bool { return model.WebSearch },
+	})
+
+	s.tools.Register(&Tool{
+		Definition:  &MakeSummaryTool{},
+		EnableKey:   "summary",
+		DisplayName: "Page summary",
+		Icon:        "fas fa-file-lines",
+		Default:     true,
+		Execute:     s.executeMakeSummary,
+	})
+
+	s.registerMCPTools()
+}
+
+// migrateSummaryTool switches the page summary on for chats created before
+// the tools could be toggled, when it was always available
+func migrateSummaryTool(db *gorm.DB) error {
+	return db.Exec(`UPDATE chats SET enabled_tools = CASE
+			WHEN COALESCE(enabled_tools, '') = '' THEN 'summary'
+			ELSE enabled_tools || ',summary' END
+		WHERE ',' || COALESCE(enabled_tools, '') || ',' NOT LIKE '%,summary,%'`).Error
+}
+
+// getTools returns the definitions of the tools switched on for the chat
+// that the model supports
+func (s *Server) getTools(chat *Chat, model *AiModel) []anthropic.ToolInterface {
+	return s.tools.Definitions(model, chat.GetEnabledToolsArray())
+}
+
+// processToolCalls executes the client-side tool calls of a response round and
+// returns their results in the same order. Failures are returned to the model
+// as error results so it can recover. Does NOT recurse into streaming — the
+// caller loops instead.
+func (s *Server) processToolCalls(
+	ctx context.Context, toolUses []*anthropic.ToolUseContent, emit StreamHandler,
+) []string {
+	results := make([]string, len(toolUses))
+	for i, tu := range toolUses {
+		displayName := tu.Name
+		if tool := s.tools.Get(tu.Name); tool != nil {
+			displayName = tool.DisplayName
+		}
+		emit(StreamEvent{
+			Type:        StreamEventToolStart,
+			Tool:        tu.Name,
+			DisplayName: displayName,
+			Input:       string(tu.Input),
+		})
 
-		result, err := s.executeToolCall(tuc, notifier)
+		result, err := s.executeToolCall(ctx, tu)
 		if err != nil {
+			Log.WithField("tool", tu.Name).WithField("error", err).Error("Tool call failed")
 			result = fmt.Sprintf("Error: %v", err)
 		}
+		results[i] = result
 
-		chat.addToolResultToDialog(tuc.ID, result)
+		emit(StreamEvent{
+			Type:        StreamEventToolResult,
+			Tool:        tu.Name,
+			DisplayName: displayName,
+			Result:      result,
+		})
 	}
 
-	s.saveHistory(chat)
+	return results
 }
 
-// executeToolCall executes a single tool call
-func (s *Server) executeToolCall(toolUse *anthropic.ToolUseContent, notifier ToolCallNotifier) (string, error) {
-	if notifier != nil {
-		notifier.OnFunctionCall(toolUse.Name, string(toolUse.Input))
+// executeToolCall looks up the requested tool in the registry and runs it
+func (s *Server) executeToolCall(ctx context.Context, toolUse *anthropic.ToolUseContent) (string, error) {
+	tool := s.tools.Get(toolUse.Name)
+	if tool == nil || tool.Execute == nil {
+		return "", fmt.Errorf("unknown function: %s", toolUse.Name)
 	}
 
-	switch toolUse.Name {
-	case "make_summary":
-		type parsed struct {
-			URL string `json:"url"`
-		}
-		var args parsed
-		if err := json.Unmarshal(toolUse.Input, &args); err != nil {
-			return "", fmt.Errorf("failed to parse arguments: %w", err)
-		}
-		Log.Info("Making summary for URL: ", args.URL)
-		return s.getPageSummary(args.URL)
+	return tool.Execute(ctx, toolUse.Input)
+}
 
-	default:
-		return "", fmt.Errorf("unknown function: %s", toolUse.Name)
+// executeMakeSummary is the executor for MakeSummaryTool
+func (s *Server) executeMakeSummary(ctx context.Context, input json.RawMessage) (string, error) {
+	var args struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(input, &args); err != nil {
+		return "", fmt.Errorf("failed to parse arguments: %w", err)
 	}
+	Log.Info("Making summary for URL: ", args.URL)
+
+	return s.getPageSummary(chatFromContext(ctx), args.URL)
 }
 
 // getPageSummary fetches and summarizes a web page using Anthropic
-func (s *Server) getPageSummary(url string) (string, error) {
+func (s *Server) getPageSummary(chat *Chat, url string) (string, error) {
 	defer func() {
 		if err := recover(); err != nil {
 			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
@@ -182,6 +329,7 @@ func (s *Server) getPageSummary(url string) (string, error) {
 	}
 
 	return s.generateSimple(
+		chat,
 		"Make a summary of the article. Be brief but thorough and highlight key points. Use markdown.",
 		article.TextContent,
 		s.conf.Models[0].ModelID,
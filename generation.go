@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/tectiv3/chatgpt-bot/markdown"
+	tele "gopkg.in/telebot.v3"
+)
+
+// finishCancelled is the finish reason of answers stopped by the user
+const finishCancelled = "cancelled"
+
+// Generations tracks the answers being generated for each chat history, so
+// the user can stop them
+type Generations struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[int64]map[int]context.CancelFunc
+}
+
+// add registers a generation, the returned function removes it when done
+func (g *Generations) add(historyID int64, cancel context.CancelFunc) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cancels == nil {
+		g.cancels = make(map[int64]map[int]context.CancelFunc)
+	}
+	if g.cancels[historyID] == nil {
+		g.cancels[historyID] = make(map[int]context.CancelFunc)
+	}
+	g.next++
+	id := g.next
+	g.cancels[historyID][id] = cancel
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.cancels[historyID], id)
+		if len(g.cancels[historyID]) == 0 {
+			delete(g.cancels, historyID)
+		}
+	}
+}
+
+// stop cancels the generations of a chat history, reporting whether there
+// were any
+func (g *Generations) stop(historyID int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, cancel := range g.cancels[historyID] {
+		cancel()
+	}
+
+	return len(g.cancels[historyID]) > 0
+}
+
+// answerContext sends the answer into messages sent before: the old answer
+// of an edited question or a placeholder. They carry the Stop button until
+// the answer replaces them.
+type answerContext struct {
+	tele.Context
+	answer []tele.Editable
+	// placeholder is set when the messages were sent for the answer
+	placeholder bool
+	// answered is set once the answer has been sent into the messages
+	answered bool
+}
+
+// showStop puts the Stop button under the old answer being replaced, or
+// under a placeholder when there is none
+func showStop(chat *Chat, c tele.Context) *answerContext {
+	if e, ok := c.(*answerContext); ok && len(e.answer) > 0 {
+		if _, err := c.Bot().EditReplyMarkup(e.answer[len(e.answer)-1], stopMenu); err != nil {
+			Log.Warn("Failed to show the Stop button: ", err)
+		}
+		return e
+	}
+
+	placeholder, err := c.Bot().Send(c.Chat(), chat.t("Answering..."), replyOptions(c, ""), stopMenu)
+	if err != nil {
+		Log.Warn("Failed to show the Stop button: ", err)
+		return &answerContext{Context: c}
+	}
+
+	return &answerContext{Context: c, answer: []tele.Editable{placeholder}, placeholder: true}
+}
+
+// hideStop removes the Stop button when no answer replaced it, an error was
+// reported instead. The placeholder is deleted, an old answer stays.
+func (c *answerContext) hideStop() {
+	if c.answered || len(c.answer) == 0 {
+		return
+	}
+	if c.placeholder {
+		_ = c.Bot().Delete(c.answer[0])
+		return
+	}
+	_, _ = c.Bot().EditReplyMarkup(c.answer[len(c.answer)-1], removeMenu)
+}
+
+// onStop stops the answers being generated for the chat, from /stop or the
+// Stop button under the answer
+func (s *Server) onStop(c tele.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
+		}
+	}()
+
+	chat := s.getChat(c)
+	stopped := s.generations.stop(chat.historyID())
+	Log.WithField("user", c.Sender().Username).Info("Stop requested, generating: ", stopped)
+
+	if c.Callback() != nil {
+		_ = c.Respond()
+		return
+	}
+	if !stopped {
+		_, _ = c.Bot().Send(c.Chat(), chat.t("Nothing to stop"), replyOptions(c, ""))
+	}
+}
+
+// saveStopped sends the partial answer of a stopped generation and keeps it
+// in the history
+func (s *Server) saveStopped(chat *Chat, c tele.Context, partial string) {
+	text := markdown.Format(partial)
+	if text.Text != "" {
+		text.Append("\n\n", 0)
+	}
+	text.Append("⏹ "+chat.t("Stopped"), markdown.Italic)
+	sent := s.sendReply(chat, c, text, replyMenu)
+
+	if strings.TrimSpace(partial) != "" {
+		reason := finishCancelled
+		answer := ChatMessage{Role: "assistant", Content: &partial, FinishReason: &reason}
+		answer.sentAs(sent)
+		chat.addMessageToDialog(answer)
+	}
+	s.saveHistory(chat)
+}
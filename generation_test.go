@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tectiv3/chatgpt-bot/markdown"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestStopButton(t *testing.T) {
+	tests := []struct {
+		name string
+		// old is the answer of an edited question
+		old      []tele.Editable
+		answered bool
+		calls    []string
+	}{
+		{
+			name:     "answer replaces the placeholder",
+			answered: true,
+			calls:    []string{"sendMessage 100", "editMessageText 100"},
+		},
+		{
+			name:  "placeholder removed after an error",
+			calls: []string{"sendMessage 100", "deleteMessage 100"},
+		},
+		{
+			name:     "edited question",
+			old:      []tele.Editable{&tele.StoredMessage{MessageID: "10", ChatID: 1}},
+			answered: true,
+			calls:    []string{"editMessageReplyMarkup 10", "editMessageText 10"},
+		},
+		{
+			name:  "edited question after an error",
+			old:   []tele.Editable{&tele.StoredMessage{MessageID: "10", ChatID: 1}},
+			calls: []string{"editMessageReplyMarkup 10", "editMessageReplyMarkup 10"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{db: testDB(t, &Chat{})}
+			bot, api := testBot(t)
+			chat := &Chat{ChatID: 1}
+
+			var c tele.Context = bot.NewContext(tele.Update{Message: &tele.Message{
+				ID:     5,
+				Chat:   &tele.Chat{ID: 1, Type: tele.ChatPrivate},
+				Sender: &tele.User{ID: 1},
+			}})
+			if tt.old != nil {
+				c = &answerContext{Context: c, answer: tt.old}
+			}
+
+			answer := showStop(chat, c)
+			if tt.answered {
+				s.sendReply(chat, answer, markdown.Format("The answer."), replyMenu)
+			}
+			answer.hideStop()
+
+			if !reflect.DeepEqual(api.calls, tt.calls) {
+				t.Errorf("calls = %q, want %q", api.calls, tt.calls)
+			}
+		})
+	}
+}
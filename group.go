@@ -0,0 +1,136 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// isGroup reports whether the chat is a group or supergroup
+func isGroup(chat *tele.Chat) bool {
+	return chat != nil && (chat.Type == tele.ChatGroup || chat.Type == tele.ChatSuperGroup)
+}
+
+// addressedToBot reports whether a group message is meant for the bot: it
+// mentions the bot, replies to one of its messages or is a command
+func (s *Server) addressedToBot(c tele.Context) bool {
+	m := c.Message()
+	if m == nil {
+		return false
+	}
+	me := s.bot.Me
+
+	if strings.HasPrefix(m.Text, "/") {
+		return true
+	}
+	if m.ReplyTo != nil && m.ReplyTo.Sender != nil && m.ReplyTo.Sender.ID == me.ID {
+		return true
+	}
+
+	entities := m.Entities
+	if m.Text == "" {
+		entities = m.CaptionEntities
+	}
+	for _, e := range entities {
+		switch e.Type {
+		case tele.EntityMention:
+			if strings.EqualFold(m.EntityText(e), "@"+me.Username) {
+				return true
+			}
+		case tele.EntityTMention:
+			if e.User != nil && e.User.ID == me.ID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// stripMention removes the bot's @username from a group message
+func (s *Server) stripMention(text string) string {
+	if s.bot.Me == nil || s.bot.Me.Username == "" {
+		return text
+	}
+	rx := regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(s.bot.Me.Username) + `\b`)
+
+	return strings.TrimSpace(rx.ReplaceAllString(text, ""))
+}
+
+// speakerName is the name a group message is attributed to in the history,
+// nil in private chats where there is only one speaker
+func speakerName(c tele.Context) *string {
+	if !isGroup(c.Chat()) || c.Sender() == nil {
+		return nil
+	}
+	u := c.Sender()
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		name = u.Username
+	}
+
+	return &name
+}
+
+// replyOptions returns send options answering the current message: in a
+// group the answer replies to the message that triggered it and stays in
+// its forum topic
+func replyOptions(c tele.Context, mode tele.ParseMode) *tele.SendOptions {
+	opts := &tele.SendOptions{ParseMode: mode}
+	m := c.Message()
+	if m == nil {
+		return opts
+	}
+	if m.TopicMessage {
+		opts.ThreadID = m.ThreadID
+	}
+	if isGroup(c.Chat()) && c.Callback() == nil {
+		opts.ReplyTo = m
+	}
+
+	return opts
+}
+
+// groupFilter drops group messages that are not addressed to the bot, the
+// bot only speaks in a group when mentioned, replied to or given a command
+func (s *Server) groupFilter() tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			if !isGroup(c.Chat()) || c.Callback() != nil || s.addressedToBot(c) {
+				return next(c)
+			}
+
+			return nil
+		}
+	}
+}
+
+// privateOnly keeps the commands about the user's own threads, searches,
+// spending and exports out of groups, where everyone would see them
+func (s *Server) privateOnly() tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			if !isGroup(c.Chat()) {
+				return next(c)
+			}
+
+			chat := s.getTelegramChat(c.Chat(), c.Sender())
+			text := chat.t("This command only works in a private chat with the bot")
+			if c.Callback() != nil {
+				return c.Respond(&tele.CallbackResponse{Text: text})
+			}
+			return c.Reply(c.Message(), text)
+		}
+	}
+}
+
+// sendDraft streams a partial answer. Drafts only exist in private chats,
+// groups see the typing status instead.
+func sendDraft(c tele.Context, draftID int, text string, opts ...interface{}) error {
+	if isGroup(c.Chat()) {
+		return c.Notify(tele.Typing)
+	}
+
+	return c.Bot().SendMessageDraft(c.Sender(), draftID, text, opts...)
+}
@@ -35,12 +35,69 @@ var localizations = map[string]string{
 	"ru.Temperature set to {{.temp}}":                        "Креативность модели установлена на {{.temp}}",
 	"ru.This bot will answer your messages with ChatGPT API": "Этот бот будет отвечать на ваши сообщения с помощью ChatGPT",
 	"ru._Transcript:_\\n%s\\n\\n_Answer:_ \\n\\n\"":          "_Транскрипт:_\n%s\n\n_Ответ:_ \n\n",
-	"ru.default":       "По умолчанию",
-	"ru.disabled":      "деактивировано",
-	"ru.enabled":       "активировано",
-	"ru.search_images": "Поиск изображений",
-	"ru.set_reminder":  "Установка напоминания",
-	"ru.web_search":    "Поиск в интернете",
+	"ru.default":                   "По умолчанию",
+	"ru.disabled":                  "деактивировано",
+	"ru.enabled":                   "активировано",
+	"ru.search_images":             "Поиск изображений",
+	"ru.set_reminder":              "Установка напоминания",
+	"ru.web_search":                "Поиск в интернете",
+	"ru.Web search":                "Поиск в интернете",
+	"ru.Page summary":              "Краткое содержание страницы",
+	"ru.Select tools":              "Выберите инструменты",
+	"ru.Toggle available tools":    "Включить или выключить инструменты",
+	"ru.Show spend for this month": "Показать расходы за этот месяц",
+	"ru.Monthly budget exceeded":   "Месячный бюджет исчерпан",
+	"ru.Usage since {{.date}}":     "Расходы с {{.date}}",
+	"ru.By model:":                 "По моделям:",
+	"ru.By day:":                   "По дням:",
+	"ru.Set thinking budget, 0 for model default":                  "Задать бюджет размышлений, 0 для значения модели по умолчанию",
+	"ru.Invalid thinking budget: {{.error}}":                       "Неверный бюджет размышлений: {{.error}}",
+	"ru.Thinking budget set to {{.budget}}":                        "Бюджет размышлений установлен на {{.budget}}",
+	"ru.Search conversations":                                      "Поиск по беседам",
+	"ru.Usage: /search <text>":                                     "Использование: /search <текст>",
+	"ru.Search is not available":                                   "Поиск недоступен",
+	"ru.Nothing found for {{.query}}":                              "По запросу {{.query}} ничего не найдено",
+	"ru.Export conversation as a file":                             "Экспортировать беседу в файл",
+	"ru.Nothing to export":                                         "Нечего экспортировать",
+	"ru.Conversation":                                              "Беседа",
+	"ru.Usage: /export [md|json|html]":                             "Использование: /export [md|json|html]",
+	"ru.Toggle voice replies":                                      "Включить или выключить голосовые ответы",
+	"ru.Voice replies are not configured":                          "Голосовые ответы не настроены",
+	"ru.Voice replies are {{.status}}":                             "Голосовые ответы {{.status}}",
+	"ru.Audio file too large, the limit is {{.size}} MB":           "Аудиофайл слишком большой, ограничение {{.size}} МБ",
+	"ru.Unsupported audio format":                                  "Неподдерживаемый формат аудио",
+	"ru.No speech recognized":                                      "Речь не распознана",
+	"ru.Transcript":                                                "Расшифровка",
+	"ru.new conversation|new chat|start over|reset":                "новый разговор|новый диалог|новая беседа|начать заново|начнём заново|начнем заново|сброс|сбросить",
+	"ru.switch model to|switch to model|change model to|use model": "переключи модель на|переключись на модель|смени модель на|используй модель",
+	"ru.switch role to|switch to role|change role to|use role":     "переключи роль на|переключись на роль|смени роль на|используй роль",
+	"ru.translate last answer to|translate the last answer to|translate the answer to|translate to": "переведи последний ответ на|переведи ответ на|переведи на",
+	"ru.repeat|say again|say it again|repeat last answer|repeat the last answer":                    "повтори|повтори ещё раз|повтори еще раз|скажи ещё раз|скажи еще раз|повтори последний ответ",
+	"ru.Yes":    "Да",
+	"ru.Cancel": "Отмена",
+	"ru.Start a new conversation? The history will be deleted.": "Начать новый диалог? История будет удалена.",
+	"ru.Conversation reset":                                     "Диалог сброшен",
+	"ru.Nothing to translate":                                   "Нечего переводить",
+	"ru.Nothing to repeat":                                      "Нечего повторять",
+	"ru.Start a new thread":                                     "Начать новую ветку",
+	"ru.Continue a thread from the web app":                     "Продолжить ветку из веб-приложения",
+	"ru.New thread started":                                     "Новая ветка начата",
+	"ru.Could not create a topic: {{.error}}":                   "Не удалось создать тему: {{.error}}",
+	"ru.Main chat":                                              "Основной чат",
+	"ru.Select a thread":                                        "Выберите ветку",
+	"ru.Switched to the main chat":                              "Переключено на основной чат",
+	"ru.Thread not found":                                       "Ветка не найдена",
+	"ru.Switched to {{.title}}":                                 "Переключено на {{.title}}",
+	"ru.Toggle branching on edits of older messages":            "Включить или выключить ветвление при правке старых сообщений",
+	"ru.Branching on edits of older messages is {{.status}}":    "Ветвление при правке старых сообщений {{.status}}",
+	"ru.Sources":                                                "Источники",
+	"ru.Sources are no longer available":                        "Источники больше недоступны",
+	"ru.Stop the answer being generated":                        "Остановить генерацию ответа",
+	"ru.Nothing to stop":                                        "Нечего останавливать",
+	"ru.Stopped":                                                "Остановлено",
+	"ru.Telegram chat":                                          "Чат в Telegram",
+	"ru.This command only works in a private chat with the bot": "Эта команда работает только в личном чате с ботом",
+	"ru.Answering...":                                           "Отвечаю...",
 }
 
 type Replacements map[string]interface{}
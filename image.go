@@ -7,33 +7,38 @@ import (
 )
 
 func (s *Server) handleImage(c tele.Context) {
-	photo := c.Message().Photo.File
+	fileName, err := s.localFile(c, c.Message().Photo.File, ".jpg")
+	if err != nil {
+		Log.Warn("Error getting image", "error=", err)
+		return
+	}
 
-	var fileName string
+	chat := s.getChat(c)
+	chat.addImageToDialog(s.stripMention(c.Message().Caption), fileName, speakerName(c))
+	s.saveHistory(chat)
 
+	s.complete(c, "")
+}
+
+// localFile returns the path of a Telegram file on disk, downloaded to
+// uploads/ unless a local Bot API server already keeps it
+func (s *Server) localFile(c tele.Context, file tele.File, ext string) (string, error) {
 	if s.conf.TelegramServerURL != "" {
-		f, err := c.Bot().FileByID(photo.FileID)
-		if err != nil {
-			Log.Warn("Error getting file ID", "error=", err)
-			return
-		}
-		fileName = f.FilePath
-	} else {
-		out, err := os.Create("uploads/" + photo.FileID + ".jpg")
+		f, err := c.Bot().FileByID(file.FileID)
 		if err != nil {
-			Log.Warn("Error creating file", "error=", err)
-			return
-		}
-		if err := c.Bot().Download(&photo, out.Name()); err != nil {
-			Log.Warn("Error getting file content", "error=", err)
-			return
+			return "", err
 		}
-		fileName = out.Name()
+		return f.FilePath, nil
 	}
 
-	chat := s.getChat(c.Chat(), c.Sender())
-	chat.addImageToDialog(c.Message().Caption, fileName)
-	s.db.Save(&chat)
+	out, err := os.Create("uploads/" + file.FileID + ext)
+	if err != nil {
+		return "", err
+	}
+	out.Close()
+	if err := c.Bot().Download(&file, out.Name()); err != nil {
+		return "", err
+	}
 
-	s.complete(c, "")
+	return out.Name(), nil
 }
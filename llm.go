@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"html"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tectiv3/anthropic-go"
+	"github.com/tectiv3/chatgpt-bot/markdown"
 	tele "gopkg.in/telebot.v3"
 )
 
@@ -41,29 +42,30 @@ func friendlyAPIError(err error) string {
 }
 
 func (s *Server) complete(c tele.Context, message string) {
-	chat := s.getChat(c.Chat(), c.Sender())
+	chat := s.getChat(c)
 
 	var msgPtr *string
 	if len(message) > 0 {
+		message = s.quoteReply(c, chat, message)
+		// a reply to a photo or document asks about it
+		if s.attachReply(c, chat, message) {
+			s.getStreamingAnswer(chat, c, nil)
+			return
+		}
 		msgPtr = &message
 	}
 
 	s.getStreamingAnswer(chat, c, msgPtr)
 }
 
-// getStreamingAnswer handles streaming responses from Anthropic.
-// Creates a fresh client per request to avoid race conditions.
-// Tool call continuation is handled iteratively (max 10 rounds).
+// getStreamingAnswer streams an answer into a Telegram message draft and
+// sends the final reply. Creates a fresh client per request to avoid race conditions.
 func (s *Server) getStreamingAnswer(chat *Chat, c tele.Context, question *string) {
-	model := s.getModel(chat.ModelName)
-	maxTokens := 4096
-	maxToolRounds := 10
-
-	system := chat.MasterPrompt
-	if chat.RoleID != nil {
-		system = chat.Role.Prompt
+	if err := s.checkBudget(chat.payerID()); err != nil {
+		Log.WithField("user", c.Sender().Username).Warn(err)
+		_, _ = c.Bot().Send(c.Chat(), chat.t("Monthly budget exceeded"), replyOptions(c, ""))
+		return
 	}
-	system += fmt.Sprintf("\n\nCurrent date: %s", time.Now().Format("2006-01-02"))
 
 	chat.removeMenu(c)
 	draftID := int(time.Now().UnixMilli() % 1000000)
@@ -72,171 +74,153 @@ func (s *Server) getStreamingAnswer(chat *Chat, c tele.Context, question *string
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
-
-	var tools []anthropic.ToolInterface
-	if model.WebSearch {
-		tools = append(tools, anthropic.NewWebSearchTool(anthropic.WebSearchToolOptions{MaxUses: 5}))
-	}
-	tools = append(tools, s.getTools()...)
-
-	opts := []anthropic.Option{
-		anthropic.WithAPIKey(s.conf.AnthropicAPIKey),
-		anthropic.WithModel(model.ModelID),
-		anthropic.WithSystemPrompt(system),
-		anthropic.WithMaxTokens(maxTokens),
-	}
-	if len(tools) > 0 {
-		opts = append(opts, anthropic.WithTools(tools...))
+	done := s.generations.add(chat.historyID(), cancel)
+	defer done()
+
+	if question != nil {
+		msg := ChatMessage{Role: "user", Content: question, SenderName: speakerName(c)}
+		if c.Callback() == nil {
+			// Remember the source message so an edit of it can branch the conversation
+			id := c.Message().ID
+			msg.TelegramMessageID = &id
+		}
+		chat.addMessageToDialog(msg)
 	}
-
-	dialog := chat.getDialog(question)
+	dialog := chat.getDialog(nil)
+	// the Stop button lives on a real message, drafts cannot carry it
+	answer := showStop(chat, c)
+	defer answer.hideStop()
+	c = answer
 	_ = c.Notify(tele.Typing)
-	var totalInputTokens, totalOutputTokens int
-
-	caching := true
-	for round := 0; round < maxToolRounds; round++ {
-		client := anthropic.New(opts...)
-		client.Caching = &caching
-		if !model.Reasoning {
-			temp := chat.Temperature
-			client.Temperature = &temp
-		}
-
-		stream, err := client.Stream(ctx, dialog)
-		if err != nil {
-			Log.WithField("user", c.Sender().Username).Error(err)
-			_, _ = c.Bot().Send(c.Sender(), friendlyAPIError(err))
-			return
-		}
 
-		var result strings.Builder
-		tokens := 0
-		lastDraft := time.Now()
-		accumulator := anthropic.NewResponseAccumulator()
+	// typing status lasts 5 seconds, drafts are refreshed much more often
+	draftInterval := 100 * time.Millisecond
+	if isGroup(c.Chat()) {
+		draftInterval = 4 * time.Second
+	}
 
-		for stream.Next() {
-			select {
-			case <-ctx.Done():
-				stream.Close()
-				_, _ = c.Bot().Send(c.Sender(), "Timeout")
-				return
-			default:
-			}
-			event := stream.Event()
-			accumulator.AddEvent(event)
-
-			switch event.Type {
-			case anthropic.EventTypeContentBlockStart:
-				if event.ContentBlock != nil {
-					if event.ContentBlock.Type == anthropic.ContentTypeServerToolUse &&
-						event.ContentBlock.Name == "web_search" {
-						_ = c.Bot().SendMessageDraft(c.Sender(), draftID, chat.t("Web search started, please wait..."))
-					}
-				}
-			case anthropic.EventTypeContentBlockDelta:
-				if event.Delta == nil {
-					continue
+	logger := Log.WithField("user", c.Sender().Username)
+	notifier := &TelegramToolCallNotifier{chat: chat, c: c, bot: s.bot, draftID: draftID}
+	var draft, thinking strings.Builder
+	lastDraft := time.Now()
+
+	result, err := s.streamAnswer(ctx, chat, dialog, func(event StreamEvent) {
+		switch event.Type {
+		case StreamEventThinkingDelta:
+			thinking.WriteString(event.Text)
+			// Thinking is only shown until the answer starts
+			if draft.Len() == 0 && time.Since(lastDraft) >= draftInterval {
+				if err := sendDraft(c, draftID, thinkingDraft(thinking.String()), tele.ModeHTML); err != nil {
+					logger.Warn("SendMessageDraft error: ", err)
 				}
-				if event.Delta.Type == anthropic.EventDeltaTypeText {
-					result.WriteString(event.Delta.Text)
-					tokens++
-					if time.Since(lastDraft) >= 100*time.Millisecond {
-						if err := c.Bot().SendMessageDraft(c.Sender(), draftID, result.String()); err != nil {
-							Log.WithField("user", c.Sender().Username).Warn("SendMessageDraft error: ", err)
-						}
-						lastDraft = time.Now()
-					}
+				lastDraft = time.Now()
+			}
+		case StreamEventTextDelta:
+			draft.WriteString(event.Text)
+			if time.Since(lastDraft) >= draftInterval {
+				// the draft is rendered from the Markdown so far, unclosed code blocks included
+				if err := sendDraft(c, draftID, markdown.ToHTML(draft.String()), tele.ModeHTML); err != nil {
+					logger.Warn("SendMessageDraft error: ", err)
 				}
-			case anthropic.EventTypeMessageStop:
-				Log.WithField("user", c.Sender().Username).
-					WithField("tokens", tokens).Info("Response stream finished")
+				lastDraft = time.Now()
 			}
-		}
-		stream.Close()
-
-		if err := stream.Err(); err != nil {
-			if ctx.Err() == context.DeadlineExceeded {
-				Log.WithField("user", c.Sender().Username).Error("Timeout. Partial: ", result.String())
-				_, _ = c.Bot().Send(c.Sender(), "Timeout. Partial: "+result.String())
-			} else if ctx.Err() == context.Canceled {
-				Log.WithField("user", c.Sender().Username).Error("Request cancelled. Partial: ", result.String())
-				_, _ = c.Bot().Send(c.Sender(), "Request cancelled. Partial: "+result.String())
-			} else {
-				Log.WithField("user", c.Sender().Username).Error("Streaming error: ", err)
-				_, _ = c.Bot().Send(c.Sender(), "Error: "+friendlyAPIError(err))
+		case StreamEventToolStart:
+			if event.Server {
+				if event.Tool == "web_search" {
+					_ = sendDraft(c, draftID, chat.t("Web search started, please wait..."))
+				}
+				return
 			}
-			return
-		}
-
-		if !accumulator.IsComplete() {
-			Log.WithField("user", c.Sender().Username).Warn("Stream ended with incomplete accumulator")
-			if result.Len() > 0 {
-				_, _ = c.Bot().Send(c.Sender(), "Incomplete response: "+result.String())
+			notifier.OnFunctionCall(event.DisplayName, event.Input)
+		case StreamEventToolResult:
+			notifier.OnFunctionResult(event.DisplayName, event.Result)
+		case StreamEventUsage:
+			if event.Usage.CacheReadTokens > 0 || event.Usage.CacheCreationTokens > 0 {
+				logger.Infof("Cache: read=%d, created=%d", event.Usage.CacheReadTokens, event.Usage.CacheCreationTokens)
 			}
-			return
+		case StreamEventFinish:
+			logger.WithField("reason", event.FinishReason).Info("Response stream finished")
 		}
+	})
 
-		response := accumulator.Response()
-
-		// Extract citations
-		var citations []Citation
-		for _, content := range response.Content {
-			if content == nil {
-				continue
-			}
-			if tc, ok := content.(*anthropic.TextContent); ok {
-				for _, cit := range tc.Citations {
-					citations = append(citations, extractCitation(cit))
-				}
+	if err != nil {
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			logger.Error("Timeout. Partial: ", result.Text)
+			_, _ = c.Bot().Send(c.Chat(), "Timeout. Partial: "+result.Text, replyOptions(c, ""))
+		case ctx.Err() == context.Canceled:
+			logger.Info("Stopped by the user. Partial: ", result.Text)
+			s.saveStopped(chat, c, result.Text)
+		case errors.Is(err, errIncompleteResponse):
+			logger.Warn("Stream ended with incomplete accumulator")
+			if result.Text != "" {
+				_, _ = c.Bot().Send(c.Chat(), "Incomplete response: "+result.Text, replyOptions(c, ""))
 			}
+		default:
+			logger.Error("Streaming error: ", err)
+			_, _ = c.Bot().Send(c.Chat(), "Error: "+friendlyAPIError(err), replyOptions(c, ""))
 		}
+		return
+	}
 
-		// Check for tool use — execute and loop
-		var toolUses []anthropic.Content
-		for _, content := range response.Content {
-			if content == nil {
-				continue
-			}
-			if content.Type() == anthropic.ContentTypeToolUse {
-				toolUses = append(toolUses, content)
-			}
+	if result.Usage.TotalTokens > 0 {
+		chat.updateTotalTokens(result.Usage.TotalTokens)
+	}
+	if chat.ThreadID != nil {
+		if err := s.updateThreadTokens(chat.ChatID, result.Usage.InputTokens, result.Usage.OutputTokens); err != nil {
+			logger.Warn("Failed to update thread tokens: ", err)
 		}
+	}
 
-		usage := accumulator.Usage()
-		totalInputTokens += usage.InputTokens
-		totalOutputTokens += usage.OutputTokens
-		if usage.CacheReadInputTokens > 0 || usage.CacheCreationInputTokens > 0 {
-			Log.WithField("user", c.Sender().Username).
-				Infof("Cache: read=%d, created=%d", usage.CacheReadInputTokens, usage.CacheCreationInputTokens)
+	for _, round := range result.Rounds {
+		text := round.Text
+		chat.addMessageToDialog(ChatMessage{
+			Role:      "assistant",
+			Content:   &text,
+			ToolCalls: round.Calls,
+			Thinking:  round.Thinking,
+		})
+		for i, call := range round.Calls {
+			chat.addToolResultToDialog(call.ID, round.Results[i])
 		}
+	}
 
-		if len(toolUses) > 0 {
-			s.processToolCalls(chat, c, response, toolUses, draftID)
-			dialog = chat.getDialog(nil)
-			continue
-		}
+	if result.Usage.FinishReason == "max_tool_rounds" {
+		logger.Warn("Max tool call rounds exceeded")
+		s.saveHistory(chat)
+		_, _ = c.Bot().Send(c.Chat(), "Response incomplete: too many tool calls", replyOptions(c, ""))
+		return
+	}
 
-		// No tool use — finalize response
-		reply := result.String()
-		s.sendFinalReply(chat, reply, c)
+	sent := s.sendFinalReply(chat, result.Text, result.Cited, c)
 
-		totalTokens := totalInputTokens + totalOutputTokens
-		if totalTokens > 0 {
-			chat.updateTotalTokens(totalTokens)
+	if result.FinalText != "" {
+		answer := ChatMessage{Role: "assistant", Content: &result.FinalText, Thinking: result.Thinking}
+		// a reply to the answer in Telegram quotes it from the history
+		answer.sentAs(sent)
+		chat.addMessageToDialog(answer)
+		if len(result.Citations) > 0 {
+			s.storeCitations(chat, result.Citations)
 		}
+	}
+	s.saveHistory(chat)
+	// speech synthesis is slow, the next question should not wait for it
+	go s.sendVoiceReply(chat, result.Text, c)
 
-		if reply != "" {
-			chat.addAssistantMessage(reply)
-			if len(citations) > 0 {
-				s.storeCitations(chat, citations)
-			}
-			s.saveHistory(chat)
-		}
-		return
+	if question != nil && chat.ThreadID != nil && threadTitle(chat) == newThreadTitle {
+		s.nameThread(chat, *question)
+	}
+}
+
+// thinkingDraft renders the tail of the model's thinking as a spoiler for the draft
+func thinkingDraft(thinking string) string {
+	const maxLen = 3500
+	runes := []rune(thinking)
+	if len(runes) > maxLen {
+		runes = append([]rune("…"), runes[len(runes)-maxLen:]...)
 	}
 
-	Log.WithField("user", c.Sender().Username).Warn("Max tool call rounds exceeded")
-	_, _ = c.Bot().Send(c.Sender(), "Response incomplete: too many tool calls")
+	return "💭 <tg-spoiler>" + html.EscapeString(string(runes)) + "</tg-spoiler>"
 }
 
 // extractCitation converts an Anthropic Citation to our local Citation type
@@ -258,27 +242,36 @@ func extractCitation(cit anthropic.Citation) Citation {
 	}
 }
 
-// generateSimple performs a non-streaming Anthropic call for internal use
+// generateSimple performs a non-streaming call for internal use
 // (summaries, title generation, etc.)
-func (s *Server) generateSimple(system, prompt, model string) (string, error) {
+func (s *Server) generateSimple(chat *Chat, system, prompt, model string) (string, error) {
+	if chat != nil {
+		if err := s.checkBudget(chat.payerID()); err != nil {
+			return "", err
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	client := anthropic.New(
-		anthropic.WithAPIKey(s.conf.AnthropicAPIKey),
-		anthropic.WithModel(model),
-		anthropic.WithSystemPrompt(system),
-		anthropic.WithMaxTokens(1024),
-	)
-
-	messages := []*anthropic.Message{
-		anthropic.NewUserTextMessage(prompt),
-	}
-
-	response, err := client.Generate(ctx, messages)
+	m := s.getModel(model)
+	response, err := s.getProvider(m).Generate(ctx, &ProviderRequest{
+		Model:     m.ModelID,
+		System:    system,
+		MaxTokens: 1024,
+		Messages: []*anthropic.Message{
+			anthropic.NewUserTextMessage(prompt),
+		},
+	})
 	if err != nil {
 		return "", err
 	}
+	s.recordUsage(chat, m, &TokenUsage{
+		InputTokens:         response.Usage.InputTokens,
+		OutputTokens:        response.Usage.OutputTokens,
+		CacheReadTokens:     response.Usage.CacheReadInputTokens,
+		CacheCreationTokens: response.Usage.CacheCreationInputTokens,
+	})
 
 	var result string
 	for _, content := range response.Content {
@@ -293,7 +286,7 @@ func (s *Server) generateSimple(system, prompt, model string) (string, error) {
 // simpleAnswer answers a one-off question using the chat's current model
 func (s *Server) simpleAnswer(c tele.Context, request string) (string, error) {
 	_ = c.Notify(tele.Typing)
-	chat := s.getChat(c.Chat(), c.Sender())
+	chat := s.getChat(c)
 
 	prompt := chat.MasterPrompt
 	if chat.RoleID != nil {
@@ -301,20 +294,22 @@ func (s *Server) simpleAnswer(c tele.Context, request string) (string, error) {
 	}
 
 	model := s.getModel(chat.ModelName)
-	return s.generateSimple(prompt, request, model.ModelID)
+	return s.generateSimple(chat, prompt, request, model.ModelID)
 }
 
 // anonymousAnswer answers without chat context
 func (s *Server) anonymousAnswer(c tele.Context, request string) (string, error) {
 	_ = c.Notify(tele.Typing)
 	model := s.conf.Models[0]
-	return s.generateSimple(masterPrompt, request, model.ModelID)
+	// inline queries come without a chat, the usage is the user's
+	chat := &Chat{UserID: s.getUser(c.Sender().Username).ID}
+	return s.generateSimple(chat, masterPrompt, request, model.ModelID)
 }
 
-// summarize summarizes chat history using generateSimple
-func (s *Server) summarize(chatHistory []ChatMessage) (string, error) {
+// summarize summarizes the chat history using generateSimple
+func (s *Server) summarize(chat *Chat) (string, error) {
 	var historyText strings.Builder
-	for _, h := range chatHistory {
+	for _, h := range chat.History {
 		if h.Role == "tool" {
 			continue
 		}
@@ -325,7 +320,7 @@ func (s *Server) summarize(chatHistory []ChatMessage) (string, error) {
 
 	prompt := historyText.String() + "\n\nMake a compressed summary of the conversation. Be brief, highlight key points. Use same language as the user."
 	model := s.conf.Models[0].ModelID
-	return s.generateSimple("Be as brief as possible", prompt, model)
+	return s.generateSimple(chat, "Be as brief as possible", prompt, model)
 }
 
 // storeCitations saves citations to the last assistant message in chat history
@@ -342,33 +337,58 @@ func (s *Server) storeCitations(chat *Chat, citations []Citation) {
 	}
 }
 
-func (s *Server) sendFinalReply(chat *Chat, answer string, c tele.Context) {
+// sendFinalReply sends the answer with the reply menu and returns the
+// messages sent, none when sending failed. The cited parts of the answer are
+// marked with footnotes numbering the sources listed under it.
+func (s *Server) sendFinalReply(chat *Chat, answer string, cited []CitedText, c tele.Context) []*tele.Message {
 	if len(answer) == 0 {
-		return
+		return nil
+	}
+
+	var citations []Citation
+	for _, ct := range cited {
+		citations = append(citations, ct.Citations...)
 	}
+	sources := sourceList(citations)
+	text := markdown.Format(withFootnotes(answer, cited, sources))
+	if len(sources) > 0 {
+		appendSources(text, chat.t("Sources"), sources)
+	}
+
+	return s.sendReply(chat, c, text, answerMenu(sources))
+}
 
-	msg, err := c.Bot().Send(
-		c.Sender(),
-		ConvertMarkdownToTelegramMarkdownV2(answer),
-		"text",
-		&tele.SendOptions{ParseMode: tele.ModeMarkdownV2},
-		replyMenu,
-	)
+// sendReply sends a formatted answer with the markup and remembers its last
+// message for removing the menu later. It returns the messages sent.
+func (s *Server) sendReply(chat *Chat, c tele.Context, text *markdown.Formatted, markup *tele.ReplyMarkup) []*tele.Message {
+	var edit []tele.Editable
+	e, answering := c.(*answerContext)
+	if answering {
+		// the answer replaces the placeholder or the old answer of an edited question
+		edit = e.answer
+	}
+	sent, err := sendFormatted(c, text, edit, markup)
 	if err != nil {
 		Log.Warn(err)
-		msg, err = c.Bot().Send(c.Sender(), answer, replyMenu)
-		if err != nil {
-			Log.Warn(err)
-			_ = c.Send(err.Error())
-			return
-		}
+		_ = c.Send(err.Error())
 	}
 
-	if msg != nil {
-		id := strconv.Itoa(msg.ID)
+	if len(sent) > 0 {
+		if answering {
+			e.answered = true
+		}
+		id := strconv.Itoa(sent[len(sent)-1].ID)
 		chat.setMessageID(&id)
 		s.setChatLastMessageID(&id, chat.ChatID)
 	}
+
+	return sent
+}
+
+// saveChat saves the chat settings, the history is saved by saveHistory.
+// gorm would key the messages by the record ID, threads key them by ChatID.
+func (s *Server) saveChat(chat *Chat) {
+	s.db.Omit("History").Save(chat)
 }
 
 func (s *Server) saveHistory(chat *Chat) {
@@ -380,21 +400,45 @@ func (s *Server) saveHistory(chat *Chat) {
 			history = append(history, h)
 			continue
 		}
-		if chat.ConversationAge > 0 && h.CreatedAt.Before(time.Now().AddDate(0, 0, -int(chat.ConversationAge))) {
+		// threads keep their messages, the web app shows the whole history
+		if chat.ThreadID == nil && chat.ConversationAge > 0 && h.CreatedAt.Before(time.Now().AddDate(0, 0, -int(chat.ConversationAge))) {
 			s.db.Where("chat_id = ?", chat.ID).Where("id = ?", h.ID).Delete(&ChatMessage{})
 		} else {
 			history = append(history, h)
 		}
 	}
+	// New messages continue the active branch, one after another
+	for i := range history {
+		if history[i].ID != 0 {
+			continue
+		}
+		history[i].ChatID = chat.historyID()
+		history[i].ChatRecordID = &chat.ID
+		history[i].ParentID = chat.ActiveLeafID
+		if err := s.db.Create(&history[i]).Error; err != nil {
+			Log.WithField("error", err).Error("Failed to save message")
+			continue
+		}
+		id := history[i].ID
+		chat.ActiveLeafID = &id
+	}
 	chat.History = history
+	if chat.ThreadID != nil {
+		s.saveChat(chat)
+		// summarised like in the web app, hiding old messages from the model
+		if err := s.checkAndSummarizeContext(chat); err != nil {
+			Log.WithField("error", err).Warn("Failed to summarize thread context")
+		}
+		return
+	}
 	if len(chat.History) < 100 {
-		s.db.Save(&chat)
+		s.saveChat(chat)
 		return
 	}
 
 	Log.WithField("user", chat.User.Username).
 		Infof("Chat history for chat ID %d is too long. Summarising...", chat.ID)
-	summary, err := s.summarize(chat.History)
+	summary, err := s.summarize(chat)
 	if err != nil {
 		Log.Warn(err)
 		return
@@ -408,46 +452,39 @@ func (s *Server) saveHistory(chat *Chat) {
 		Infof("Deleting chat history for chat ID %d up to message ID %d", chat.ID, maxID)
 	s.db.Where("chat_id = ?", chat.ID).Where("id <= ?", maxID).Delete(&ChatMessage{})
 
-	chat.History = []ChatMessage{{
-		Role:      "assistant",
-		Content:   &summary,
-		ChatID:    chat.ChatID,
-		CreatedAt: time.Now(),
-	}}
+	// The summary takes the place of the deleted messages in the tree
+	summaryMessage := ChatMessage{
+		Role:         "assistant",
+		Content:      &summary,
+		ChatID:       int64(chat.ID),
+		ChatRecordID: &chat.ID,
+		CreatedAt:    time.Now(),
+	}
+	if err := s.db.Create(&summaryMessage).Error; err != nil {
+		Log.WithField("error", err).Error("Failed to save summary")
+		return
+	}
+	s.db.Model(&ChatMessage{}).
+		Where("chat_id = ? AND parent_id <= ?", chat.ID, maxID).
+		UpdateColumn("parent_id", summaryMessage.ID)
+	chat.History = []ChatMessage{summaryMessage}
 
 	Log.WithField("user", chat.User.Username).
 		Info("Chat history length after summarising: ", len(chat.History))
 
-	s.db.Save(&chat)
+	s.saveChat(chat)
 }
 
 func (s *Server) processPDF(c tele.Context) {
-	pdf := c.Message().Document.File
-	var fileName string
-
-	if s.conf.TelegramServerURL != "" {
-		f, err := c.Bot().FileByID(pdf.FileID)
-		if err != nil {
-			Log.Warn("Error getting file ID", "error=", err)
-			return
-		}
-		fileName = f.FilePath
-	} else {
-		out, err := os.Create("uploads/" + pdf.FileID + ".pdf")
-		if err != nil {
-			Log.Warn("Error creating file", "error=", err)
-			return
-		}
-		if err := c.Bot().Download(&pdf, out.Name()); err != nil {
-			Log.Warn("Error getting file content", "error=", err)
-			return
-		}
-		fileName = out.Name()
+	fileName, err := s.localFile(c, c.Message().Document.File, ".pdf")
+	if err != nil {
+		Log.Warn("Error getting file", "error=", err)
+		return
 	}
 
-	chat := s.getChat(c.Chat(), c.Sender())
-	chat.addFileToDialog(c.Message().Caption, fileName, c.Message().Document.FileName)
-	s.db.Save(&chat)
+	chat := s.getChat(c)
+	chat.addFileToDialog(s.stripMention(c.Message().Caption), fileName, c.Message().Document.FileName, speakerName(c))
+	s.saveHistory(chat)
 
 	s.complete(c, "")
 }
@@ -3,14 +3,17 @@ package main
 // main.go
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	stdlog "log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -90,7 +93,21 @@ func main() {
 		if err := db.AutoMigrate(&Role{}); err != nil {
 			panic("failed to migrate role")
 		}
-
+		if err := db.AutoMigrate(&UsageRecord{}); err != nil {
+			panic("failed to migrate usage record")
+		}
+		if err := db.AutoMigrate(&Migration{}); err != nil {
+			panic("failed to migrate migration")
+		}
+		if err := runMigration(db, "message_tree", migrateMessageTree); err != nil {
+			Log.WithField("error", err).Error("Failed to migrate message tree")
+		}
+		if err := runMigration(db, "summary_tool", migrateSummaryTool); err != nil {
+			Log.WithField("error", err).Error("Failed to enable the summary tool")
+		}
+		if err := runMigration(db, "message_chat_record", migrateMessageChats); err != nil {
+			Log.WithField("error", err).Error("Failed to link messages to their chats")
+		}
 
 		if len(conf.Models) == 0 {
 			panic("config.json must contain at least one model in 'models' array")
@@ -104,6 +121,12 @@ func main() {
 			connectionManager: NewConnectionManager(3),
 		}
 		l = i18n.New("ru", "en")
+		if err := setupSearch(db); err != nil {
+			Log.WithField("error", err).Warn("Full-text search disabled, build with -tags sqlite_fts5")
+		} else {
+			server.searchEnabled = true
+		}
+		server.registerTools()
 
 		// Setup and start web server if enabled
 		if conf.MiniAppEnabled {
@@ -131,12 +154,42 @@ func main() {
 			}()
 		}
 
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			server.shutdown()
+		}()
+
 		server.run()
+		server.closeMCPClients()
 	} else {
 		Log.Warn("failed to load config", "error=", err)
 	}
 }
 
+// shutdown stops the web server and the bot, run returns once it has stopped
+func (s *Server) shutdown() {
+	Log.Info("Shutting down")
+	if s.webServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.webServer.Shutdown(ctx); err != nil {
+			Log.WithField("error", err).Warn("Failed to stop web server")
+		}
+	}
+
+	s.Lock()
+	b := s.bot
+	s.Unlock()
+	if b != nil {
+		b.Stop()
+	} else {
+		s.closeMCPClients()
+		os.Exit(0)
+	}
+}
+
 // load config at given path
 func loadConfig(fpath string) (conf config, err error) {
 	if err := godotenv.Load(); err != nil {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tectiv3/chatgpt-bot/i18n"
+	tele "gopkg.in/telebot.v3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	// the test binary doubles as the stdio MCP server of the MCP tests
+	if os.Getenv(testMCPServerEnv) != "" {
+		runTestMCPServer(os.Stdin, os.Stdout)
+		os.Exit(0)
+	}
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	Log = logger.WithField("ver", Version)
+	l = i18n.New("ru", "en")
+
+	os.Exit(m.Run())
+}
+
+var testDBs atomic.Int32
+
+// testDB opens an in-memory database of its own for a test, with the tables
+// of the models
+func testDB(t *testing.T, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:test%d?mode=memory&cache=shared", testDBs.Add(1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// fakeTelegram is a Bot API recording the calls made to it as the method
+// and the message ID. Sent messages get IDs from 100 on.
+type fakeTelegram struct {
+	sync.Mutex
+	calls []string
+	next  int
+}
+
+// testBot returns a bot talking to a fake Bot API
+func testBot(t *testing.T) (*tele.Bot, *fakeTelegram) {
+	t.Helper()
+
+	api := &fakeTelegram{next: 100}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&params)
+		method := path.Base(r.URL.Path)
+
+		api.Lock()
+		id := params["message_id"]
+		if method == "sendMessage" {
+			id = api.next
+			api.next++
+		}
+		api.calls = append(api.calls, fmt.Sprintf("%s %v", method, id))
+		api.Unlock()
+
+		if method == "deleteMessage" {
+			fmt.Fprint(w, `{"ok":true,"result":true}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%v,"chat":{"id":1,"type":"private"},"text":""}}`, id)
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bot, api
+}
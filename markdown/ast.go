@@ -0,0 +1,96 @@
+// Package markdown parses the Markdown written by language models, CommonMark
+// with the GitHub tables, strikethrough, task lists and autolinks, and
+// renders it for Telegram as MarkdownV2 or HTML.
+package markdown
+
+// Kind is the type of a node
+type Kind int
+
+const (
+	Document Kind = iota
+	Paragraph
+	Heading
+	CodeBlock
+	Blockquote
+	List
+	ListItem
+	Table
+	TableRow
+	TableCell
+	ThematicBreak
+
+	Text
+	SoftBreak
+	LineBreak
+	Code
+	Emphasis
+	Strong
+	Strikethrough
+	Spoiler
+	Link
+	Image
+)
+
+// Align is the alignment of a table column
+type Align int
+
+const (
+	AlignNone Align = iota
+	AlignLeft
+	AlignCenter
+	AlignRight
+)
+
+// Node is an element of the document tree
+type Node struct {
+	Kind     Kind
+	Children []*Node
+
+	// Literal is the text of Text, Code and CodeBlock nodes
+	Literal string
+	// Info is the language of a CodeBlock
+	Info string
+	// Destination is the URL of a Link or Image
+	Destination string
+	// Level is the level of a Heading, 1 to 6
+	Level int
+
+	// Ordered lists number their items from Start
+	Ordered bool
+	Start   int
+	// Tight lists have no blank lines between their items
+	Tight bool
+	// Task is set on the items of a task list, Checked when they are done
+	Task    bool
+	Checked bool
+
+	// Align has the alignment of each column of a Table
+	Align []Align
+}
+
+// Parse parses a Markdown document
+func Parse(src string) *Node {
+	return &Node{Kind: Document, Children: parseBlocks(splitLines(src))}
+}
+
+// PlainText returns the text of a node without formatting
+func (n *Node) PlainText() string {
+	var b []byte
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		switch n.Kind {
+		case Text, Code:
+			b = append(b, n.Literal...)
+		case SoftBreak:
+			b = append(b, ' ')
+		case LineBreak:
+			b = append(b, '\n')
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return string(b)
+}
@@ -0,0 +1,486 @@
+package markdown
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	atxHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	thematicBreak = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	setextHeading = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	openingFence  = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*?)[ \t]*$")
+	tableDelim    = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+)
+
+// splitLines splits the source into lines. Tabs are kept, code blocks need
+// them, and count as indentation up to the next multiple of four columns.
+func splitLines(src string) []string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+
+	return strings.Split(src, "\n")
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// indentOf returns the width of the leading whitespace in columns
+func indentOf(line string) int {
+	col := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			col++
+		case '\t':
+			col += 4 - col%4
+		default:
+			return col
+		}
+	}
+	return col
+}
+
+// stripIndent removes up to n columns of the leading whitespace. The rest of
+// a tab crossing the n-th column is left as spaces, later tabs are kept.
+func stripIndent(line string, n int) string {
+	col := 0
+	for i := 0; i < len(line); i++ {
+		if col >= n {
+			return line[i:]
+		}
+		switch line[i] {
+		case ' ':
+			col++
+		case '\t':
+			col += 4 - col%4
+		default:
+			return line[i:]
+		}
+		if col > n {
+			return strings.Repeat(" ", col-n) + line[i+1:]
+		}
+	}
+	return ""
+}
+
+// listMarker describes the marker starting a list item
+type listMarker struct {
+	ordered bool
+	// bullet character, or the delimiter after the number
+	char  byte
+	start int
+	// column the item content starts at
+	content int
+	empty   bool
+	// text is the first line of the item content
+	text string
+}
+
+// parseListMarker reads the marker of a list item, ok is false when the line
+// does not start one
+func parseListMarker(line string) (m listMarker, ok bool) {
+	indent := indentOf(line)
+	if indent > 3 {
+		return m, false
+	}
+	rest := line[indent:]
+
+	width := 0
+	switch {
+	case rest != "" && strings.IndexByte("-+*", rest[0]) >= 0:
+		m.char = rest[0]
+		width = 1
+	default:
+		digits := 0
+		for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits >= len(rest) || (rest[digits] != '.' && rest[digits] != ')') {
+			return m, false
+		}
+		m.ordered = true
+		m.char = rest[digits]
+		m.start, _ = strconv.Atoi(rest[:digits])
+		width = digits + 1
+	}
+
+	after := rest[width:]
+	if after == "" || isBlank(after) {
+		m.empty = true
+		m.content = indent + width + 1
+		return m, true
+	}
+	if after[0] != ' ' {
+		return m, false
+	}
+	spaces := indentOf(after)
+	if spaces > 4 {
+		// the content is indented code, the marker takes one space
+		spaces = 1
+	}
+	m.content = indent + width + spaces
+	m.text = stripIndent(after, spaces)
+
+	return m, true
+}
+
+// startsBlock reports whether a line starts a block that ends a paragraph
+func startsBlock(line string) bool {
+	if atxHeading.MatchString(line) || thematicBreak.MatchString(line) || openingFence.MatchString(line) {
+		return true
+	}
+	if trimmed := strings.TrimLeft(line, " "); indentOf(line) < 4 && strings.HasPrefix(trimmed, ">") {
+		return true
+	}
+	if m, ok := parseListMarker(line); ok && !m.empty && (!m.ordered || m.start == 1) {
+		return true
+	}
+
+	return false
+}
+
+// tableCells splits a table row into its cells
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// isTableStart reports whether a table with the header at lines[i] starts there
+func isTableStart(lines []string, i int) bool {
+	if i+1 >= len(lines) || !strings.Contains(lines[i], "|") || !tableDelim.MatchString(lines[i+1]) {
+		return false
+	}
+	if !strings.Contains(lines[i+1], "|") && len(tableCells(lines[i])) != 1 {
+		return false
+	}
+
+	return len(tableCells(lines[i])) == len(tableCells(lines[i+1]))
+}
+
+// parseBlocks parses lines into block nodes
+func parseBlocks(lines []string) []*Node {
+	var blocks []*Node
+	var para []string
+
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		for i := range para {
+			para[i] = strings.TrimLeft(para[i], " \t")
+		}
+		text := strings.TrimRight(strings.Join(para, "\n"), " \t")
+		blocks = append(blocks, &Node{Kind: Paragraph, Children: parseInlines(text)})
+		para = nil
+	}
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			flush()
+			i++
+			continue
+		}
+
+		if len(para) > 0 {
+			if m := setextHeading.FindStringSubmatch(line); m != nil {
+				level := 2
+				if m[1][0] == '=' {
+					level = 1
+				}
+				heading := strings.TrimSpace(strings.Join(para, "\n"))
+				para = nil
+				blocks = append(blocks, &Node{Kind: Heading, Level: level, Children: parseInlines(heading)})
+				i++
+				continue
+			}
+		}
+
+		if indentOf(line) >= 4 {
+			if len(para) > 0 {
+				// indented lines continue a paragraph
+				para = append(para, line)
+				i++
+				continue
+			}
+			var code []string
+			for i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4) {
+				if isBlank(lines[i]) {
+					code = append(code, "")
+				} else {
+					code = append(code, stripIndent(lines[i], 4))
+				}
+				i++
+			}
+			for len(code) > 0 && code[len(code)-1] == "" {
+				code = code[:len(code)-1]
+			}
+			blocks = append(blocks, &Node{Kind: CodeBlock, Literal: strings.Join(code, "\n")})
+			continue
+		}
+
+		if m := openingFence.FindStringSubmatch(line); m != nil {
+			flush()
+			indent, fence := len(m[1]), m[2]
+			info := strings.Fields(m[3])
+			var code []string
+			i++
+			for i < len(lines) {
+				l := lines[i]
+				if t := strings.TrimSpace(l); indentOf(l) < 4 && strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+					i++
+					break
+				}
+				// the content loses the indentation of the fence
+				code = append(code, stripIndent(l, indent))
+				i++
+			}
+			block := &Node{Kind: CodeBlock, Literal: strings.Join(code, "\n")}
+			if len(info) > 0 {
+				block.Info = info[0]
+			}
+			blocks = append(blocks, block)
+			continue
+		}
+
+		if m := atxHeading.FindStringSubmatch(line); m != nil {
+			flush()
+			blocks = append(blocks, &Node{Kind: Heading, Level: len(m[1]), Children: parseInlines(strings.TrimSpace(m[2]))})
+			i++
+			continue
+		}
+
+		if thematicBreak.MatchString(line) {
+			flush()
+			blocks = append(blocks, &Node{Kind: ThematicBreak})
+			i++
+			continue
+		}
+
+		if strings.HasPrefix(strings.TrimLeft(line, " "), ">") {
+			flush()
+			var inner []string
+			for i < len(lines) {
+				l := lines[i]
+				if t := strings.TrimLeft(l, " "); indentOf(l) < 4 && strings.HasPrefix(t, ">") {
+					t = t[1:]
+					if strings.HasPrefix(t, " ") {
+						t = t[1:]
+					}
+					inner = append(inner, t)
+					i++
+					continue
+				}
+				// lazy continuation of a quoted paragraph
+				if !isBlank(l) && len(inner) > 0 && !isBlank(inner[len(inner)-1]) && !startsBlock(l) {
+					inner = append(inner, l)
+					i++
+					continue
+				}
+				break
+			}
+			blocks = append(blocks, &Node{Kind: Blockquote, Children: parseBlocks(inner)})
+			continue
+		}
+
+		if m, ok := parseListMarker(line); ok && (len(para) == 0 || (!m.empty && (!m.ordered || m.start == 1))) {
+			flush()
+			var list *Node
+			list, i = parseList(lines, i, m)
+			blocks = append(blocks, list)
+			continue
+		}
+
+		if isTableStart(lines, i) {
+			flush()
+			var table *Node
+			table, i = parseTable(lines, i)
+			blocks = append(blocks, table)
+			continue
+		}
+
+		para = append(para, line)
+		i++
+	}
+	flush()
+
+	return blocks
+}
+
+// parseList parses the list starting at lines[i] and returns the index of
+// the first line after it
+func parseList(lines []string, i int, first listMarker) (*Node, int) {
+	list := &Node{Kind: List, Ordered: first.ordered, Start: first.start, Tight: true}
+
+	for i < len(lines) {
+		m, ok := parseListMarker(lines[i])
+		if !ok || m.ordered != first.ordered || m.char != first.char {
+			break
+		}
+		if len(list.Children) > 0 && thematicBreak.MatchString(lines[i]) {
+			break
+		}
+
+		var item []string
+		if m.empty {
+			item = append(item, "")
+		} else {
+			item = append(item, m.text)
+		}
+		i++
+		fenced := openingFence.MatchString(item[0])
+		for i < len(lines) {
+			l := lines[i]
+			if isBlank(l) {
+				item = append(item, "")
+				i++
+				continue
+			}
+			if indentOf(l) >= m.content {
+				content := stripIndent(l, m.content)
+				if openingFence.MatchString(content) {
+					fenced = !fenced
+				}
+				item = append(item, content)
+				i++
+				continue
+			}
+			// lazy continuation of the item's paragraph
+			if prev := item[len(item)-1]; !fenced && !isBlank(prev) && !startsBlock(l) && !isTableStart(lines, i) {
+				if _, marker := parseListMarker(l); !marker {
+					item = append(item, l)
+					i++
+					continue
+				}
+			}
+			break
+		}
+
+		// blank lines at the end separate the item from the next one
+		blank := 0
+		for len(item) > 1 && item[len(item)-1] == "" {
+			item = item[:len(item)-1]
+			blank++
+		}
+		if blank > 0 && i < len(lines) {
+			if next, ok := parseListMarker(lines[i]); ok && next.ordered == first.ordered && next.char == first.char {
+				list.Tight = false
+			}
+		}
+
+		children := parseBlocks(item)
+		if len(children) > 1 {
+			for j := 1; j < len(item)-1; j++ {
+				if item[j] == "" && !insideFence(item[:j]) {
+					list.Tight = false
+					break
+				}
+			}
+		}
+
+		node := &Node{Kind: ListItem, Children: children}
+		taskItem(node)
+		list.Children = append(list.Children, node)
+	}
+
+	return list, i
+}
+
+// insideFence reports whether the lines end inside a fenced code block
+func insideFence(lines []string) bool {
+	fenced := false
+	for _, l := range lines {
+		if openingFence.MatchString(l) {
+			fenced = !fenced
+		}
+	}
+	return fenced
+}
+
+// taskItem turns an item starting with [ ] or [x] into a task
+func taskItem(item *Node) {
+	if len(item.Children) == 0 || item.Children[0].Kind != Paragraph {
+		return
+	}
+	para := item.Children[0]
+	if len(para.Children) == 0 || para.Children[0].Kind != Text {
+		return
+	}
+	text := para.Children[0]
+	if len(text.Literal) < 4 || text.Literal[0] != '[' || text.Literal[2] != ']' || text.Literal[3] != ' ' {
+		return
+	}
+	switch text.Literal[1] {
+	case ' ':
+	case 'x', 'X':
+		item.Checked = true
+	default:
+		return
+	}
+	item.Task = true
+	text.Literal = text.Literal[4:]
+}
+
+// parseTable parses the table with its header at lines[i] and returns the
+// index of the first line after it
+func parseTable(lines []string, i int) (*Node, int) {
+	header := tableCells(lines[i])
+	table := &Node{Kind: Table}
+	for _, d := range tableCells(lines[i+1]) {
+		left, right := strings.HasPrefix(d, ":"), strings.HasSuffix(d, ":")
+		switch {
+		case left && right:
+			table.Align = append(table.Align, AlignCenter)
+		case right:
+			table.Align = append(table.Align, AlignRight)
+		case left:
+			table.Align = append(table.Align, AlignLeft)
+		default:
+			table.Align = append(table.Align, AlignNone)
+		}
+	}
+
+	row := func(cells []string) *Node {
+		r := &Node{Kind: TableRow}
+		for c := range header {
+			text := ""
+			if c < len(cells) {
+				text = cells[c]
+			}
+			r.Children = append(r.Children, &Node{Kind: TableCell, Children: parseInlines(text)})
+		}
+		return r
+	}
+
+	table.Children = append(table.Children, row(header))
+	i += 2
+	for i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]) {
+		table.Children = append(table.Children, row(tableCells(lines[i])))
+		i++
+	}
+
+	return table, i
+}
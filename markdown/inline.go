@@ -0,0 +1,601 @@
+package markdown
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// item is an inline node in the doubly linked list the inline parser works on
+type item struct {
+	node       *Node
+	prev, next *item
+}
+
+// delimiter is a run of *, _, ~ or | that may open or close emphasis
+type delimiter struct {
+	item     *item
+	char     byte
+	count    int
+	orig     int
+	canOpen  bool
+	canClose bool
+
+	prev, next *delimiter
+}
+
+// bracket is a [ or ![ that may start a link or image
+type bracket struct {
+	item   *item
+	image  bool
+	active bool
+	// top of the delimiter stack when the bracket was found
+	delims *delimiter
+	prev   *bracket
+}
+
+type inlineParser struct {
+	src string
+	pos int
+
+	head, tail *item
+	delims     *delimiter
+	brackets   *bracket
+	text       strings.Builder
+}
+
+// parseInlines parses the text of a block into inline nodes
+func parseInlines(src string) []*Node {
+	p := &inlineParser{src: src}
+	p.parse()
+
+	return p.nodes(p.head, nil)
+}
+
+func (p *inlineParser) parse() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case '\\':
+			p.escape()
+		case '`':
+			p.codeSpan()
+		case '*', '_', '~', '|':
+			p.delimiterRun(c)
+		case '[':
+			p.flushText()
+			p.pushBracket(p.appendText("["), false)
+			p.pos++
+		case '!':
+			if strings.HasPrefix(p.src[p.pos:], "![") {
+				p.flushText()
+				p.pushBracket(p.appendText("!["), true)
+				p.pos += 2
+			} else {
+				p.text.WriteByte(c)
+				p.pos++
+			}
+		case ']':
+			p.closeBracket()
+		case '<':
+			if !p.autolink() {
+				p.text.WriteByte(c)
+				p.pos++
+			}
+		case '\n':
+			p.lineBreak()
+		default:
+			if !p.bareURL() {
+				_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+				p.text.WriteString(p.src[p.pos : p.pos+size])
+				p.pos += size
+			}
+		}
+	}
+	p.flushText()
+	p.processEmphasis(nil)
+}
+
+// flushText turns the pending text into a Text node
+func (p *inlineParser) flushText() {
+	if p.text.Len() == 0 {
+		return
+	}
+	p.appendText(html.UnescapeString(p.text.String()))
+	p.text.Reset()
+}
+
+func (p *inlineParser) appendText(text string) *item {
+	return p.append(&Node{Kind: Text, Literal: text})
+}
+
+func (p *inlineParser) append(n *Node) *item {
+	it := &item{node: n, prev: p.tail}
+	if p.tail != nil {
+		p.tail.next = it
+	} else {
+		p.head = it
+	}
+	p.tail = it
+
+	return it
+}
+
+func (p *inlineParser) remove(it *item) {
+	if it.prev != nil {
+		it.prev.next = it.next
+	} else {
+		p.head = it.next
+	}
+	if it.next != nil {
+		it.next.prev = it.prev
+	} else {
+		p.tail = it.prev
+	}
+}
+
+// nodes collects the nodes from one item up to another, merging adjacent text
+func (p *inlineParser) nodes(from, to *item) []*Node {
+	var nodes []*Node
+	for it := from; it != nil && it != to; it = it.next {
+		n := it.node
+		if n.Kind == Text && len(nodes) > 0 && nodes[len(nodes)-1].Kind == Text {
+			nodes[len(nodes)-1].Literal += n.Literal
+			continue
+		}
+		if n.Kind == Text && n.Literal == "" {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nodes
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
+
+func (p *inlineParser) escape() {
+	if p.pos+1 < len(p.src) {
+		next := p.src[p.pos+1]
+		if next == '\n' {
+			p.flushText()
+			p.append(&Node{Kind: LineBreak})
+			p.pos += 2
+			return
+		}
+		if isASCIIPunct(next) {
+			// escaped characters are never markup nor entities
+			p.flushText()
+			p.append(&Node{Kind: Text, Literal: string(next)})
+			p.pos += 2
+			return
+		}
+	}
+	p.text.WriteByte('\\')
+	p.pos++
+}
+
+func (p *inlineParser) codeSpan() {
+	start := p.pos
+	for p.pos < len(p.src) && p.src[p.pos] == '`' {
+		p.pos++
+	}
+	ticks := p.pos - start
+
+	for i := p.pos; i < len(p.src); {
+		j := strings.IndexByte(p.src[i:], '`')
+		if j < 0 {
+			break
+		}
+		j += i
+		k := j
+		for k < len(p.src) && p.src[k] == '`' {
+			k++
+		}
+		if k-j == ticks {
+			code := strings.ReplaceAll(p.src[p.pos:j], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			p.flushText()
+			p.append(&Node{Kind: Code, Literal: code})
+			p.pos = k
+			return
+		}
+		i = k
+	}
+
+	// no closing run, the backticks are text
+	p.text.WriteString(p.src[start:p.pos])
+}
+
+// runeBefore and runeAfter return the characters around a delimiter run,
+// a space at the start or end of the text
+func (p *inlineParser) runeBefore(pos int) rune {
+	if pos == 0 {
+		return ' '
+	}
+	r, _ := utf8.DecodeLastRuneInString(p.src[:pos])
+	return r
+}
+
+func (p *inlineParser) runeAfter(pos int) rune {
+	if pos >= len(p.src) {
+		return ' '
+	}
+	r, _ := utf8.DecodeRuneInString(p.src[pos:])
+	return r
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+func (p *inlineParser) delimiterRun(c byte) {
+	start := p.pos
+	for p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+	}
+	count := p.pos - start
+	// strikethrough takes one or two tildes, spoilers two bars
+	if (c == '~' && count > 2) || (c == '|' && count != 2) {
+		p.text.WriteString(p.src[start:p.pos])
+		return
+	}
+
+	before, after := p.runeBefore(start), p.runeAfter(p.pos)
+	left := !unicode.IsSpace(after) && (!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+	right := !unicode.IsSpace(before) && (!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+
+	d := &delimiter{char: c, count: count, orig: count, canOpen: left, canClose: right}
+	if c == '_' {
+		d.canOpen = left && (!right || isPunct(before))
+		d.canClose = right && (!left || isPunct(after))
+	}
+	if !d.canOpen && !d.canClose {
+		p.text.WriteString(p.src[start:p.pos])
+		return
+	}
+
+	p.flushText()
+	d.item = p.appendText(p.src[start:p.pos])
+	d.prev = p.delims
+	if p.delims != nil {
+		p.delims.next = d
+	}
+	p.delims = d
+}
+
+func (p *inlineParser) removeDelimiter(d *delimiter) {
+	if d.prev != nil {
+		d.prev.next = d.next
+	}
+	if d.next != nil {
+		d.next.prev = d.prev
+	} else {
+		p.delims = d.prev
+	}
+}
+
+func (p *inlineParser) pushBracket(it *item, image bool) {
+	p.brackets = &bracket{item: it, image: image, active: true, delims: p.delims, prev: p.brackets}
+}
+
+func (p *inlineParser) closeBracket() {
+	p.flushText()
+	p.pos++
+	b := p.brackets
+	if b == nil {
+		p.appendText("]")
+		return
+	}
+	p.brackets = b.prev
+	if !b.active {
+		p.appendText("]")
+		return
+	}
+
+	dest, end, ok := parseDestination(p.src, p.pos)
+	if !ok {
+		p.appendText("]")
+		return
+	}
+	p.pos = end
+
+	// emphasis inside the link text is resolved first
+	p.processEmphasis(b.delims)
+
+	kind := Link
+	if b.image {
+		kind = Image
+	}
+	link := &Node{Kind: kind, Destination: dest, Children: p.nodes(b.item.next, nil)}
+	b.item.next = nil
+	p.tail = b.item
+	b.item.node = link
+
+	if !b.image {
+		// links cannot contain other links
+		for o := p.brackets; o != nil; o = o.prev {
+			if !o.image {
+				o.active = false
+			}
+		}
+	}
+}
+
+// parseDestination reads the (destination "title") after a link text
+func parseDestination(src string, pos int) (dest string, end int, ok bool) {
+	if pos >= len(src) || src[pos] != '(' {
+		return "", pos, false
+	}
+	i := pos + 1
+	skipSpace := func() {
+		for i < len(src) && (src[i] == ' ' || src[i] == '\t' || src[i] == '\n') {
+			i++
+		}
+	}
+	skipSpace()
+
+	if i < len(src) && src[i] == '<' {
+		j := strings.IndexAny(src[i+1:], ">\n")
+		if j < 0 || src[i+1+j] != '>' {
+			return "", pos, false
+		}
+		dest = src[i+1 : i+1+j]
+		i += j + 2
+	} else {
+		start, depth := i, 0
+		for i < len(src) {
+			c := src[i]
+			if c == '\\' && i+1 < len(src) {
+				i += 2
+				continue
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			} else if c == ' ' || c == '\t' || c == '\n' || c < 0x20 {
+				break
+			}
+			i++
+		}
+		dest = src[start:i]
+	}
+	skipSpace()
+
+	if i < len(src) && strings.IndexByte(`"'(`, src[i]) >= 0 {
+		closing := src[i]
+		if closing == '(' {
+			closing = ')'
+		}
+		j := strings.IndexByte(src[i+1:], closing)
+		if j < 0 {
+			return "", pos, false
+		}
+		i += j + 2
+		skipSpace()
+	}
+	if i >= len(src) || src[i] != ')' {
+		return "", pos, false
+	}
+
+	return unescapeString(dest), i + 1, true
+}
+
+// unescapeString drops the backslashes of escaped punctuation
+func unescapeString(s string) string {
+	if !strings.Contains(s, `\`) {
+		return html.UnescapeString(s)
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+
+	return html.UnescapeString(b.String())
+}
+
+// autolink parses <https://example.com> and <user@example.com>
+func (p *inlineParser) autolink() bool {
+	end := strings.IndexAny(p.src[p.pos+1:], "> \n<")
+	if end < 0 || p.src[p.pos+1+end] != '>' {
+		return false
+	}
+	target := p.src[p.pos+1 : p.pos+1+end]
+
+	dest := target
+	if scheme, _, ok := strings.Cut(target, ":"); !ok || len(scheme) < 2 || !isScheme(scheme) {
+		at := strings.IndexByte(target, '@')
+		if at <= 0 || at == len(target)-1 || !strings.Contains(target[at:], ".") {
+			return false
+		}
+		dest = "mailto:" + target
+	}
+
+	p.flushText()
+	p.append(&Node{Kind: Link, Destination: dest, Children: []*Node{{Kind: Text, Literal: target}}})
+	p.pos += end + 2
+
+	return true
+}
+
+func isScheme(s string) bool {
+	for i, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && (r >= '0' && r <= '9' || r == '+' || r == '.' || r == '-')) {
+			return false
+		}
+	}
+	return true
+}
+
+// bareURL links a URL written without markup, http(s):// or www.
+func (p *inlineParser) bareURL() bool {
+	rest := p.src[p.pos:]
+	var prefix string
+	switch {
+	case strings.HasPrefix(rest, "https://"), strings.HasPrefix(rest, "http://"):
+	case strings.HasPrefix(rest, "www."):
+		prefix = "http://"
+	default:
+		return false
+	}
+	if before := p.runeBefore(p.pos); unicode.IsLetter(before) || unicode.IsDigit(before) || before == '/' {
+		return false
+	}
+
+	end := strings.IndexFunc(rest, func(r rune) bool { return unicode.IsSpace(r) || r == '<' })
+	if end < 0 {
+		end = len(rest)
+	}
+	url := rest[:end]
+	// trailing punctuation belongs to the sentence
+	for len(url) > 0 {
+		last := url[len(url)-1]
+		if strings.IndexByte(`?!.,:;*_~'"`, last) >= 0 {
+			url = url[:len(url)-1]
+			continue
+		}
+		if last == ')' && strings.Count(url, "(") < strings.Count(url, ")") {
+			url = url[:len(url)-1]
+			continue
+		}
+		break
+	}
+	if len(url) <= len("https://") || !strings.Contains(url, ".") {
+		return false
+	}
+
+	p.flushText()
+	p.append(&Node{Kind: Link, Destination: prefix + url, Children: []*Node{{Kind: Text, Literal: url}}})
+	p.pos += len(url)
+
+	return true
+}
+
+// lineBreak ends a line, a hard break when the line ends with two spaces
+func (p *inlineParser) lineBreak() {
+	text := p.text.String()
+	trimmed := strings.TrimRight(text, " ")
+	kind := SoftBreak
+	if len(text)-len(trimmed) >= 2 {
+		kind = LineBreak
+	}
+	p.text.Reset()
+	p.text.WriteString(trimmed)
+	p.flushText()
+	p.append(&Node{Kind: kind})
+	p.pos++
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// openersKey indexes the lowest opener worth looking at for a closer
+type openersKey struct {
+	char    byte
+	canOpen bool
+	mod     int
+}
+
+// processEmphasis matches the delimiters above bottom into emphasis, as in
+// the CommonMark algorithm
+func (p *inlineParser) processEmphasis(bottom *delimiter) {
+	openersBottom := map[openersKey]*delimiter{}
+	if p.delims == bottom {
+		return
+	}
+
+	closer := p.delims
+	for closer != nil && closer.prev != bottom {
+		closer = closer.prev
+	}
+
+	for closer != nil {
+		if !closer.canClose {
+			closer = closer.next
+			continue
+		}
+
+		key := openersKey{char: closer.char, canOpen: closer.canOpen, mod: closer.orig % 3}
+		var opener *delimiter
+		for o := closer.prev; o != nil && o != bottom && o != openersBottom[key]; o = o.prev {
+			if o.char != closer.char || !o.canOpen {
+				continue
+			}
+			switch closer.char {
+			case '*', '_':
+				// a run that can open and close matches only runs of a fitting length
+				if (o.canClose || closer.canOpen) && (o.orig+closer.orig)%3 == 0 && !(o.orig%3 == 0 && closer.orig%3 == 0) {
+					continue
+				}
+			default:
+				if o.count != closer.count {
+					continue
+				}
+			}
+			opener = o
+			break
+		}
+
+		if opener == nil {
+			openersBottom[key] = closer.prev
+			next := closer.next
+			if !closer.canOpen {
+				p.removeDelimiter(closer)
+			}
+			closer = next
+			continue
+		}
+
+		n, kind := 1, Emphasis
+		switch closer.char {
+		case '*', '_':
+			if opener.count >= 2 && closer.count >= 2 {
+				n, kind = 2, Strong
+			}
+		case '~':
+			n, kind = closer.count, Strikethrough
+		case '|':
+			n, kind = 2, Spoiler
+		}
+		opener.count -= n
+		closer.count -= n
+		opener.item.node.Literal = opener.item.node.Literal[:opener.count]
+		closer.item.node.Literal = closer.item.node.Literal[:closer.count]
+
+		// the items between the runs become the children of the emphasis
+		emph := &item{node: &Node{Kind: kind, Children: p.nodes(opener.item.next, closer.item)}}
+		emph.prev, emph.next = opener.item, closer.item
+		opener.item.next = emph
+		closer.item.prev = emph
+
+		for d := closer.prev; d != nil && d != opener; d = d.prev {
+			p.removeDelimiter(d)
+		}
+		if opener.count == 0 {
+			p.remove(opener.item)
+			p.removeDelimiter(opener)
+		}
+		if closer.count == 0 {
+			next := closer.next
+			p.remove(closer.item)
+			p.removeDelimiter(closer)
+			closer = next
+		}
+	}
+
+	for p.delims != nil && p.delims != bottom {
+		p.removeDelimiter(p.delims)
+	}
+}
@@ -0,0 +1,74 @@
+package markdown
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// TestGolden renders every testdata/*.md for both parse modes and compares
+// the result with the .html and .mdv2 golden files next to it
+func TestGolden(t *testing.T) {
+	sources, err := filepath.Glob(filepath.Join("testdata", "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) == 0 {
+		t.Fatal("no test cases in testdata")
+	}
+
+	for _, source := range sources {
+		name := strings.TrimSuffix(source, ".md")
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			src, err := os.ReadFile(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := Format(string(src))
+
+			for ext, got := range map[string]string{".html": f.HTML(), ".mdv2": f.MarkdownV2()} {
+				golden := name + ext
+				if *update {
+					if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != string(want) {
+					t.Errorf("%s differs\n--- got\n%s\n--- want\n%s", golden, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStripIndent(t *testing.T) {
+	tests := []struct {
+		line string
+		n    int
+		want string
+	}{
+		{"    code", 4, "code"},
+		{"      code", 4, "  code"},
+		{"\tcode", 4, "code"},
+		{"\t\tcode", 4, "\tcode"},
+		{"  \tcode", 4, "code"},
+		{"\tcode", 2, "  code"},
+		{"  code", 4, "code"},
+		{"code\t", 0, "code\t"},
+		{"\t", 8, ""},
+	}
+	for _, tt := range tests {
+		if got := stripIndent(tt.line, tt.n); got != tt.want {
+			t.Errorf("stripIndent(%q, %d) = %q, want %q", tt.line, tt.n, got, tt.want)
+		}
+	}
+}
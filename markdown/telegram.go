@@ -0,0 +1,525 @@
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Style is a Telegram text formatting
+type Style int
+
+const (
+	Bold Style = iota + 1
+	Italic
+	Strike
+	Hidden
+	Monospace
+	Preformatted
+	TextLink
+	Quote
+)
+
+// Span formats a part of the plain text, offsets are in bytes
+type Span struct {
+	Style    Style
+	Offset   int
+	Length   int
+	URL      string
+	Language string
+}
+
+// Formatted is plain text with the spans formatting it, properly nested and
+// in the order they start in, outer spans first
+type Formatted struct {
+	Text  string
+	Spans []Span
+}
+
+// bullets of the list levels
+var bullets = []string{"•", "◦", "▪"}
+
+// Render lays a document out for Telegram: headings become bold, tables
+// preformatted blocks and lists are indented with bullets or numbers
+func Render(doc *Node) *Formatted {
+	r := &renderer{}
+	r.blocks(doc.Children, false)
+
+	return &Formatted{Text: r.buf.String(), Spans: r.spans}
+}
+
+type renderer struct {
+	buf   strings.Builder
+	spans []Span
+	// open counts the open spans of each style, the same style never nests
+	open [Quote + 1]int
+	// indent follows every line break, inside list items
+	indent string
+	depth  int
+}
+
+// write appends text, indenting the lines after the first
+func (r *renderer) write(s string) {
+	if r.indent != "" {
+		s = strings.ReplaceAll(s, "\n", "\n"+r.indent)
+	}
+	r.buf.WriteString(s)
+}
+
+// begin opens a span, -1 when the style is already open
+func (r *renderer) begin(style Style, url, lang string) int {
+	if r.open[style] > 0 {
+		return -1
+	}
+	r.open[style]++
+	r.spans = append(r.spans, Span{Style: style, Offset: r.buf.Len(), URL: url, Language: lang})
+
+	return len(r.spans) - 1
+}
+
+// end closes a span opened by begin, dropping it when it is empty
+func (r *renderer) end(i int) {
+	if i < 0 {
+		return
+	}
+	span := &r.spans[i]
+	r.open[span.Style]--
+	span.Length = r.buf.Len() - span.Offset
+	// trailing line breaks are not part of the span
+	for span.Length > 0 && r.buf.String()[span.Offset+span.Length-1] == '\n' {
+		span.Length--
+	}
+	if strings.TrimSpace(r.buf.String()[span.Offset:span.Offset+span.Length]) == "" {
+		r.spans = append(r.spans[:i], r.spans[i+1:]...)
+	}
+}
+
+func (r *renderer) blocks(nodes []*Node, tight bool) {
+	for i, n := range nodes {
+		if i > 0 {
+			if tight {
+				r.write("\n")
+			} else {
+				r.write("\n\n")
+			}
+		}
+		r.block(n)
+	}
+}
+
+func (r *renderer) block(n *Node) {
+	switch n.Kind {
+	case Paragraph, TableCell:
+		r.inlines(n.Children)
+
+	case Heading:
+		span := r.begin(Bold, "", "")
+		r.inlines(n.Children)
+		r.end(span)
+
+	case CodeBlock:
+		r.code(n.Literal, n.Info)
+
+	case Blockquote:
+		// a quote starts a line, quotes do not nest
+		span := -1
+		if r.indent == "" {
+			span = r.begin(Quote, "", "")
+		}
+		r.blocks(n.Children, false)
+		r.end(span)
+
+	case List:
+		r.list(n)
+
+	case Table:
+		r.code(tableText(n), "")
+
+	case ThematicBreak:
+		r.write("──────────")
+	}
+}
+
+// code writes a code block, as monospace lines inside a quote where
+// preformatted blocks are not allowed
+func (r *renderer) code(text, lang string) {
+	text = strings.TrimRight(text, "\n")
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	if r.open[Quote] > 0 {
+		for i, line := range strings.Split(text, "\n") {
+			if i > 0 {
+				r.write("\n")
+			}
+			span := r.begin(Monospace, "", "")
+			r.buf.WriteString(line)
+			r.end(span)
+		}
+		return
+	}
+
+	span := r.begin(Preformatted, "", lang)
+	r.buf.WriteString(text)
+	r.end(span)
+}
+
+func (r *renderer) list(n *Node) {
+	bullet := bullets[min(r.depth, len(bullets)-1)]
+	r.depth++
+	defer func() { r.depth-- }()
+
+	for i, item := range n.Children {
+		if i > 0 {
+			if n.Tight {
+				r.write("\n")
+			} else {
+				r.write("\n\n")
+			}
+		}
+
+		marker := bullet + " "
+		if n.Ordered {
+			marker = fmt.Sprintf("%d. ", n.Start+i)
+		}
+		if item.Task {
+			marker = "☐ "
+			if item.Checked {
+				marker = "☑ "
+			}
+		}
+		r.write(marker)
+
+		indent := r.indent
+		r.indent += strings.Repeat(" ", utf8.RuneCountInString(marker))
+		r.blocks(item.Children, n.Tight)
+		r.indent = indent
+	}
+}
+
+func (r *renderer) inlines(nodes []*Node) {
+	for _, n := range nodes {
+		r.inline(n)
+	}
+}
+
+func (r *renderer) inline(n *Node) {
+	switch n.Kind {
+	case Text:
+		r.write(n.Literal)
+	case SoftBreak, LineBreak:
+		r.write("\n")
+	case Code:
+		// code inside a link is plain text
+		if r.open[TextLink] > 0 {
+			r.write(n.Literal)
+			return
+		}
+		span := r.begin(Monospace, "", "")
+		r.write(n.Literal)
+		r.end(span)
+	case Emphasis:
+		r.styled(Italic, n)
+	case Strong:
+		r.styled(Bold, n)
+	case Strikethrough:
+		r.styled(Strike, n)
+	case Spoiler:
+		r.styled(Hidden, n)
+	case Link, Image:
+		text := n.PlainText()
+		if !linkable(n.Destination) {
+			if text == "" {
+				text = n.Destination
+			}
+			r.write(text)
+			return
+		}
+		span := r.begin(TextLink, n.Destination, "")
+		if text == "" {
+			r.write(n.Destination)
+		} else {
+			r.inlines(n.Children)
+		}
+		r.end(span)
+	default:
+		r.inlines(n.Children)
+	}
+}
+
+func (r *renderer) styled(style Style, n *Node) {
+	span := r.begin(style, "", "")
+	r.inlines(n.Children)
+	r.end(span)
+}
+
+// linkable reports whether Telegram accepts the URL of a link
+func linkable(url string) bool {
+	scheme, _, ok := strings.Cut(url, ":")
+	if !ok {
+		return false
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "tg", "mailto", "ftp":
+		return true
+	}
+	return false
+}
+
+// tableText lays out a table as text with aligned columns
+func tableText(table *Node) string {
+	var rows [][]string
+	var widths []int
+	for _, row := range table.Children {
+		var cells []string
+		for c, cell := range row.Children {
+			text := strings.ReplaceAll(cell.PlainText(), "\n", " ")
+			cells = append(cells, text)
+			if c >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[c] = max(widths[c], utf8.RuneCountInString(text))
+		}
+		rows = append(rows, cells)
+	}
+
+	pad := func(text string, c int) string {
+		gap := widths[c] - utf8.RuneCountInString(text)
+		align := AlignNone
+		if c < len(table.Align) {
+			align = table.Align[c]
+		}
+		switch align {
+		case AlignRight:
+			return strings.Repeat(" ", gap) + text
+		case AlignCenter:
+			return strings.Repeat(" ", gap/2) + text + strings.Repeat(" ", gap-gap/2)
+		default:
+			return text + strings.Repeat(" ", gap)
+		}
+	}
+
+	var b strings.Builder
+	for i, cells := range rows {
+		for c, text := range cells {
+			if c > 0 {
+				b.WriteString(" | ")
+			}
+			b.WriteString(pad(text, c))
+		}
+		b.WriteString("\n")
+		if i == 0 {
+			for c, w := range widths {
+				if c > 0 {
+					b.WriteString("-+-")
+				}
+				b.WriteString(strings.Repeat("-", w))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	// lines do not end with the padding of the last column
+	lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// event is a span starting or ending at a position of the text
+type event struct {
+	pos   int
+	span  int
+	start bool
+}
+
+// events orders the starts and ends of the spans, at the same position
+// inner spans end first and outer spans start first
+func (f *Formatted) events() []event {
+	var events []event
+	for i, s := range f.Spans {
+		events = append(events, event{pos: s.Offset, span: i, start: true}, event{pos: s.Offset + s.Length, span: i})
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		ea, eb := events[a], events[b]
+		if ea.pos != eb.pos {
+			return ea.pos < eb.pos
+		}
+		if ea.start != eb.start {
+			return !ea.start
+		}
+		if ea.start {
+			return ea.span < eb.span
+		}
+		return ea.span > eb.span
+	})
+
+	return events
+}
+
+// MarkdownV2 serializes the text for the MarkdownV2 parse mode
+func (f *Formatted) MarkdownV2() string {
+	var b strings.Builder
+	var inCode, inQuote bool
+	pos := 0
+
+	text := func(s string) {
+		for _, r := range s {
+			switch {
+			case inCode:
+				if r == '`' || r == '\\' {
+					b.WriteByte('\\')
+				}
+			case strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", r):
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+			if r == '\n' && inQuote {
+				b.WriteByte('>')
+			}
+		}
+	}
+	marker := func(m string) {
+		// ___ reads as underline, a zero-width \r separates two italic markers
+		if m == "_" && strings.HasSuffix(b.String(), "_") && !strings.HasSuffix(b.String(), `\_`) {
+			b.WriteByte('\r')
+		}
+		b.WriteString(m)
+	}
+
+	for _, e := range f.events() {
+		text(f.Text[pos:e.pos])
+		pos = e.pos
+		s := f.Spans[e.span]
+		switch s.Style {
+		case Bold:
+			marker("*")
+		case Italic:
+			marker("_")
+		case Strike:
+			marker("~")
+		case Hidden:
+			marker("||")
+		case Monospace:
+			marker("`")
+			inCode = e.start
+		case Preformatted:
+			if e.start {
+				b.WriteString("```" + codeLanguage(s.Language) + "\n")
+			} else {
+				b.WriteString("\n```")
+			}
+			inCode = e.start
+		case TextLink:
+			if e.start {
+				b.WriteString("[")
+			} else {
+				url := strings.NewReplacer(`\`, `\\`, `)`, `\)`).Replace(s.URL)
+				b.WriteString("](" + url + ")")
+			}
+		case Quote:
+			if e.start {
+				b.WriteString(">")
+			}
+			inQuote = e.start
+		}
+	}
+	text(f.Text[pos:])
+
+	return b.String()
+}
+
+// HTML serializes the text for the HTML parse mode
+func (f *Formatted) HTML() string {
+	var b strings.Builder
+	pos := 0
+	for _, e := range f.events() {
+		b.WriteString(html.EscapeString(f.Text[pos:e.pos]))
+		pos = e.pos
+		s := f.Spans[e.span]
+		tag := ""
+		switch s.Style {
+		case Bold:
+			tag = "b"
+		case Italic:
+			tag = "i"
+		case Strike:
+			tag = "s"
+		case Hidden:
+			tag = "tg-spoiler"
+		case Monospace:
+			tag = "code"
+		case Preformatted:
+			if !e.start {
+				b.WriteString("</code></pre>")
+			} else if lang := codeLanguage(s.Language); lang != "" {
+				b.WriteString(`<pre><code class="language-` + lang + `">`)
+			} else {
+				b.WriteString("<pre><code>")
+			}
+			continue
+		case TextLink:
+			if e.start {
+				b.WriteString(`<a href="` + html.EscapeString(s.URL) + `">`)
+			} else {
+				b.WriteString("</a>")
+			}
+			continue
+		case Quote:
+			tag = "blockquote"
+		}
+		if e.start {
+			b.WriteString("<" + tag + ">")
+		} else {
+			b.WriteString("</" + tag + ">")
+		}
+	}
+	b.WriteString(html.EscapeString(f.Text[pos:]))
+
+	return b.String()
+}
+
+// codeLanguage keeps the characters Telegram accepts in a language name
+func codeLanguage(lang string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("+#_.-", r) {
+			return r
+		}
+		return -1
+	}, lang)
+}
+
+// Append adds text to the end, formatted with the style unless it is zero
+func (f *Formatted) Append(text string, style Style) {
+	if style != 0 && strings.TrimSpace(text) != "" {
+		f.Spans = append(f.Spans, Span{Style: style, Offset: len(f.Text), Length: len(text)})
+	}
+	f.Text += text
+}
+
+// AppendLink adds text linking to the URL, plain text when the URL is not
+// one Telegram accepts
+func (f *Formatted) AppendLink(text, url string) {
+	if linkable(url) && strings.TrimSpace(text) != "" {
+		f.Spans = append(f.Spans, Span{Style: TextLink, Offset: len(f.Text), Length: len(text), URL: url})
+	}
+	f.Text += text
+}
+
+// Format parses Markdown and lays it out for Telegram
+func Format(src string) *Formatted {
+	return Render(Parse(src))
+}
+
+// ToMarkdownV2 converts Markdown to Telegram MarkdownV2
+func ToMarkdownV2(src string) string {
+	return Format(src).MarkdownV2()
+}
+
+// ToHTML converts Markdown to Telegram HTML
+func ToHTML(src string) string {
+	return Format(src).HTML()
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tectiv3/anthropic-go"
+)
+
+const mcpProtocolVersion = "2025-06-18"
+
+// maxToolName is the longest tool name the API accepts
+const maxToolName = 64
+
+var (
+	errMCPClosed      = errors.New("mcp connection closed")
+	mcpToolNameSanity = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// jsonrpcMessage is a JSON-RPC 2.0 request, notification or response
+type jsonrpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+// mcpTransport carries JSON-RPC messages to an MCP server
+type mcpTransport interface {
+	// call sends a request and waits for the response with the same ID
+	call(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error)
+	// notify sends a message that expects no response
+	notify(ctx context.Context, msg *jsonrpcMessage) error
+	Close() error
+}
+
+// MCPClient talks to a single MCP server over stdio or streamable HTTP.
+// A server that exits or drops the connection is connected again on the
+// next request.
+type MCPClient struct {
+	conf   MCPServerConfig
+	nextID atomic.Int64
+
+	mu        sync.Mutex
+	transport mcpTransport
+}
+
+// mcpToolInfo is a tool as described by tools/list
+type mcpToolInfo struct {
+	Name        string         `json:"name"`
+	Title       string         `json:"title,omitempty"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+// NewMCPClient connects to the configured server and performs the initialize handshake
+func NewMCPClient(ctx context.Context, conf MCPServerConfig) (*MCPClient, error) {
+	client := &MCPClient{conf: conf}
+	transport, err := client.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client.transport = transport
+
+	return client, nil
+}
+
+// connect starts a transport to the server and performs the initialize handshake
+func (c *MCPClient) connect(ctx context.Context) (mcpTransport, error) {
+	conf := c.conf
+	var transport mcpTransport
+	var err error
+	switch {
+	case conf.Command != "":
+		transport, err = newMCPStdioTransport(conf)
+	case conf.URL != "":
+		transport = newMCPHTTPTransport(conf)
+	default:
+		err = fmt.Errorf("mcp server %s: either command or url is required", conf.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "chatgpt-bot", "version": Version},
+	}
+	var result struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+	if err := c.send(ctx, transport, "initialize", params, &result); err != nil {
+		_ = transport.Close()
+		return nil, fmt.Errorf("mcp server %s: initialize: %w", conf.Name, err)
+	}
+	if t, ok := transport.(*mcpHTTPTransport); ok {
+		t.setProtocolVersion(result.ProtocolVersion)
+	}
+
+	if err := transport.notify(ctx, &jsonrpcMessage{JSONRPC: "2.0", Method: "notifications/initialized"}); err != nil {
+		_ = transport.Close()
+		return nil, fmt.Errorf("mcp server %s: initialized: %w", conf.Name, err)
+	}
+
+	Log.WithField("mcp", conf.Name).
+		WithField("server", result.ServerInfo.Name).
+		WithField("protocol", result.ProtocolVersion).
+		Info("MCP server connected")
+
+	return transport, nil
+}
+
+// request sends a JSON-RPC request and decodes its result into out. When the
+// connection is closed the server is connected again and the request retried
+// once.
+func (c *MCPClient) request(ctx context.Context, method string, params any, out any) error {
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+	if transport == nil {
+		return errMCPClosed
+	}
+
+	err := c.send(ctx, transport, method, params, out)
+	if !errors.Is(err, errMCPClosed) {
+		return err
+	}
+
+	Log.WithField("mcp", c.conf.Name).Warn("MCP server connection lost, reconnecting")
+	if transport, err = c.reconnect(ctx, transport); err != nil {
+		return fmt.Errorf("mcp server %s: reconnect: %w", c.conf.Name, err)
+	}
+
+	return c.send(ctx, transport, method, params, out)
+}
+
+// reconnect replaces a closed transport, unless another request has done so
+func (c *MCPClient) reconnect(ctx context.Context, closed mcpTransport) (mcpTransport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport == nil {
+		return nil, errMCPClosed
+	}
+	if c.transport != closed {
+		return c.transport, nil
+	}
+	_ = closed.Close()
+
+	transport, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.transport = transport
+
+	return transport, nil
+}
+
+// send sends a JSON-RPC request over the transport and decodes its result into out
+func (c *MCPClient) send(ctx context.Context, transport mcpTransport, method string, params any, out any) error {
+	id := c.nextID.Add(1)
+	resp, err := transport.call(ctx, &jsonrpcMessage{
+		JSONRPC: "2.0",
+		ID:      &id,
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, out)
+}
+
+// ListTools returns every tool the server offers, following pagination
+func (c *MCPClient) ListTools(ctx context.Context) ([]mcpToolInfo, error) {
+	var tools []mcpToolInfo
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var result struct {
+			Tools      []mcpToolInfo `json:"tools"`
+			NextCursor string        `json:"nextCursor,omitempty"`
+		}
+		if err := c.request(ctx, "tools/list", params, &result); err != nil {
+			return nil, err
+		}
+		tools = append(tools, result.Tools...)
+		if result.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+// CallTool runs a tool on the server and returns its text content.
+// Tool-level failures reported by the server are returned as errors.
+func (c *MCPClient) CallTool(ctx context.Context, name string, input json.RawMessage) (string, error) {
+	args := map[string]any{}
+	if len(input) > 0 {
+		if err := json.Unmarshal(input, &args); err != nil {
+			return "", fmt.Errorf("failed to parse arguments: %w", err)
+		}
+	}
+
+	var result struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text,omitempty"`
+			MimeType string `json:"mimeType,omitempty"`
+			URI      string `json:"uri,omitempty"`
+			Resource *struct {
+				URI  string `json:"uri"`
+				Text string `json:"text,omitempty"`
+			} `json:"resource,omitempty"`
+		} `json:"content"`
+		StructuredContent json.RawMessage `json:"structuredContent,omitempty"`
+		IsError           bool            `json:"isError,omitempty"`
+	}
+	if err := c.request(ctx, "tools/call", map[string]any{"name": name, "arguments": args}, &result); err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, content := range result.Content {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+		case "resource":
+			if content.Resource != nil && content.Resource.Text != "" {
+				parts = append(parts, content.Resource.Text)
+			} else if content.Resource != nil {
+				parts = append(parts, fmt.Sprintf("[resource: %s]", content.Resource.URI))
+			}
+		case "resource_link":
+			parts = append(parts, fmt.Sprintf("[resource: %s]", content.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s: %s]", content.Type, content.MimeType))
+		}
+	}
+	if len(parts) == 0 && len(result.StructuredContent) > 0 {
+		parts = append(parts, string(result.StructuredContent))
+	}
+
+	text := strings.Join(parts, "\n")
+	if result.IsError {
+		return "", errors.New(text)
+	}
+
+	return text, nil
+}
+
+// Close stops the server, later requests fail
+func (c *MCPClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transport == nil {
+		return nil
+	}
+	err := c.transport.Close()
+	c.transport = nil
+
+	return err
+}
+
+// MCPTool exposes a tool of an MCP server as an anthropic.ToolInterface
+type MCPTool struct {
+	name        string
+	remoteName  string
+	description string
+	inputSchema map[string]any
+}
+
+func (t *MCPTool) Name() string        { return t.name }
+func (t *MCPTool) Description() string { return t.description }
+
+// Schema converts the server's JSON schema on a best-effort basis;
+// the Anthropic request uses the original schema via ToolConfiguration.
+func (t *MCPTool) Schema() *anthropic.Schema {
+	schema := &anthropic.Schema{Type: anthropic.Object, Properties: map[string]*anthropic.Property{}}
+	if data, err := json.Marshal(t.inputSchema); err == nil {
+		_ = json.Unmarshal(data, schema)
+	}
+	if schema.Properties == nil {
+		schema.Properties = map[string]*anthropic.Property{}
+	}
+
+	return schema
+}
+
+// ToolConfiguration passes the input schema through unchanged, keeping
+// JSON schema features the anthropic.Schema type can't express
+func (t *MCPTool) ToolConfiguration(providerName string) map[string]any {
+	schema := t.inputSchema
+	if schema == nil {
+		schema = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+
+	return map[string]any{
+		"name":         t.name,
+		"description":  t.description,
+		"input_schema": schema,
+	}
+}
+
+// mcpToolName namespaces a server tool name so tools of different
+// servers don't collide, within the API's name constraints. Long names are
+// cut and end with a hash of the full name, so they stay distinct.
+func mcpToolName(server, tool string) string {
+	name := mcpToolNameSanity.ReplaceAllString(server+"_"+tool, "_")
+	if len(name) > maxToolName {
+		hash := fnv.New32a()
+		hash.Write([]byte(server + "_" + tool))
+		name = fmt.Sprintf("%s_%08x", name[:maxToolName-9], hash.Sum32())
+	}
+
+	return name
+}
+
+// closeMCPClients stops the MCP servers
+func (s *Server) closeMCPClients() {
+	s.Lock()
+	clients := s.mcpClients
+	s.mcpClients = nil
+	s.Unlock()
+
+	for _, client := range clients {
+		if err := client.Close(); err != nil {
+			Log.WithField("mcp", client.conf.Name).Debug("MCP server closed: ", err)
+		}
+	}
+}
+
+// registerMCPTools connects to the configured MCP servers and registers
+// their tools. Servers that fail to start are logged and skipped.
+func (s *Server) registerMCPTools() {
+	for _, conf := range s.conf.MCPServers {
+		logger := Log.WithField("mcp", conf.Name)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		client, err := NewMCPClient(ctx, conf)
+		if err != nil {
+			cancel()
+			logger.WithField("error", err).Warn("Failed to connect to MCP server")
+			continue
+		}
+
+		tools, err := client.ListTools(ctx)
+		cancel()
+		if err != nil {
+			logger.WithField("error", err).Warn("Failed to list MCP tools")
+			_ = client.Close()
+			continue
+		}
+
+		for _, info := range tools {
+			remoteName := info.Name
+			displayName := info.Title
+			if displayName == "" {
+				displayName = info.Name
+			}
+
+			s.tools.Register(&Tool{
+				Definition: &MCPTool{
+					name:        mcpToolName(conf.Name, info.Name),
+					remoteName:  remoteName,
+					description: info.Description,
+					inputSchema: info.InputSchema,
+				},
+				EnableKey:   mcpToolName(conf.Name, info.Name),
+				DisplayName: displayName,
+				Icon:        "fas fa-plug",
+				Default:     conf.Default,
+				Execute: func(ctx context.Context, input json.RawMessage) (string, error) {
+					return client.CallTool(ctx, remoteName, input)
+				},
+			})
+		}
+		logger.WithField("tools", len(tools)).Info("MCP tools registered")
+
+		s.Lock()
+		s.mcpClients = append(s.mcpClients, client)
+		s.Unlock()
+	}
+}
+
+// mcpStdioTransport runs the MCP server as a subprocess and exchanges
+// newline-delimited JSON-RPC messages over its stdin and stdout
+type mcpStdioTransport struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[int64]chan *jsonrpcMessage
+	done    chan struct{}
+	closing atomic.Bool
+}
+
+func newMCPStdioTransport(conf MCPServerConfig) (*mcpStdioTransport, error) {
+	cmd := exec.Command(conf.Command, conf.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range conf.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", conf.Command, err)
+	}
+
+	t := &mcpStdioTransport{
+		name:    conf.Name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan *jsonrpcMessage),
+		done:    make(chan struct{}),
+	}
+	go t.readLoop(stdout)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			Log.WithField("mcp", conf.Name).Debug(scanner.Text())
+		}
+	}()
+
+	return t, nil
+}
+
+func (t *mcpStdioTransport) readLoop(stdout io.Reader) {
+	defer close(t.done)
+
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg jsonrpcMessage
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				Log.WithField("mcp", t.name).Warn("Invalid message from MCP server: ", jsonErr)
+			} else {
+				t.dispatch(&msg)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				Log.WithField("mcp", t.name).Warn("MCP server read error: ", err)
+			} else if !t.closing.Load() {
+				Log.WithField("mcp", t.name).Warn("MCP server exited")
+			}
+			return
+		}
+	}
+}
+
+func (t *mcpStdioTransport) dispatch(msg *jsonrpcMessage) {
+	if msg.Method != "" {
+		// Requests from the server; we offer no client capabilities besides ping
+		if msg.ID != nil {
+			reply := &jsonrpcMessage{JSONRPC: "2.0", ID: msg.ID}
+			if msg.Method == "ping" {
+				reply.Result = json.RawMessage("{}")
+			} else {
+				reply.Error = &jsonrpcError{Code: -32601, Message: "method not found"}
+			}
+			_ = t.write(reply)
+		}
+		return
+	}
+	if msg.ID == nil {
+		return
+	}
+
+	t.mu.Lock()
+	ch, ok := t.pending[*msg.ID]
+	delete(t.pending, *msg.ID)
+	t.mu.Unlock()
+	if ok {
+		ch <- msg
+	}
+}
+
+func (t *mcpStdioTransport) write(msg *jsonrpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.stdin.Write(append(data, '\n'))
+
+	return err
+}
+
+func (t *mcpStdioTransport) call(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error) {
+	ch := make(chan *jsonrpcMessage, 1)
+	t.mu.Lock()
+	t.pending[*req.ID] = ch
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, *req.ID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(req); err != nil {
+		// the server has exited when its input is gone
+		return nil, fmt.Errorf("%w: %v", errMCPClosed, err)
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-t.done:
+		return nil, errMCPClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *mcpStdioTransport) notify(ctx context.Context, msg *jsonrpcMessage) error {
+	return t.write(msg)
+}
+
+func (t *mcpStdioTransport) Close() error {
+	t.closing.Store(true)
+	_ = t.stdin.Close()
+
+	select {
+	case <-t.done:
+	case <-time.After(5 * time.Second):
+		_ = t.cmd.Process.Kill()
+	}
+
+	return t.cmd.Wait()
+}
+
+// mcpHTTPTransport implements the streamable HTTP transport: every message
+// is POSTed to the endpoint, which answers with JSON or an SSE stream
+type mcpHTTPTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu              sync.Mutex
+	sessionID       string
+	protocolVersion string
+}
+
+func newMCPHTTPTransport(conf MCPServerConfig) *mcpHTTPTransport {
+	return &mcpHTTPTransport{
+		url:     conf.URL,
+		headers: conf.Headers,
+		client:  &http.Client{},
+	}
+}
+
+func (t *mcpHTTPTransport) setProtocolVersion(version string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.protocolVersion = version
+}
+
+func (t *mcpHTTPTransport) newRequest(ctx context.Context, method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	t.mu.Lock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+	if t.protocolVersion != "" {
+		req.Header.Set("MCP-Protocol-Version", t.protocolVersion)
+	}
+	t.mu.Unlock()
+
+	return req, nil
+}
+
+func (t *mcpHTTPTransport) post(ctx context.Context, msg *jsonrpcMessage) (*http.Response, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := t.newRequest(ctx, http.MethodPost, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.mu.Lock()
+		t.sessionID = id
+		t.mu.Unlock()
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("mcp http error (status %d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+func (t *mcpHTTPTransport) call(ctx context.Context, req *jsonrpcMessage) (*jsonrpcMessage, error) {
+	resp, err := t.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		var msg jsonrpcMessage
+		if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("invalid mcp response: %w", err)
+		}
+		return &msg, nil
+	}
+
+	// The stream may carry server notifications before the response
+	reader := bufio.NewReader(resp.Body)
+	var data strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		} else if line == "" && data.Len() > 0 {
+			var msg jsonrpcMessage
+			if jsonErr := json.Unmarshal([]byte(data.String()), &msg); jsonErr == nil &&
+				msg.Method == "" && msg.ID != nil && *msg.ID == *req.ID {
+				return &msg, nil
+			}
+			data.Reset()
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return nil, errMCPClosed
+			}
+			return nil, err
+		}
+	}
+}
+
+func (t *mcpHTTPTransport) notify(ctx context.Context, msg *jsonrpcMessage) error {
+	resp, err := t.post(ctx, msg)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Close ends the session on the server if one was assigned
+func (t *mcpHTTPTransport) Close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := t.newRequest(ctx, http.MethodDelete, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMCPServerEnv makes the test binary run as the MCP server, see TestMain
+const testMCPServerEnv = "TEST_MCP_SERVER"
+
+// runTestMCPServer serves three tools over stdio: echo returns its text,
+// fail reports a tool error and exit stops the server without answering
+func runTestMCPServer(in io.Reader, out io.Writer) {
+	encoder := json.NewEncoder(out)
+	reply := func(id *int64, result any) {
+		data, _ := json.Marshal(result)
+		_ = encoder.Encode(jsonrpcMessage{JSONRPC: "2.0", ID: id, Result: data})
+	}
+	fail := func(id *int64, code int, message string) {
+		_ = encoder.Encode(jsonrpcMessage{JSONRPC: "2.0", ID: id, Error: &jsonrpcError{Code: code, Message: message}})
+	}
+	text := func(text string, isError bool) map[string]any {
+		return map[string]any{
+			"content": []map[string]any{{"type": "text", "text": text}},
+			"isError": isError,
+		}
+	}
+	tool := func(name string) map[string]any {
+		return map[string]any{
+			"name":        name,
+			"inputSchema": map[string]any{"type": "object"},
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var msg struct {
+			ID     *int64 `json:"id"`
+			Method string `json:"method"`
+			Params struct {
+				Cursor    string            `json:"cursor"`
+				Name      string            `json:"name"`
+				Arguments map[string]string `json:"arguments"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || msg.ID == nil {
+			continue
+		}
+
+		switch msg.Method {
+		case "initialize":
+			reply(msg.ID, map[string]any{
+				"protocolVersion": mcpProtocolVersion,
+				"serverInfo":      map[string]any{"name": "test", "version": "1"},
+			})
+		case "tools/list":
+			// the tools come in two pages
+			if msg.Params.Cursor == "" {
+				reply(msg.ID, map[string]any{"tools": []any{tool("echo")}, "nextCursor": "next"})
+			} else {
+				reply(msg.ID, map[string]any{"tools": []any{tool("fail"), tool("exit")}})
+			}
+		case "tools/call":
+			switch msg.Params.Name {
+			case "echo":
+				reply(msg.ID, text(msg.Params.Arguments["text"], false))
+			case "fail":
+				reply(msg.ID, text("boom", true))
+			case "exit":
+				os.Exit(1)
+			default:
+				fail(msg.ID, -32602, "unknown tool")
+			}
+		default:
+			fail(msg.ID, -32601, "method not found")
+		}
+	}
+}
+
+func newTestMCPClient(t *testing.T) *MCPClient {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := NewMCPClient(ctx, MCPServerConfig{
+		Name:    "test",
+		Command: os.Args[0],
+		Env:     map[string]string{testMCPServerEnv: "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func TestMCPStdio(t *testing.T) {
+	client := newTestMCPClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+	if got := strings.Join(names, ","); got != "echo,fail,exit" {
+		t.Errorf("tools = %s, want echo,fail,exit", got)
+	}
+
+	tests := []struct {
+		tool    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{tool: "echo", input: `{"text":"hello"}`, want: "hello"},
+		{tool: "fail", input: `{}`, wantErr: "boom"},
+		{tool: "missing", input: `{}`, wantErr: "unknown tool"},
+		{tool: "echo", input: `not json`, wantErr: "failed to parse arguments"},
+	}
+	for _, tt := range tests {
+		got, err := client.CallTool(ctx, tt.tool, json.RawMessage(tt.input))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s(%s) error = %v, want %q", tt.tool, tt.input, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s(%s) = %q, %v, want %q", tt.tool, tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestMCPStdioReconnect(t *testing.T) {
+	client := newTestMCPClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the server exits again after reconnecting, the call fails
+	if _, err := client.CallTool(ctx, "exit", nil); err == nil {
+		t.Fatal("exit succeeded, want an error")
+	}
+
+	got, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"again"}`))
+	if err != nil || got != "again" {
+		t.Fatalf("echo after exit = %q, %v, want again", got, err)
+	}
+}
+
+func TestMCPClose(t *testing.T) {
+	client := newTestMCPClient(t)
+	transport := client.transport.(*mcpStdioTransport)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if state := transport.cmd.ProcessState; state == nil || !state.Exited() {
+		t.Fatalf("server process state = %v, want exited", state)
+	}
+
+	if _, err := client.CallTool(context.Background(), "echo", nil); err == nil {
+		t.Fatal("call after close succeeded, want an error")
+	}
+}
+
+func TestMCPToolName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+
+	tests := []struct {
+		server string
+		tool   string
+		want   string
+	}{
+		{"files", "read_file", "files_read_file"},
+		{"my.server", "get item", "my_server_get_item"},
+		{"s", long + "_one", "s_" + long[:53] + "_6187344e"},
+	}
+	for _, tt := range tests {
+		if got := mcpToolName(tt.server, tt.tool); got != tt.want {
+			t.Errorf("mcpToolName(%q, %q) = %q, want %q", tt.server, tt.tool, got, tt.want)
+		}
+	}
+
+	one, two := mcpToolName("s", long+"_one"), mcpToolName("s", long+"_two")
+	if one == two {
+		t.Errorf("long names collide: %s", one)
+	}
+	if len(one) != maxToolName || len(two) != maxToolName {
+		t.Errorf("long names are %d and %d bytes, want %d", len(one), len(two), maxToolName)
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,7 +28,9 @@ type config struct {
 
 	// other configurations
 	AllowedTelegramUsers []string `json:"allowed_telegram_users"`
-	Verbose              bool     `json:"verbose,omitempty"`
+	// AllowedTelegramGroups are group chat IDs where everyone may talk to the bot
+	AllowedTelegramGroups []int64 `json:"allowed_telegram_groups,omitempty"`
+	Verbose               bool    `json:"verbose,omitempty"`
 
 	// Mini app configuration
 	MiniAppEnabled bool   `json:"mini_app_enabled"`
@@ -36,6 +38,25 @@ type config struct {
 	MiniAppURL     string `json:"mini_app_url"`
 
 	WhisperEndpoint string `json:"whisper_endpoint"`
+	// STTProvider is the speech to text API at WhisperEndpoint: "generic"
+	// (default) posts the file and reads {"text": ...}, "openai" is any
+	// /v1/audio/transcriptions server with the endpoint including the /v1
+	// prefix, "whispercpp" is the whisper.cpp server
+	STTProvider string `json:"stt_provider,omitempty"`
+	// STTModel and STTAPIKey are used by the "openai" provider
+	STTModel  string `json:"stt_model,omitempty"`
+	STTAPIKey string `json:"stt_api_key,omitempty"`
+	// TTSEndpoint accepts text in a POST body and returns WAV audio (e.g. Piper's HTTP server)
+	TTSEndpoint string `json:"tts_endpoint,omitempty"`
+	// FFmpegPath is used to decode audio and video formats other than Ogg Opus
+	// and WAV, "ffmpeg" from PATH by default
+	FFmpegPath string `json:"ffmpeg_path,omitempty"`
+
+	// MonthlyBudget is the default per-user spend limit in USD, 0 means unlimited
+	MonthlyBudget float64 `json:"monthly_budget,omitempty"`
+
+	// External MCP servers whose tools are offered to the models
+	MCPServers []MCPServerConfig `json:"mcp_servers,omitempty"`
 }
 
 type AiModel struct {
@@ -43,6 +64,35 @@ type AiModel struct {
 	Name      string `json:"name"`
 	Reasoning bool   `json:"reasoning,omitempty"`
 	WebSearch bool   `json:"web_search,omitempty"`
+
+	// ThinkingBudget is the extended thinking budget in tokens for reasoning
+	// models, 0 uses defaultThinkingBudget. Threads can override it.
+	ThinkingBudget int `json:"thinking_budget,omitempty"`
+	// MaxOutputTokens is the most the model can output, thinking included.
+	// 0 uses defaultMaxOutputTokens.
+	MaxOutputTokens int `json:"max_output_tokens,omitempty"`
+
+	// Provider is "anthropic" (default) or "openai" for any OpenAI-compatible
+	// /v1/chat/completions server. BaseURL overrides the API location,
+	// for "openai" it includes the /v1 prefix.
+	Provider string `json:"provider,omitempty"`
+	BaseURL  string `json:"base_url,omitempty"`
+	APIKey   string `json:"api_key,omitempty"`
+
+	Pricing ModelPricing `json:"pricing"`
+}
+
+// MCPServerConfig describes an MCP server. Command starts a stdio server,
+// URL connects to a streamable HTTP server.
+type MCPServerConfig struct {
+	Name    string            `json:"name"`
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Default enables the server's tools for new chats
+	Default bool `json:"default,omitempty"`
 }
 
 type Server struct {
@@ -52,10 +102,18 @@ type Server struct {
 	bot       *tele.Bot
 	db        *gorm.DB
 	webServer *http.Server
+	tools     *ToolRegistry
+
+	mcpClients []*MCPClient
+	// searchEnabled is false when SQLite was built without FTS5
+	searchEnabled bool
 
 	// Rate limiting and connection management for webapp
 	rateLimiter       *RateLimiter
 	connectionManager *ConnectionManager
+
+	// generations are the answers being generated, which /stop cancels
+	generations Generations
 }
 
 // Rate limiting and connection management
@@ -157,6 +215,8 @@ type User struct {
 	Threads    []Chat
 	Roles      []Role
 	State      *State `json:"state,omitempty" gorm:"type:text"`
+	// MonthlyBudget overrides the configured monthly budget when set
+	MonthlyBudget *float64 `gorm:"nullable:true"`
 }
 
 type Role struct {
@@ -195,6 +255,26 @@ type Chat struct {
 	TotalOutputTokens int `json:"total_output_tokens" gorm:"default:0"`
 
 	EnabledTools string `json:"enabled_tools" gorm:"type:text;default:'search'"`
+
+	// ThinkingBudget overrides the model's thinking budget, 0 means model default
+	ThinkingBudget int `json:"thinking_budget" gorm:"default:0"`
+
+	// BranchEdits makes an edit of an older question branch the conversation,
+	// otherwise only edits of the latest question are answered
+	BranchEdits bool `json:"branch_edits"`
+
+	// ActiveLeafID is the last message of the branch in use, NULL for an empty chat
+	ActiveLeafID *uint `json:"active_leaf_id" gorm:"nullable:true"`
+
+	// ActiveThreadID is the thread a Telegram chat talks in, picked with
+	// /threads or /new. NULL for the chat's own history.
+	ActiveThreadID *string `json:"active_thread_id,omitempty" gorm:"nullable:true"`
+	// TelegramChatID and TopicID link a thread to a forum topic
+	TelegramChatID *int64 `json:"telegram_chat_id,omitempty" gorm:"index;nullable:true"`
+	TopicID        *int   `json:"topic_id,omitempty" gorm:"nullable:true"`
+	// SenderID is the user a group message came from, charged for the
+	// answer instead of the chat's owner. Not stored.
+	SenderID uint `json:"-" gorm:"-"`
 }
 
 type ChatMessage struct {
@@ -202,6 +282,21 @@ type ChatMessage struct {
 	CreatedAt time.Time `gorm:"index"`
 	UpdatedAt time.Time
 	ChatID    int64 `sql:"chat_id" json:"chat_id" gorm:"index"`
+	// ChatRecordID is the ID of the chat the message belongs to. ChatID is
+	// the record ID of a Telegram chat but the ChatID of a thread, and the
+	// two can be equal. NULL for older messages that could be either.
+	ChatRecordID *uint `json:"-" gorm:"index;nullable"`
+	// ParentID is the message this one follows, NULL for the first message.
+	// Siblings are alternative branches created by edits and regenerations.
+	ParentID *uint `json:"parent_id,omitempty" gorm:"index;nullable"`
+	// TelegramMessageID links a message to the Telegram message it came from or
+	// was sent as, for edits of questions and replies to answers
+	TelegramMessageID *int `json:"telegram_message_id,omitempty" gorm:"index;nullable"`
+	// TelegramMessageIDs are all messages a long answer was sent as, in order,
+	// TelegramMessageID is the last of them
+	TelegramMessageIDs MessageIDs `json:"-" gorm:"type:json"`
+	// SenderName is who wrote a user message in a group chat, NULL in private chats
+	SenderName *string `json:"sender_name,omitempty" gorm:"nullable"`
 
 	Role       string  `json:"role"`
 	ToolCallID *string `json:"tool_call_id,omitempty"`
@@ -223,6 +318,15 @@ type ChatMessage struct {
 	Citations Citations `json:"citations,omitempty" gorm:"type:json"`
 
 	ToolCalls ToolCalls `json:"tool_calls,omitempty" gorm:"type:text"`
+
+	// Thinking blocks are replayed with the tool calls of the same message
+	Thinking ThinkingBlocks `json:"thinking,omitempty" gorm:"type:json"`
+}
+
+// Migration records a data migration that has been applied, so it runs once
+type Migration struct {
+	Name      string `gorm:"primarykey;size:100"`
+	CreatedAt time.Time
 }
 
 type Citation struct {
@@ -257,6 +361,76 @@ func (c *Citations) Scan(value interface{}) error {
 	return json.Unmarshal(b, &c)
 }
 
+// MessageIDs are the IDs of Telegram messages
+type MessageIDs []int
+
+// Value implements the driver.Valuer interface for database storage
+func (m MessageIDs) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(m)
+}
+
+// Scan implements the sql.Scanner interface for database retrieval
+func (m *MessageIDs) Scan(value interface{}) error {
+	if value == nil {
+		*m = nil
+		return nil
+	}
+
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &m)
+}
+
+// ThinkingBlock is an extended thinking block with the signature the API
+// needs to verify it when the block is sent back
+type ThinkingBlock struct {
+	Thinking  string `json:"thinking"`
+	Signature string `json:"signature"`
+}
+
+type ThinkingBlocks []ThinkingBlock
+
+// Text joins the thinking of all blocks
+func (t ThinkingBlocks) Text() string {
+	parts := make([]string, len(t))
+	for i, block := range t {
+		parts[i] = block.Thinking
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+// Value implements the driver.Valuer interface for database storage
+func (t ThinkingBlocks) Value() (driver.Value, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(t)
+}
+
+// Scan implements the sql.Scanner interface for database retrieval
+func (t *ThinkingBlocks) Scan(value interface{}) error {
+	if value == nil {
+		*t = nil
+		return nil
+	}
+
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &t)
+}
+
 // ToolCalls is a custom type that will allow us to implement
 // the driver.Valuer and sql.Scanner interfaces on a slice of ToolCall.
 type ToolCalls []ToolCall
@@ -298,34 +472,15 @@ func (tc *ToolCalls) Scan(value interface{}) error {
 	return json.Unmarshal(b, &tc)
 }
 
-// WAV writer struct
-type wavWriter struct {
-	w io.Writer
-}
-
-// WAV file header struct
-type wavHeader struct {
-	RIFFID        [4]byte // RIFF header
-	FileSize      uint32  // file size - 8
-	WAVEID        [4]byte // WAVE header
-	FMTID         [4]byte // fmt header
-	Subchunk1Size uint32  // size of the fmt chunk
-	AudioFormat   uint16  // audio format code
-	NumChannels   uint16  // number of channels
-	SampleRate    uint32  // sample rate
-	ByteRate      uint32  // bytes per second
-	BlockAlign    uint16  // block align
-	BitsPerSample uint16  // bits per sample
-	DataID        [4]byte // data header
-	Subchunk2Size uint32  // size of the data chunk
-}
-
 // RestrictConfig defines config for Restrict middleware.
 type RestrictConfig struct {
 	// Chats is a list of chats that are going to be affected
 	// by either In or Out function.
 	Usernames []string
 
+	// Chats are chat IDs whose updates are handled by In regardless of the sender.
+	Chats []int64
+
 	// In defines a function that will be called if the chat
 	// of an update will be found in the Chats list.
 	In tele.HandlerFunc
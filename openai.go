@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tectiv3/anthropic-go"
+)
+
+// OpenAIProvider calls an OpenAI-compatible /v1/chat/completions endpoint,
+// e.g. llama.cpp server, vLLM or Ollama. baseURL includes the /v1 prefix.
+type OpenAIProvider struct {
+	baseURL string
+	apiKey  string
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    any              `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIToolFunction `json:"function"`
+}
+
+type openAIToolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters"`
+}
+
+type openAIRequest struct {
+	Model         string          `json:"model"`
+	Messages      []openAIMessage `json:"messages"`
+	MaxTokens     int             `json:"max_tokens,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	Tools         []openAITool    `json:"tools,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details,omitempty"`
+}
+
+type openAIResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      openAIResponseMessage `json:"message"`
+		Delta        openAIResponseMessage `json:"delta"`
+		FinishReason *string               `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage,omitempty"`
+}
+
+type openAIResponseMessage struct {
+	Content   string           `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+func (p *OpenAIProvider) Name() string { return providerOpenAI }
+
+func (p *OpenAIProvider) Stream(ctx context.Context, req *ProviderRequest) (EventStream, error) {
+	body := p.buildRequest(req)
+	body.Stream = true
+	body.StreamOptions = &struct {
+		IncludeUsage bool `json:"include_usage"`
+	}{IncludeUsage: true}
+
+	resp, err := p.post(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openAIStream{body: resp.Body, reader: bufio.NewReader(resp.Body), model: req.Model, tools: map[int]int{}, textBlock: -1}, nil
+}
+
+func (p *OpenAIProvider) Generate(ctx context.Context, req *ProviderRequest) (*anthropic.Response, error) {
+	resp, err := p.post(ctx, p.buildRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if len(result.Choices) == 0 {
+		return nil, fmt.Errorf("empty response from %s", p.baseURL)
+	}
+
+	choice := result.Choices[0]
+	response := &anthropic.Response{
+		ID:    result.ID,
+		Model: result.Model,
+		Role:  "assistant",
+		Type:  "message",
+	}
+	if choice.Message.Content != "" {
+		response.Content = append(response.Content, anthropic.NewTextContent(choice.Message.Content))
+	}
+	for _, tc := range choice.Message.ToolCalls {
+		response.Content = append(response.Content, &anthropic.ToolUseContent{
+			ID:    tc.ID,
+			Name:  tc.Function.Name,
+			Input: json.RawMessage(tc.Function.Arguments),
+		})
+	}
+	if choice.FinishReason != nil {
+		response.StopReason = openAIStopReason(*choice.FinishReason)
+	}
+	if result.Usage != nil {
+		response.Usage = result.Usage.anthropic()
+	}
+
+	return response, nil
+}
+
+func (p *OpenAIProvider) post(ctx context.Context, body *openAIRequest) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.baseURL, "/")+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var parsed struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(raw, &parsed) == nil && parsed.Error.Message != "" {
+			return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, parsed.Error.Message)
+		}
+		return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+
+	return resp, nil
+}
+
+// buildRequest converts the Anthropic-style request into the chat completions format
+func (p *OpenAIProvider) buildRequest(req *ProviderRequest) *openAIRequest {
+	body := &openAIRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+	}
+
+	if req.System != "" {
+		body.Messages = append(body.Messages, openAIMessage{Role: "system", Content: req.System})
+	}
+	for _, msg := range req.Messages {
+		body.Messages = append(body.Messages, openAIMessages(msg)...)
+	}
+
+	for _, tool := range req.Tools {
+		var parameters any = tool.Schema()
+		if configurable, ok := tool.(anthropic.ToolConfiguration); ok {
+			config := configurable.ToolConfiguration(providerOpenAI)
+			if config != nil {
+				// Provider-executed tools like Anthropic web search can't run here
+				schema, ok := config["input_schema"]
+				if !ok {
+					continue
+				}
+				parameters = schema
+			}
+		}
+		body.Tools = append(body.Tools, openAITool{
+			Type: "function",
+			Function: openAIToolFunction{
+				Name:        tool.Name(),
+				Description: tool.Description(),
+				Parameters:  parameters,
+			},
+		})
+	}
+
+	return body
+}
+
+// openAIMessages converts one Anthropic message. Tool results become
+// separate "tool" role messages, which must directly follow the assistant
+// message that made the calls.
+func openAIMessages(msg *anthropic.Message) []openAIMessage {
+	var messages []openAIMessage
+	var parts []openAIContentPart
+	var toolCalls []openAIToolCall
+
+	for _, content := range msg.Content {
+		switch c := content.(type) {
+		case *anthropic.TextContent:
+			parts = append(parts, openAIContentPart{Type: "text", Text: c.Text})
+		case *anthropic.ImageContent:
+			if c.Source != nil && c.Source.Type == anthropic.ContentSourceTypeBase64 {
+				parts = append(parts, openAIContentPart{
+					Type:     "image_url",
+					ImageURL: &openAIImageURL{URL: "data:" + c.Source.MediaType + ";base64," + c.Source.Data},
+				})
+			} else if c.Source != nil && c.Source.Type == anthropic.ContentSourceTypeURL {
+				parts = append(parts, openAIContentPart{Type: "image_url", ImageURL: &openAIImageURL{URL: c.Source.URL}})
+			}
+		case *anthropic.DocumentContent:
+			parts = append(parts, openAIContentPart{Type: "text", Text: "[Attached document is not supported by this model]"})
+		case *anthropic.ToolUseContent:
+			call := openAIToolCall{ID: c.ID, Type: "function"}
+			call.Function.Name = c.Name
+			call.Function.Arguments = string(c.Input)
+			if call.Function.Arguments == "" {
+				call.Function.Arguments = "{}"
+			}
+			toolCalls = append(toolCalls, call)
+		case *anthropic.ToolResultContent:
+			result, ok := c.Content.(string)
+			if !ok {
+				data, _ := json.Marshal(c.Content)
+				result = string(data)
+			}
+			messages = append(messages, openAIMessage{Role: "tool", ToolCallID: c.ToolUseID, Content: result})
+		}
+	}
+
+	if len(parts) == 0 && len(toolCalls) == 0 {
+		return messages
+	}
+
+	out := openAIMessage{Role: string(msg.Role), ToolCalls: toolCalls}
+	if msg.Role == "assistant" || (len(parts) == 1 && parts[0].Type == "text") {
+		var text strings.Builder
+		for _, part := range parts {
+			text.WriteString(part.Text)
+		}
+		out.Content = text.String()
+	} else {
+		out.Content = parts
+	}
+
+	return append(messages, out)
+}
+
+func openAIStopReason(reason string) string {
+	switch reason {
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+func (u *openAIUsage) anthropic() anthropic.Usage {
+	usage := anthropic.Usage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+	}
+	if u.PromptTokensDetails != nil {
+		usage.CacheReadInputTokens = u.PromptTokensDetails.CachedTokens
+		usage.InputTokens -= u.PromptTokensDetails.CachedTokens
+	}
+
+	return usage
+}
+
+// openAIStream translates chat completion chunks into Anthropic stream
+// events, so anthropic.ResponseAccumulator can assemble the response
+type openAIStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	model  string
+
+	queue   []*anthropic.Event
+	current *anthropic.Event
+	err     error
+	done    bool
+
+	started      bool
+	nextBlock    int
+	textBlock    int
+	tools        map[int]int // chunk tool call index -> content block index
+	openBlocks   []int
+	finishReason string
+	usage        *openAIUsage
+}
+
+func (s *openAIStream) Next() bool {
+	for len(s.queue) == 0 {
+		if s.done || s.err != nil {
+			return false
+		}
+		s.readChunk()
+	}
+
+	s.current = s.queue[0]
+	s.queue = s.queue[1:]
+	return true
+}
+
+func (s *openAIStream) Event() *anthropic.Event {
+	return s.current
+}
+
+func (s *openAIStream) Close() error {
+	return s.body.Close()
+}
+
+func (s *openAIStream) Err() error {
+	return s.err
+}
+
+func (s *openAIStream) emit(event *anthropic.Event) {
+	s.queue = append(s.queue, event)
+}
+
+func (s *openAIStream) startBlock(block *anthropic.EventContentBlock) int {
+	index := s.nextBlock
+	s.nextBlock++
+	s.openBlocks = append(s.openBlocks, index)
+	s.emit(&anthropic.Event{Type: anthropic.EventTypeContentBlockStart, Index: &index, ContentBlock: block})
+
+	return index
+}
+
+// readChunk reads SSE lines until one chunk has been translated
+func (s *openAIStream) readChunk() {
+	line, err := s.reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			// Some servers close the stream without [DONE]
+			if s.finishReason != "" {
+				s.finish()
+				return
+			}
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = err
+		return
+	}
+
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "data:") {
+		return
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "[DONE]" {
+		s.finish()
+		return
+	}
+
+	var chunk openAIResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		s.err = fmt.Errorf("invalid stream chunk: %w", err)
+		return
+	}
+
+	if !s.started {
+		s.started = true
+		s.emit(&anthropic.Event{
+			Type:    anthropic.EventTypeMessageStart,
+			Message: &anthropic.Response{ID: chunk.ID, Model: s.model, Role: "assistant", Type: "message"},
+		})
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return
+	}
+
+	choice := chunk.Choices[0]
+	if choice.Delta.Content != "" {
+		if s.textBlock < 0 {
+			s.textBlock = s.startBlock(&anthropic.EventContentBlock{Type: anthropic.ContentTypeText})
+		}
+		index := s.textBlock
+		s.emit(&anthropic.Event{
+			Type:  anthropic.EventTypeContentBlockDelta,
+			Index: &index,
+			Delta: &anthropic.EventDelta{Type: anthropic.EventDeltaTypeText, Text: choice.Delta.Content},
+		})
+	}
+
+	for i, tc := range choice.Delta.ToolCalls {
+		callIndex := i
+		if tc.Index != nil {
+			callIndex = *tc.Index
+		}
+		index, ok := s.tools[callIndex]
+		if !ok {
+			// Text after a tool call starts a new block
+			s.textBlock = -1
+			index = s.startBlock(&anthropic.EventContentBlock{
+				Type: anthropic.ContentTypeToolUse,
+				ID:   tc.ID,
+				Name: tc.Function.Name,
+			})
+			s.tools[callIndex] = index
+		}
+		if tc.Function.Arguments != "" {
+			blockIndex := index
+			s.emit(&anthropic.Event{
+				Type:  anthropic.EventTypeContentBlockDelta,
+				Index: &blockIndex,
+				Delta: &anthropic.EventDelta{Type: anthropic.EventDeltaTypeInputJSON, PartialJSON: tc.Function.Arguments},
+			})
+		}
+	}
+
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.finishReason = *choice.FinishReason
+	}
+}
+
+// finish closes the open blocks and completes the message
+func (s *openAIStream) finish() {
+	s.done = true
+	if !s.started {
+		s.err = fmt.Errorf("empty response stream")
+		return
+	}
+
+	for _, index := range s.openBlocks {
+		blockIndex := index
+		s.emit(&anthropic.Event{Type: anthropic.EventTypeContentBlockStop, Index: &blockIndex})
+	}
+
+	delta := &anthropic.Event{
+		Type:  anthropic.EventTypeMessageDelta,
+		Delta: &anthropic.EventDelta{StopReason: openAIStopReason(s.finishReason)},
+	}
+	if s.usage != nil {
+		usage := s.usage.anthropic()
+		delta.Usage = &usage
+	}
+	s.emit(delta)
+	s.emit(&anthropic.Event{Type: anthropic.EventTypeMessageStop})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tectiv3/anthropic-go"
+)
+
+// summarize lays out the content, stop reason and usage of a response
+func summarize(response *anthropic.Response) string {
+	var parts []string
+	for _, content := range response.Content {
+		switch c := content.(type) {
+		case *anthropic.TextContent:
+			parts = append(parts, "text "+c.Text)
+		case *anthropic.ToolUseContent:
+			parts = append(parts, fmt.Sprintf("tool %s %s %s", c.ID, c.Name, c.Input))
+		}
+	}
+	usage := response.Usage
+	parts = append(parts,
+		"stop "+response.StopReason,
+		fmt.Sprintf("usage %d/%d/%d", usage.InputTokens, usage.OutputTokens, usage.CacheReadInputTokens))
+
+	return strings.Join(parts, " | ")
+}
+
+func TestOpenAIStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "text",
+			chunks: []string{
+				`{"id":"1","choices":[{"delta":{"role":"assistant","content":""}}]}`,
+				`{"id":"1","choices":[{"delta":{"content":"Hel"}}]}`,
+				`{"id":"1","choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+				`{"id":"1","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3,"prompt_tokens_details":{"cached_tokens":4}}}`,
+				`[DONE]`,
+			},
+			want: "text Hello | stop end_turn | usage 8/3/4",
+		},
+		{
+			name: "tool calls",
+			chunks: []string{
+				`{"id":"2","choices":[{"delta":{"content":"Looking"}}]}`,
+				`{"id":"2","choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"search","arguments":""}}]}}]}`,
+				`{"id":"2","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":"}}]}}]}`,
+				`{"id":"2","choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"summary","arguments":"{}"}}]}}]}`,
+				`{"id":"2","choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"go\"}"}}]}}]}`,
+				`{"id":"2","choices":[{"delta":{},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":20,"completion_tokens":9}}`,
+				`[DONE]`,
+			},
+			want: `text Looking | tool call_1 search {"q":"go"} | tool call_2 summary {} | stop tool_use | usage 20/9/0`,
+		},
+		{
+			name: "length without done",
+			chunks: []string{
+				`{"id":"3","choices":[{"delta":{"content":"Cut"},"finish_reason":"length"}]}`,
+			},
+			want: "text Cut | stop max_tokens | usage 0/0/0",
+		},
+		{
+			name: "truncated",
+			chunks: []string{
+				`{"id":"4","choices":[{"delta":{"content":"Cut"}}]}`,
+			},
+			wantErr: io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:    "invalid chunk",
+			chunks:  []string{`{"id":`},
+			wantErr: "invalid stream chunk",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request openAIRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer key" {
+					http.Error(w, "unexpected request", http.StatusBadRequest)
+					return
+				}
+				_ = json.NewDecoder(r.Body).Decode(&request)
+
+				w.Header().Set("Content-Type", "text/event-stream")
+				for _, chunk := range tt.chunks {
+					fmt.Fprintf(w, "data: %s\n\n", chunk)
+				}
+			}))
+			defer server.Close()
+
+			provider := &OpenAIProvider{baseURL: server.URL + "/v1/", apiKey: "key"}
+			stream, err := provider.Stream(context.Background(), &ProviderRequest{
+				Model:     "local",
+				System:    "Be brief",
+				MaxTokens: 100,
+				Tools:     []anthropic.ToolInterface{&MakeSummaryTool{}},
+				Messages:  []*anthropic.Message{anthropic.NewUserTextMessage("Hi")},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			accumulator := anthropic.NewResponseAccumulator()
+			for stream.Next() {
+				if err := accumulator.AddEvent(stream.Event()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !request.Stream || request.StreamOptions == nil || !request.StreamOptions.IncludeUsage {
+				t.Error("request does not stream with usage")
+			}
+			if len(request.Messages) != 2 || request.Messages[0].Role != "system" || len(request.Tools) != 1 {
+				t.Errorf("request messages = %+v, tools = %+v", request.Messages, request.Tools)
+			}
+
+			if tt.wantErr != "" {
+				if err := stream.Err(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err := stream.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !accumulator.IsComplete() {
+				t.Fatal("the message did not complete")
+			}
+			if got := summarize(accumulator.Response()); got != tt.want {
+				t.Errorf("response = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"error":{"message":"model not loaded"}}`)
+	}))
+	defer server.Close()
+
+	provider := &OpenAIProvider{baseURL: server.URL}
+	_, err := provider.Stream(context.Background(), &ProviderRequest{Model: "local"})
+	if err == nil || err.Error() != "API error (400): model not loaded" {
+		t.Fatalf("error = %v, want the API error", err)
+	}
+}
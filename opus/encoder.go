@@ -32,6 +32,12 @@ bridge_encoder_get_sample_rate(OpusEncoder *st, opus_int32 *sample_rate)
 }
 
 
+int
+bridge_encoder_get_lookahead(OpusEncoder *st, opus_int32 *lookahead)
+{
+	return opus_encoder_ctl(st, OPUS_GET_LOOKAHEAD(lookahead));
+}
+
 int
 bridge_encoder_set_bitrate(OpusEncoder *st, opus_int32 bitrate)
 {
@@ -274,6 +280,17 @@ func (enc *Encoder) SampleRate() (int, error) {
 	return int(sr), nil
 }
 
+// Lookahead returns the encoder delay in samples at the encoder sample rate,
+// the pre-skip of an Ogg Opus stream at 48 kHz.
+func (enc *Encoder) Lookahead() (int, error) {
+	var lookahead C.opus_int32
+	res := C.bridge_encoder_get_lookahead(enc.p, &lookahead)
+	if res != C.OPUS_OK {
+		return 0, Error(res)
+	}
+	return int(lookahead), nil
+}
+
 // SetBitrate sets the bitrate of the Encoder
 func (enc *Encoder) SetBitrate(bitrate int) error {
 	res := C.bridge_encoder_set_bitrate(enc.p, C.opus_int32(bitrate))
@@ -0,0 +1,240 @@
+package opus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+// Ogg page header type flags
+const (
+	oggBOS = 0x02
+	oggEOS = 0x04
+)
+
+const (
+	// Vendor string written to OpusTags
+	oggVendor = "go-opus"
+	// Pre-skip used when the encoder lookahead is unknown, the libopus
+	// default at 48 kHz
+	defaultPreSkip = 312
+	// RFC 7845 recommends pages of at most one second of audio
+	maxPageSamples = 48000
+	maxSegments    = 255
+)
+
+// OggWriter muxes raw Opus packets into an Ogg Opus stream (RFC 7845).
+//
+// The OpusHead and OpusTags headers are written with the first packet, so the
+// pre-skip and comments can be set up to that point. Packets are collected into
+// pages of up to a second of audio, each page carrying the granule position
+// (in 48 kHz samples) of the last packet that ends on it. Decoders drop the
+// pre-skip from the start of the stream, so the encoder input should be padded
+// with as many samples of silence at the end. Close flushes the last page and
+// marks the end of the stream.
+type OggWriter struct {
+	w          io.Writer
+	serial     uint32
+	sequence   uint32
+	sampleRate int
+	channels   int
+	preSkip    int
+	comments   []string
+	started    bool
+	closed     bool
+
+	// granule position at the end of the buffered packets
+	granule uint64
+	// packets of the page being built
+	packets     [][]byte
+	segments    int
+	pageSamples int
+}
+
+// NewOggWriter creates a writer for a stream with the given input sample rate
+// and channel count. The sample rate is informational only, Opus always
+// decodes at 48 kHz.
+func NewOggWriter(w io.Writer, sampleRate int, channels int) (*OggWriter, error) {
+	if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("Number of channels must be 1 or 2: %d", channels)
+	}
+
+	return &OggWriter{
+		w:          w,
+		serial:     rand.Uint32(),
+		sampleRate: sampleRate,
+		channels:   channels,
+		preSkip:    defaultPreSkip,
+	}, nil
+}
+
+// SetPreSkip sets the number of 48 kHz samples the decoder drops from the
+// start of the stream, normally the encoder lookahead (see Encoder.Lookahead).
+func (ow *OggWriter) SetPreSkip(samples int) error {
+	if ow.started {
+		return fmt.Errorf("opus: ogg headers already written")
+	}
+	if samples < 0 || samples > 0xffff {
+		return fmt.Errorf("opus: invalid pre-skip: %d", samples)
+	}
+	ow.preSkip = samples
+
+	return nil
+}
+
+// AddComment adds a user comment such as TITLE or ARTIST to the OpusTags header
+func (ow *OggWriter) AddComment(field, value string) error {
+	if ow.started {
+		return fmt.Errorf("opus: ogg headers already written")
+	}
+	if field == "" || strings.Contains(field, "=") {
+		return fmt.Errorf("opus: invalid comment field: %q", field)
+	}
+	ow.comments = append(ow.comments, field+"="+value)
+
+	return nil
+}
+
+// WritePacket adds an encoded Opus packet holding the given number of samples
+// per channel at 48 kHz.
+func (ow *OggWriter) WritePacket(packet []byte, samples int) error {
+	if ow.closed {
+		return fmt.Errorf("opus: ogg writer closed")
+	}
+	if len(packet) == 0 {
+		return fmt.Errorf("opus: empty packet")
+	}
+	if err := ow.writeHeaders(); err != nil {
+		return err
+	}
+
+	segments := len(packet)/255 + 1
+	if segments > maxSegments {
+		return fmt.Errorf("opus: packet too large for an ogg page: %d bytes", len(packet))
+	}
+	if len(ow.packets) > 0 && (ow.segments+segments > maxSegments || ow.pageSamples+samples > maxPageSamples) {
+		if err := ow.flush(0); err != nil {
+			return err
+		}
+	}
+
+	ow.packets = append(ow.packets, append([]byte(nil), packet...))
+	ow.segments += segments
+	ow.pageSamples += samples
+	ow.granule += uint64(samples)
+
+	return nil
+}
+
+// Close writes the last page, marking the end of the stream. It does not
+// close the underlying writer.
+func (ow *OggWriter) Close() error {
+	if ow.closed {
+		return nil
+	}
+	if err := ow.writeHeaders(); err != nil {
+		return err
+	}
+	ow.closed = true
+
+	return ow.flush(oggEOS)
+}
+
+// writeHeaders writes the OpusHead and OpusTags pages once
+func (ow *OggWriter) writeHeaders() error {
+	if ow.started {
+		return nil
+	}
+	ow.started = true
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(ow.channels)
+	binary.LittleEndian.PutUint16(head[10:], uint16(ow.preSkip))
+	binary.LittleEndian.PutUint32(head[12:], uint32(ow.sampleRate))
+	// output gain and channel mapping family 0 stay zero
+	if err := ow.writePage([][]byte{head}, 0, oggBOS); err != nil {
+		return err
+	}
+
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(oggVendor)))
+	tags = append(tags, oggVendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(ow.comments)))
+	for _, c := range ow.comments {
+		tags = binary.LittleEndian.AppendUint32(tags, uint32(len(c)))
+		tags = append(tags, c...)
+	}
+	if len(tags)/255+1 > maxSegments {
+		return fmt.Errorf("opus: comments too large: %d bytes", len(tags))
+	}
+
+	return ow.writePage([][]byte{tags}, 0, 0)
+}
+
+// flush writes the buffered packets as a page
+func (ow *OggWriter) flush(flags byte) error {
+	err := ow.writePage(ow.packets, ow.granule, flags)
+	ow.packets = ow.packets[:0]
+	ow.segments = 0
+	ow.pageSamples = 0
+
+	return err
+}
+
+// writePage writes complete packets as one Ogg page. A page without packets
+// only carries the end of stream flag.
+func (ow *OggWriter) writePage(packets [][]byte, granule uint64, flags byte) error {
+	// lacing values: 255 for every full segment, then the remainder
+	var lacing, body []byte
+	for _, p := range packets {
+		for i := 0; i < len(p)/255; i++ {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(len(p)%255))
+		body = append(body, p...)
+	}
+
+	page := make([]byte, 27, 27+len(lacing)+len(body))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], ow.serial)
+	binary.LittleEndian.PutUint32(page[18:], ow.sequence)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	page = append(page, body...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	ow.sequence++
+
+	_, err := ow.w.Write(page)
+	return err
+}
+
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return
+}()
+
+// oggCRC is the page checksum: CRC-32 with polynomial 0x04c11db7, no
+// reflection, zero initial value, computed with the checksum field zeroed
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,249 @@
+package opus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+// oggPage is a parsed Ogg page
+type oggPage struct {
+	flags    byte
+	granule  uint64
+	sequence uint32
+	packets  [][]byte
+}
+
+// readOggPages parses an Ogg stream, checking the capture pattern and the
+// checksum of every page. Packets do not span pages in streams of OggWriter.
+func readOggPages(t *testing.T, data []byte) []oggPage {
+	t.Helper()
+
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			t.Fatalf("page %d: no capture pattern", len(pages))
+		}
+		segments := int(data[26])
+		lacing := data[27 : 27+segments]
+		size := 27 + segments
+		for _, l := range lacing {
+			size += int(l)
+		}
+
+		page := append([]byte(nil), data[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if got := oggCRC(page); got != crc {
+			t.Fatalf("page %d: checksum %08x, want %08x", len(pages), crc, got)
+		}
+
+		p := oggPage{
+			flags:    data[5],
+			granule:  binary.LittleEndian.Uint64(data[6:]),
+			sequence: binary.LittleEndian.Uint32(data[18:]),
+		}
+		body := data[27+segments : size]
+		var packet []byte
+		for _, l := range lacing {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+			if l < 255 {
+				p.packets = append(p.packets, packet)
+				packet = nil
+			}
+		}
+		if packet != nil {
+			t.Fatalf("page %d: a packet continues on the next page", len(pages))
+		}
+
+		pages = append(pages, p)
+		data = data[size:]
+	}
+
+	return pages
+}
+
+func TestOggWriterPages(t *testing.T) {
+	tests := []struct {
+		name      string
+		packets   int
+		size      int
+		samples   int
+		wantPages int
+	}{
+		{"empty", 0, 0, 960, 3},
+		{"one page", 10, 40, 960, 3},
+		{"a second per page", 120, 40, 960, 5},
+		{"long packets", 3, 600, 2880, 3},
+		{"segments per page", 100, 700, 120, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w, err := NewOggWriter(&out, 48000, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.SetPreSkip(480); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.AddComment("TITLE", "test"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.packets; i++ {
+				packet := bytes.Repeat([]byte{byte(i)}, tt.size)
+				if err := w.WritePacket(packet, tt.samples); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.SetPreSkip(0); err == nil {
+				t.Error("pre-skip changed after the headers were written")
+			}
+
+			pages := readOggPages(t, out.Bytes())
+			if len(pages) != tt.wantPages {
+				t.Fatalf("%d pages, want %d", len(pages), tt.wantPages)
+			}
+
+			head := pages[0].packets[0]
+			if pages[0].flags != oggBOS || string(head[:8]) != "OpusHead" {
+				t.Fatalf("first page is not the OpusHead: %q", head)
+			}
+			if head[9] != 2 || binary.LittleEndian.Uint16(head[10:]) != 480 {
+				t.Errorf("channels %d, pre-skip %d, want 2 and 480", head[9], binary.LittleEndian.Uint16(head[10:]))
+			}
+			tags := pages[1].packets[0]
+			if !strings.HasPrefix(string(tags), "OpusTags") || !strings.HasSuffix(string(tags), "TITLE=test") {
+				t.Errorf("second page is not the OpusTags: %q", tags)
+			}
+
+			var granule uint64
+			packets := 0
+			for i, page := range pages {
+				if page.sequence != uint32(i) {
+					t.Errorf("page %d: sequence %d", i, page.sequence)
+				}
+				if i < 2 {
+					if page.granule != 0 {
+						t.Errorf("header page %d: granule %d, want 0", i, page.granule)
+					}
+					continue
+				}
+				samples := uint64(len(page.packets) * tt.samples)
+				if samples > maxPageSamples {
+					t.Errorf("page %d: %d samples, more than a second", i, samples)
+				}
+				granule += samples
+				if page.granule != granule {
+					t.Errorf("page %d: granule %d, want %d", i, page.granule, granule)
+				}
+				for _, packet := range page.packets {
+					if len(packet) != tt.size || packet[0] != byte(packets) {
+						t.Errorf("page %d: packet %d has %d bytes", i, packets, len(packet))
+					}
+					packets++
+				}
+			}
+			if packets != tt.packets {
+				t.Errorf("%d packets, want %d", packets, tt.packets)
+			}
+			if last := pages[len(pages)-1]; last.flags != oggEOS {
+				t.Errorf("last page flags %x, want end of stream", last.flags)
+			}
+		})
+	}
+}
+
+func TestOggRoundTrip(t *testing.T) {
+	const (
+		sampleRate = 48000
+		frameSize  = 960
+		duration   = sampleRate * 3 / 2
+	)
+
+	enc, err := NewEncoder(sampleRate, 1, AppVoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookahead, err := enc.Lookahead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	w, err := NewOggWriter(&out, sampleRate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetPreSkip(lookahead); err != nil {
+		t.Fatal(err)
+	}
+
+	// a 440 Hz tone, padded with the lookahead and to whole frames
+	samples := make([]float32, duration+lookahead)
+	for i := range duration {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*440*float64(i)/sampleRate))
+	}
+	frames := (len(samples) + frameSize - 1) / frameSize
+	samples = append(samples, make([]float32, frames*frameSize-len(samples))...)
+
+	packet := make([]byte, 4000)
+	for start := 0; start < len(samples); start += frameSize {
+		n, err := enc.EncodeFloat32(samples[start:start+frameSize], packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WritePacket(packet[:n], frameSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readOggPages(t, out.Bytes())
+	head := pages[0].packets[0]
+	if preSkip := int(binary.LittleEndian.Uint16(head[10:])); preSkip != lookahead {
+		t.Errorf("pre-skip %d, want the encoder lookahead %d", preSkip, lookahead)
+	}
+	if granule := pages[len(pages)-1].granule; granule != uint64(frames*frameSize) {
+		t.Errorf("final granule %d, want %d", granule, frames*frameSize)
+	}
+
+	stream, err := NewStream(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	// the decoder drops the pre-skip and stops at the final granule position
+	decoded := 0
+	var energy float64
+	pcm := make([]int16, 5760)
+	for {
+		n, err := stream.Read(pcm)
+		for _, v := range pcm[:n] {
+			energy += float64(v) * float64(v)
+		}
+		decoded += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := frames*frameSize - lookahead; decoded != want {
+		t.Errorf("decoded %d samples, want %d", decoded, want)
+	}
+	if rms := math.Sqrt(energy/float64(decoded)) / math.MaxInt16; rms < 0.2 {
+		t.Errorf("decoded tone has an RMS of %.2f, want about 0.35", rms)
+	}
+}
@@ -171,6 +171,15 @@ func (s *Stream) ReadFloat32(pcm []float32) (int, error) {
 	return int(n), nil
 }
 
+// Channels returns the number of channels of the current link, the layout
+// Read and ReadFloat32 interleave their output in.
+func (s *Stream) Channels() int {
+	if s.oggfile == nil {
+		return 0
+	}
+	return int(C.op_channels(s.oggfile, -1))
+}
+
 func (s *Stream) Close() error {
 	if s.oggfile == nil {
 		return fmt.Errorf("opus stream is uninitialized or already closed")
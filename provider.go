@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tectiv3/anthropic-go"
+)
+
+const (
+	providerAnthropic = "anthropic"
+	providerOpenAI    = "openai"
+)
+
+// Provider is a chat model backend. Messages, tools, responses and stream
+// events use the anthropic-go types; other APIs convert to and from them,
+// so the streaming engine and chat history work the same for every model.
+type Provider interface {
+	Name() string
+	// Stream starts a streaming completion
+	Stream(ctx context.Context, req *ProviderRequest) (EventStream, error)
+	// Generate runs a completion and returns the whole response
+	Generate(ctx context.Context, req *ProviderRequest) (*anthropic.Response, error)
+}
+
+// ProviderRequest holds everything needed for one completion call
+type ProviderRequest struct {
+	Model       string
+	System      string
+	MaxTokens   int
+	Temperature *float64
+	// Tools the model may call; results come back as tool_use content
+	Tools    []anthropic.ToolInterface
+	Messages []*anthropic.Message
+	// ThinkingBudget enables extended thinking when > 0, it must be below MaxTokens
+	ThinkingBudget int
+}
+
+// EventStream iterates over streamed events, *anthropic.StreamIterator implements it
+type EventStream interface {
+	Next() bool
+	Event() *anthropic.Event
+	Close() error
+	Err() error
+}
+
+// getProvider returns the backend serving the model
+func (s *Server) getProvider(model *AiModel) Provider {
+	switch model.Provider {
+	case providerOpenAI:
+		return &OpenAIProvider{baseURL: model.BaseURL, apiKey: model.APIKey}
+	default:
+		apiKey := s.conf.AnthropicAPIKey
+		if model.APIKey != "" {
+			apiKey = model.APIKey
+		}
+		return &AnthropicProvider{baseURL: model.BaseURL, apiKey: apiKey}
+	}
+}
+
+// AnthropicProvider calls the Anthropic Messages API.
+// A fresh client is created per request to avoid shared state.
+type AnthropicProvider struct {
+	baseURL string
+	apiKey  string
+}
+
+func (p *AnthropicProvider) Name() string { return providerAnthropic }
+
+// client creates a client for the request, collecting the citations of the
+// streamed text blocks when citations is set
+func (p *AnthropicProvider) client(req *ProviderRequest, citations *streamCitations) *anthropic.Client {
+	opts := []anthropic.Option{
+		anthropic.WithAPIKey(p.apiKey),
+		anthropic.WithModel(req.Model),
+		anthropic.WithSystemPrompt(req.System),
+		anthropic.WithMaxTokens(req.MaxTokens),
+	}
+	if p.baseURL != "" {
+		opts = append(opts, anthropic.WithEndpoint(strings.TrimRight(p.baseURL, "/")+"/v1/messages"))
+	}
+	if len(req.Tools) > 0 {
+		opts = append(opts, anthropic.WithTools(req.Tools...))
+	}
+	var transport http.RoundTripper
+	if req.ThinkingBudget > 0 {
+		transport = &thinkingTransport{budget: req.ThinkingBudget}
+	}
+	if citations != nil {
+		transport = &citationTransport{base: transport, citations: citations}
+	}
+	if transport != nil {
+		opts = append(opts, anthropic.WithClient(&http.Client{
+			Timeout:   anthropic.DefaultClient.Timeout,
+			Transport: transport,
+		}))
+	}
+
+	client := anthropic.New(opts...)
+	caching := true
+	client.Caching = &caching
+	client.Temperature = req.Temperature
+
+	return client
+}
+
+func (p *AnthropicProvider) Stream(ctx context.Context, req *ProviderRequest) (EventStream, error) {
+	citations := &streamCitations{blocks: map[int][]anthropic.Citation{}}
+	stream, err := p.client(req, citations).Stream(ctx, req.Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	return &citedStream{EventStream: stream, citations: citations}, nil
+}
+
+func (p *AnthropicProvider) Generate(ctx context.Context, req *ProviderRequest) (*anthropic.Response, error) {
+	return p.client(req, nil).Generate(ctx, req.Messages)
+}
+
+// thinkingTransport adds the extended thinking config to Messages API requests.
+// anthropic-go has a Request.Thinking field but no option to set it.
+type thinkingTransport struct {
+	budget int
+	base   http.RoundTripper
+}
+
+func (t *thinkingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.Body == nil {
+		return base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	payload["thinking"], _ = json.Marshal(anthropic.Thinking{Type: "enabled", BudgetTokens: t.budget})
+	if body, err = json.Marshal(payload); err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return base.RoundTrip(req)
+}
+
+// CitationStream is implemented by streams that keep the citations of their
+// text blocks, which the accumulated response does not have
+type CitationStream interface {
+	Citations(index int) []anthropic.Citation
+}
+
+// citedStream is an Anthropic stream with the citations its transport read
+type citedStream struct {
+	EventStream
+	citations *streamCitations
+}
+
+func (s *citedStream) Citations(index int) []anthropic.Citation {
+	return s.citations.block(index)
+}
+
+// streamCitations are the citations of each content block of a stream
+type streamCitations struct {
+	mu     sync.Mutex
+	blocks map[int][]anthropic.Citation
+}
+
+func (c *streamCitations) block(index int) []anthropic.Citation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.blocks[index]
+}
+
+// add reads the citation of a citations_delta event from a line of the stream
+func (c *streamCitations) add(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok || !bytes.Contains(data, []byte(`"citations_delta"`)) {
+		return
+	}
+
+	var event struct {
+		Index int `json:"index"`
+		Delta struct {
+			Citation json.RawMessage `json:"citation"`
+		} `json:"delta"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	var kind struct {
+		Type anthropic.CitationType `json:"type"`
+	}
+	if err := json.Unmarshal(event.Delta.Citation, &kind); err != nil {
+		return
+	}
+
+	var citation anthropic.Citation
+	switch kind.Type {
+	case anthropic.CitationTypeWebSearchResultLocation:
+		citation = &anthropic.WebSearchResultLocation{}
+	case anthropic.CitationTypeCharLocation:
+		citation = &anthropic.CharLocation{}
+	default:
+		return
+	}
+	if err := json.Unmarshal(event.Delta.Citation, citation); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.blocks[event.Index] = append(c.blocks[event.Index], citation)
+	c.mu.Unlock()
+}
+
+// citationTransport reads the citations of streamed text blocks, which
+// anthropic-go drops from citations_delta events
+type citationTransport struct {
+	base      http.RoundTripper
+	citations *streamCitations
+}
+
+func (t *citationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &citationReader{ReadCloser: resp.Body, citations: t.citations}
+
+	return resp, nil
+}
+
+// citationReader passes a stream through, reading citations from its lines
+type citationReader struct {
+	io.ReadCloser
+	citations *streamCitations
+	line      []byte
+}
+
+func (r *citationReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	for _, b := range p[:n] {
+		if b != '\n' {
+			r.line = append(r.line, b)
+			continue
+		}
+		r.citations.add(r.line)
+		r.line = r.line[:0]
+	}
+
+	return n, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// maxQuoteLength caps the replied-to text put in front of a question, in runes
+const maxQuoteLength = 4000
+
+// repliedTo returns the message the current one replies to, nil when it is
+// not a reply. Messages in a forum topic reply to its creation by default.
+func repliedTo(c tele.Context) *tele.Message {
+	m := c.Message()
+	if c.Callback() != nil || m == nil || m.ReplyTo == nil || m.ReplyTo.TopicCreated != nil {
+		return nil
+	}
+
+	return m.ReplyTo
+}
+
+// quoteReply puts the message the user replied to in front of the question,
+// so "explain this part" refers to the right text. Answers of the bot are
+// quoted from the history, Telegram only has their rendered text.
+func (s *Server) quoteReply(c tele.Context, chat *Chat, message string) string {
+	reply := repliedTo(c)
+	if reply == nil {
+		return message
+	}
+	fromBot := s.bot.Me != nil && reply.Sender != nil && reply.Sender.ID == s.bot.Me.ID
+
+	quote := ""
+	switch {
+	case c.Message().Quote != nil && c.Message().Quote.Text != "":
+		quote = c.Message().Quote.Text
+	case fromBot:
+		// the latest answer is the end of the history anyway
+		if chat.isLastAnswer(reply.ID) {
+			return message
+		}
+		quote = s.storedAnswer(chat, reply.ID)
+	}
+	if quote == "" {
+		quote = reply.Text
+	}
+	if quote == "" {
+		quote = reply.Caption
+	}
+	if quote == "" {
+		return message
+	}
+	if runes := []rune(quote); len(runes) > maxQuoteLength {
+		quote = string(runes[:maxQuoteLength]) + "…"
+	}
+
+	header := "In reply to:"
+	switch {
+	case fromBot:
+		header = "In reply to your earlier answer:"
+	case isGroup(c.Chat()) && reply.Sender != nil && reply.Sender.ID != c.Sender().ID:
+		name := strings.TrimSpace(reply.Sender.FirstName + " " + reply.Sender.LastName)
+		if name == "" {
+			name = reply.Sender.Username
+		}
+		header = "In reply to " + name + ":"
+	}
+
+	lines := strings.Split(strings.TrimSpace(quote), "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+
+	return header + "\n" + strings.Join(lines, "\n") + "\n\n" + message
+}
+
+// attachReply adds the question to the dialog together with the photo or PDF
+// of the message it replies to. It returns false when there is none.
+func (s *Server) attachReply(c tele.Context, chat *Chat, message string) bool {
+	reply := repliedTo(c)
+	if reply == nil {
+		return false
+	}
+
+	msg := ChatMessage{Role: "user", Content: &message, SenderName: speakerName(c)}
+	var path string
+	var err error
+	switch {
+	case reply.Photo != nil:
+		path, err = s.localFile(c, reply.Photo.File, ".jpg")
+	case reply.Document != nil && reply.Document.MIME == "application/pdf":
+		if err := ValidateFileSize(reply.Document.FileSize); err != nil {
+			return false
+		}
+		path, err = s.localFile(c, reply.Document.File, ".pdf")
+		msg.Filename = &reply.Document.FileName
+	default:
+		return false
+	}
+	if err != nil {
+		Log.Warn("Error getting replied file", "error=", err)
+		return false
+	}
+
+	msg.ImagePath = &path
+	id := c.Message().ID
+	msg.TelegramMessageID = &id
+	chat.addMessageToDialog(msg)
+
+	return true
+}
+
+// storedAnswer returns the stored text of an answer sent as the given
+// Telegram message, empty if it is not in the history
+func (s *Server) storedAnswer(chat *Chat, messageID int) string {
+	answer := s.storedMessage(chat, messageID)
+	if answer == nil || answer.Content == nil {
+		return ""
+	}
+
+	return *answer.Content
+}
+
+// storedMessage finds the answer sent as the Telegram message in the history
+func (s *Server) storedMessage(chat *Chat, messageID int) *ChatMessage {
+	var answer ChatMessage
+	err := s.db.Where("chat_id = ? AND role = ? AND telegram_message_id = ?", chat.historyID(), "assistant", messageID).
+		Order("id DESC").
+		First(&answer).Error
+	if err != nil {
+		return nil
+	}
+
+	return &answer
+}
+
+// isLastAnswer reports whether the Telegram message is the latest answer
+func (c *Chat) isLastAnswer(messageID int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := len(c.History) - 1; i >= 0; i-- {
+		if h := c.History[i]; h.Role == "assistant" && h.TelegramMessageID != nil {
+			return *h.TelegramMessageID == messageID
+		}
+	}
+
+	return false
+}
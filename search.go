@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tectiv3/chatgpt-bot/i18n"
+	tele "gopkg.in/telebot.v3"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// snippet markers, control characters that don't occur in chat text
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// FTS5 indexes over message content and thread titles. Both are external
+// content tables kept in sync by triggers, so every insert, delete and
+// summarization path is covered without touching the code that writes them.
+var searchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS message_search USING fts5(
+		content, content='chat_messages', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+	`CREATE TRIGGER IF NOT EXISTS message_search_insert AFTER INSERT ON chat_messages BEGIN
+		INSERT INTO message_search(rowid, content) VALUES (new.id, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS message_search_delete AFTER DELETE ON chat_messages BEGIN
+		INSERT INTO message_search(message_search, rowid, content) VALUES ('delete', old.id, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS message_search_update AFTER UPDATE OF content ON chat_messages BEGIN
+		INSERT INTO message_search(message_search, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO message_search(rowid, content) VALUES (new.id, new.content);
+	END`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS thread_search USING fts5(
+		thread_title, content='chats', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+	`CREATE TRIGGER IF NOT EXISTS thread_search_insert AFTER INSERT ON chats BEGIN
+		INSERT INTO thread_search(rowid, thread_title) VALUES (new.id, new.thread_title);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS thread_search_delete AFTER DELETE ON chats BEGIN
+		INSERT INTO thread_search(thread_search, rowid, thread_title) VALUES ('delete', old.id, old.thread_title);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS thread_search_update AFTER UPDATE OF thread_title ON chats BEGIN
+		INSERT INTO thread_search(thread_search, rowid, thread_title) VALUES ('delete', old.id, old.thread_title);
+		INSERT INTO thread_search(rowid, thread_title) VALUES (new.id, new.thread_title);
+	END`,
+}
+
+var searchTriggers = []string{
+	"message_search_insert", "message_search_delete", "message_search_update",
+	"thread_search_insert", "thread_search_delete", "thread_search_update",
+}
+
+// SearchResult is a message or thread title matching a search query
+type SearchResult struct {
+	// ThreadID and ThreadTitle are empty for messages of the Telegram chat
+	ThreadID    string `json:"thread_id"`
+	ThreadTitle string `json:"thread_title"`
+	// MessageID is nil when the thread title matched
+	MessageID *uint     `json:"message_id,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Snippet   string    `json:"snippet"`
+	CreatedAt time.Time `json:"created_at"`
+	// Highlights are [start, end) rune offsets of the matches in Snippet
+	Highlights [][2]int `json:"highlights"`
+}
+
+type searchRow struct {
+	ThreadID    string
+	ThreadTitle string
+	MessageID   *uint
+	Role        string
+	Snippet     string
+	CreatedAt   time.Time
+}
+
+// setupSearch creates the full-text indexes, filling them from existing data
+// when they were not kept in sync before. Without FTS5 in SQLite it drops the
+// triggers, which would otherwise break every write, and returns an error.
+func setupSearch(db *gorm.DB) error {
+	var synced int64
+	db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'message_search_insert'").Scan(&synced)
+
+	for _, stmt := range searchSchema {
+		if err := db.Exec(stmt).Error; err != nil {
+			for _, name := range searchTriggers {
+				db.Exec("DROP TRIGGER IF EXISTS " + name)
+			}
+			return err
+		}
+	}
+
+	if synced > 0 {
+		return nil
+	}
+
+	if err := db.Exec("INSERT INTO message_search(message_search) VALUES ('rebuild')").Error; err != nil {
+		return err
+	}
+
+	return db.Exec("INSERT INTO thread_search(thread_search) VALUES ('rebuild')").Error
+}
+
+// migrateMessageChats links the messages stored before ChatRecordID to their
+// chats. A message whose chat_id is both the record ID of a Telegram chat and
+// the ChatID of a thread cannot be told apart and stays unlinked.
+func migrateMessageChats(db *gorm.DB) error {
+	const (
+		telegramChat = `SELECT id FROM chats WHERE thread_id IS NULL AND id = chat_messages.chat_id`
+		thread       = `SELECT id FROM chats WHERE thread_id IS NOT NULL AND chat_id = chat_messages.chat_id`
+	)
+	err := db.Exec(`UPDATE chat_messages SET chat_record_id = (` + telegramChat + `)
+		WHERE chat_record_id IS NULL AND EXISTS (` + telegramChat + `) AND NOT EXISTS (` + thread + `)`).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Exec(`UPDATE chat_messages SET chat_record_id = (` + thread + ` LIMIT 1)
+		WHERE chat_record_id IS NULL AND EXISTS (` + thread + `) AND NOT EXISTS (` + telegramChat + `)`).Error
+}
+
+// searchQuery turns user input into an FTS5 query: every word is quoted so
+// operators and punctuation are matched literally, the last one as a prefix
+func searchQuery(input string) string {
+	words := strings.Fields(input)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+
+	return strings.Join(words, " ")
+}
+
+// parseSnippet strips the match markers from an FTS5 snippet and returns
+// the plain text with the rune offsets of the matches
+func parseSnippet(snippet string) (string, [][2]int) {
+	var b strings.Builder
+	highlights := [][2]int{}
+	pos, start := 0, -1
+	for _, r := range snippet {
+		switch string(r) {
+		case matchStart:
+			start = pos
+		case matchEnd:
+			if start >= 0 {
+				highlights = append(highlights, [2]int{start, pos})
+			}
+			start = -1
+		default:
+			b.WriteRune(r)
+			pos++
+		}
+	}
+
+	return b.String(), highlights
+}
+
+// search finds the user's threads and messages matching the input, best matches
+// first. Title matches come before message matches.
+func (s *Server) search(userID uint, input string, limit int) ([]SearchResult, error) {
+	query := searchQuery(input)
+	results := []SearchResult{}
+	if query == "" {
+		return results, nil
+	}
+
+	var rows []searchRow
+	err := s.db.Raw(`SELECT chats.thread_id, chats.thread_title, chats.updated_at AS created_at,
+			highlight(thread_search, 0, ?, ?) AS snippet
+		FROM thread_search
+		JOIN chats ON chats.id = thread_search.rowid
+		WHERE thread_search MATCH ? AND chats.user_id = ?
+			AND chats.thread_id IS NOT NULL AND chats.deleted_at IS NULL
+		ORDER BY thread_search.rank
+		LIMIT ?`, matchStart, matchEnd, query, userID, limit).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []searchRow
+	err = s.db.Raw(`SELECT COALESCE(chats.thread_id, '') AS thread_id,
+			COALESCE(chats.thread_title, '') AS thread_title, chat_messages.id AS message_id,
+			chat_messages.role, chat_messages.created_at,
+			snippet(message_search, 0, ?, ?, '…', 16) AS snippet
+		FROM message_search
+		JOIN chat_messages ON chat_messages.id = message_search.rowid
+		JOIN chats ON chats.id = chat_messages.chat_record_id
+		WHERE message_search MATCH ? AND chats.user_id = ? AND chats.deleted_at IS NULL
+			AND chat_messages.role IN ('user', 'assistant') AND chat_messages.tool_call_id IS NULL
+		ORDER BY message_search.rank
+		LIMIT ?`, matchStart, matchEnd, query, userID, limit).Scan(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	rows = append(rows, messages...)
+
+	for _, row := range rows {
+		if len(results) == limit {
+			break
+		}
+		snippet, highlights := parseSnippet(row.Snippet)
+		results = append(results, SearchResult{
+			ThreadID:    row.ThreadID,
+			ThreadTitle: row.ThreadTitle,
+			MessageID:   row.MessageID,
+			Role:        row.Role,
+			Snippet:     snippet,
+			CreatedAt:   row.CreatedAt,
+			Highlights:  highlights,
+		})
+	}
+
+	return results, nil
+}
+
+// getSearch handles GET /api/search?q=&limit=
+func (s *Server) getSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user := getUserFromContext(r)
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	if !s.searchEnabled {
+		s.writeJSONError(w, http.StatusServiceUnavailable, "Search is not available")
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if err := validateString(q, 1, MaxPromptLength); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid query: %v", err))
+		return
+	}
+
+	limit := defaultSearchLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit, expected 1 to %d", maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+
+	results, err := s.search(user.ID, q, limit)
+	if err != nil {
+		getLogger(r.Context()).WithField("error", err).Error("Search failed")
+		s.writeJSONError(w, http.StatusInternalServerError, "Search failed")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string][]SearchResult{"results": results})
+}
+
+// threadURL links into the mini app, opening the thread at the message
+func (s *Server) threadURL(threadID string, messageID *uint) string {
+	u, err := url.Parse(s.conf.MiniAppURL)
+	if err != nil {
+		return s.conf.MiniAppURL
+	}
+
+	q := u.Query()
+	q.Set("thread", threadID)
+	if messageID != nil {
+		q.Set("message", strconv.FormatUint(uint64(*messageID), 10))
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// highlightHTML renders a snippet with its matches in bold
+func highlightHTML(snippet string, highlights [][2]int) string {
+	var b strings.Builder
+	runes := []rune(snippet)
+	pos := 0
+	for _, h := range highlights {
+		b.WriteString(html.EscapeString(string(runes[pos:h[0]])))
+		b.WriteString("<b>" + html.EscapeString(string(runes[h[0]:h[1]])) + "</b>")
+		pos = h[1]
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:])))
+
+	return b.String()
+}
+
+// onSearch replies to /search with the best matches and buttons opening them in the mini app
+func (s *Server) onSearch(c tele.Context) error {
+	chat := s.getChat(c)
+	query := strings.TrimSpace(c.Message().Payload)
+	if query == "" {
+		return c.Reply(c.Message(), chat.t("Usage: /search <text>"))
+	}
+	if !s.searchEnabled {
+		return c.Reply(c.Message(), chat.t("Search is not available"))
+	}
+
+	const telegramResults = 5
+	results, err := s.search(chat.UserID, query, telegramResults)
+	if err != nil {
+		Log.WithField("error", err).Error("Search failed")
+		return c.Reply(c.Message(), chat.t("Search is not available"))
+	}
+	if len(results) == 0 {
+		return c.Reply(c.Message(), chat.t("Nothing found for {{.query}}", &i18n.Replacements{"query": query}))
+	}
+
+	var b strings.Builder
+	markup := &tele.ReplyMarkup{}
+	var rows []tele.Row
+	for i, r := range results {
+		title := r.ThreadTitle
+		if r.ThreadID == "" {
+			title = chat.t("Telegram chat")
+		}
+		b.WriteString(fmt.Sprintf("%d. <b>%s</b>\n", i+1, html.EscapeString(title)))
+		if r.MessageID != nil {
+			b.WriteString(highlightHTML(r.Snippet, r.Highlights) + "\n")
+		}
+		b.WriteString("\n")
+
+		// the Telegram chat is not in the mini app
+		if s.conf.MiniAppEnabled && r.ThreadID != "" {
+			if utf8.RuneCountInString(title) > 40 {
+				title = string([]rune(title)[:40]) + "…"
+			}
+			rows = append(rows, markup.Row(markup.WebApp(fmt.Sprintf("%d. %s", i+1, title), &tele.WebApp{
+				URL: s.threadURL(r.ThreadID, r.MessageID),
+			})))
+		}
+	}
+	opts := &tele.SendOptions{ReplyTo: c.Message(), ParseMode: tele.ModeHTML}
+	if len(rows) > 0 {
+		markup.Inline(rows...)
+		opts.ReplyMarkup = markup
+	}
+
+	return c.Send(b.String(), opts)
+}
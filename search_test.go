@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSearchOwnership(t *testing.T) {
+	db := testDB(t, &User{}, &Chat{}, &ChatMessage{})
+	if err := setupSearch(db); err != nil {
+		t.Skip("no full-text search, build with -tags sqlite_fts5: ", err)
+	}
+	s := &Server{db: db}
+
+	alice, bob := User{Username: "alice"}, User{Username: "bob"}
+	db.Create(&alice)
+	db.Create(&bob)
+
+	// Bob's Telegram chat keeps its messages under its record ID, which an
+	// older thread of Alice has as its ChatID
+	bobChat := Chat{ChatID: 4242, UserID: bob.ID}
+	db.Create(&bobChat)
+	threadID, title := "thread-1", "Soups"
+	aliceThread := Chat{ChatID: int64(bobChat.ID), UserID: alice.ID, ThreadID: &threadID, ThreadTitle: &title}
+	db.Create(&aliceThread)
+
+	message := func(chat *Chat, text string) {
+		msg := ChatMessage{ChatID: chat.historyID(), Role: "user", Content: &text}
+		if err := s.appendMessage(db, chat, &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message(&bobChat, "tomato salad from the Telegram chat")
+	message(&aliceThread, "tomato soup from the thread")
+
+	// messages from before ChatRecordID: one of each, and the ambiguous pair
+	legacy := func(chatID int64, text string) {
+		db.Create(&ChatMessage{ChatID: chatID, Role: "user", Content: &text})
+	}
+	aliceOwn := Chat{ChatID: 7, UserID: alice.ID}
+	db.Create(&aliceOwn)
+	legacy(int64(aliceOwn.ID), "tomato pasta from the old Telegram chat")
+	legacy(int64(bobChat.ID), "tomato juice of either")
+	if err := migrateMessageChats(db); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user uint
+		want []string
+	}{
+		{alice.ID, []string{"tomato soup from the thread", "tomato pasta from the old Telegram chat"}},
+		{bob.ID, []string{"tomato salad from the Telegram chat"}},
+	}
+	for _, tt := range tests {
+		results, err := s.search(tt.user, "tomato", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]bool{}
+		for _, r := range results {
+			got[r.Snippet] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("user %d found %v, want %v", tt.user, results, tt.want)
+			continue
+		}
+		for _, want := range tt.want {
+			if !got[want] {
+				t.Errorf("user %d did not find %q in %v", tt.user, want, results)
+			}
+		}
+	}
+}
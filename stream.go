@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tectiv3/anthropic-go"
+)
+
+const (
+	// maxResponseTokens is the output token limit for chat answers
+	maxResponseTokens = 16384
+	// maxToolRounds limits how many tool-use continuations one answer can take
+	maxToolRounds = 10
+	// defaultThinkingBudget is used for reasoning models without a configured budget
+	defaultThinkingBudget = 8192
+	// minThinkingBudget and maxThinkingBudget bound the budget a thread can set
+	minThinkingBudget = 1024
+	maxThinkingBudget = 64000
+	// defaultMaxOutputTokens is the output limit of models without a configured one
+	defaultMaxOutputTokens = 32000
+)
+
+var errIncompleteResponse = errors.New("incomplete response from the model")
+
+// StreamEventType identifies the kind of update emitted by streamAnswer
+type StreamEventType string
+
+const (
+	StreamEventTextDelta     StreamEventType = "text_delta"
+	StreamEventThinkingDelta StreamEventType = "thinking_delta"
+	StreamEventToolStart     StreamEventType = "tool_start"
+	StreamEventToolResult    StreamEventType = "tool_result"
+	StreamEventCitation      StreamEventType = "citation"
+	StreamEventUsage         StreamEventType = "usage"
+	StreamEventFinish        StreamEventType = "finish"
+)
+
+// StreamEvent is a single update from the streaming engine.
+// Only the fields relevant to the event type are set.
+type StreamEvent struct {
+	Type StreamEventType
+
+	// Text is the new chunk for text_delta and thinking_delta events
+	Text string
+
+	// Tool is the tool name and DisplayName its i18n label. Server marks
+	// tools executed by Anthropic itself (web search), which have no input
+	// or result on our side.
+	Tool        string
+	DisplayName string
+	Server      bool
+	Input       string
+	Result      string
+
+	Citations    []Citation
+	Usage        *TokenUsage
+	FinishReason string
+}
+
+// TokenUsage holds token usage information
+type TokenUsage struct {
+	InputTokens         int
+	OutputTokens        int
+	TotalTokens         int
+	CacheReadTokens     int
+	CacheCreationTokens int
+	FinishReason        string
+}
+
+// add accumulates the usage of another response round
+func (u *TokenUsage) add(other *TokenUsage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.TotalTokens = u.InputTokens + u.OutputTokens
+	u.CacheReadTokens += other.CacheReadTokens
+	u.CacheCreationTokens += other.CacheCreationTokens
+	u.FinishReason = other.FinishReason
+}
+
+// StreamHandler receives events from streamAnswer as they happen
+type StreamHandler func(event StreamEvent)
+
+// ToolRound is a response round that ended with client-side tool calls
+type ToolRound struct {
+	Text     string
+	Thinking ThinkingBlocks
+	Calls    ToolCalls
+	Results  []string
+}
+
+// StreamResult is the outcome of streamAnswer, partial when an error is returned
+type StreamResult struct {
+	// Text is the answer text across all rounds, a paragraph apart, FinalText
+	// only the last round
+	Text      string
+	FinalText string
+	// Thinking holds the thinking blocks of the last round
+	Thinking  ThinkingBlocks
+	Rounds    []ToolRound
+	Citations []Citation
+	// Cited are the parts of Text the citations back, in order
+	Cited []CitedText
+	Usage TokenUsage
+}
+
+// CitedText is a part of the answer backed by citations, End is its offset
+// in StreamResult.Text
+type CitedText struct {
+	End       int
+	Citations []Citation
+}
+
+// streamAnswer streams an answer for the chat from the model's provider, executing
+// client-side tool calls and continuing the conversation (max 10 rounds).
+// Progress is reported to the handler; the frontends decide how to render it.
+func (s *Server) streamAnswer(
+	ctx context.Context, chat *Chat, messages []*anthropic.Message, handler StreamHandler,
+) (*StreamResult, error) {
+	result := &StreamResult{}
+	model := s.getModel(chat.ModelName)
+	if model == nil {
+		return result, fmt.Errorf("model %s not found", chat.ModelName)
+	}
+
+	emit := func(event StreamEvent) {
+		if handler != nil {
+			handler(event)
+		}
+	}
+
+	provider := s.getProvider(model)
+	req := &ProviderRequest{
+		Model:  model.ModelID,
+		System: chat.systemPrompt(),
+		Tools:  s.getTools(chat, model),
+	}
+	req.MaxTokens, req.ThinkingBudget = outputTokens(chat, model)
+	if !model.Reasoning {
+		temp := chat.Temperature
+		req.Temperature = &temp
+	}
+
+	var text strings.Builder
+	currentMessages := append([]*anthropic.Message(nil), messages...)
+	for round := 0; round < maxToolRounds; round++ {
+		req.Messages = currentMessages
+		stream, err := provider.Stream(ctx, req)
+		if err != nil {
+			result.Text = text.String()
+			return result, err
+		}
+
+		var roundText strings.Builder
+		// blockEnds are the offsets in the answer text the text blocks end at
+		blockEnds := map[int]int{}
+		accumulator := anthropic.NewResponseAccumulator()
+
+		for stream.Next() {
+			select {
+			case <-ctx.Done():
+				stream.Close()
+				result.Text = text.String()
+				return result, ctx.Err()
+			default:
+			}
+
+			event := stream.Event()
+			accumulator.AddEvent(event)
+
+			switch event.Type {
+			case anthropic.EventTypeContentBlockStart:
+				if event.ContentBlock != nil && event.ContentBlock.Type == anthropic.ContentTypeServerToolUse {
+					start := StreamEvent{Type: StreamEventToolStart, Tool: event.ContentBlock.Name, Server: true}
+					if tool := s.tools.Get(event.ContentBlock.Name); tool != nil {
+						start.DisplayName = tool.DisplayName
+					}
+					emit(start)
+				}
+			case anthropic.EventTypeContentBlockDelta:
+				if event.Delta == nil {
+					continue
+				}
+				switch event.Delta.Type {
+				case anthropic.EventDeltaTypeText:
+					delta := event.Delta.Text
+					if roundText.Len() == 0 && text.Len() > 0 && delta != "" {
+						// the text after a tool call starts a paragraph of its own
+						delta = "\n\n" + delta
+					}
+					text.WriteString(delta)
+					roundText.WriteString(event.Delta.Text)
+					if event.Index != nil {
+						blockEnds[*event.Index] = text.Len()
+					}
+					emit(StreamEvent{Type: StreamEventTextDelta, Text: delta})
+				case anthropic.EventDeltaTypeThinking:
+					emit(StreamEvent{Type: StreamEventThinkingDelta, Text: event.Delta.Thinking})
+				}
+			}
+		}
+		stream.Close()
+
+		result.Text = text.String()
+		result.FinalText = roundText.String()
+
+		if err := stream.Err(); err != nil {
+			return result, err
+		}
+		if !accumulator.IsComplete() {
+			return result, errIncompleteResponse
+		}
+
+		response := accumulator.Response()
+
+		accUsage := accumulator.Usage()
+		usage := &TokenUsage{
+			InputTokens:         accUsage.InputTokens,
+			OutputTokens:        accUsage.OutputTokens,
+			TotalTokens:         accUsage.InputTokens + accUsage.OutputTokens,
+			CacheReadTokens:     accUsage.CacheReadInputTokens,
+			CacheCreationTokens: accUsage.CacheCreationInputTokens,
+			FinishReason:        string(response.StopReason),
+		}
+		result.Usage.add(usage)
+		s.recordUsage(chat, model, usage)
+		emit(StreamEvent{Type: StreamEventUsage, Usage: usage})
+
+		var citations []Citation
+		var toolUses []*anthropic.ToolUseContent
+		var assistantContent []anthropic.Content
+		result.Thinking = nil
+		for i, content := range response.Content {
+			if content == nil {
+				continue
+			}
+			// The accumulator drops the data of redacted thinking blocks,
+			// sending them back empty would fail the next round
+			if _, ok := content.(*anthropic.RedactedThinkingContent); ok {
+				continue
+			}
+			assistantContent = append(assistantContent, content)
+			switch c := content.(type) {
+			case *anthropic.ThinkingContent:
+				result.Thinking = append(result.Thinking, ThinkingBlock{Thinking: c.Thinking, Signature: c.Signature})
+			case *anthropic.TextContent:
+				// the content keeps the order of the streamed blocks, i is the block index
+				if cs, ok := stream.(CitationStream); ok {
+					c.Citations = append(c.Citations, cs.Citations(i)...)
+				}
+				cited := CitedText{End: blockEnds[i]}
+				for _, cit := range c.Citations {
+					cited.Citations = append(cited.Citations, extractCitation(cit))
+				}
+				if len(cited.Citations) > 0 {
+					citations = append(citations, cited.Citations...)
+					// a block without text has nothing to mark
+					if _, ok := blockEnds[i]; ok {
+						result.Cited = append(result.Cited, cited)
+					}
+				}
+			case *anthropic.ToolUseContent:
+				if len(c.Input) == 0 {
+					c.Input = json.RawMessage("{}")
+				}
+				toolUses = append(toolUses, c)
+			}
+		}
+		if len(citations) > 0 {
+			result.Citations = append(result.Citations, citations...)
+			emit(StreamEvent{Type: StreamEventCitation, Citations: citations})
+		}
+
+		if len(toolUses) == 0 {
+			emit(StreamEvent{Type: StreamEventFinish, FinishReason: result.Usage.FinishReason})
+			return result, nil
+		}
+
+		toolRound := ToolRound{Text: result.FinalText, Thinking: result.Thinking}
+		for _, tu := range toolUses {
+			toolRound.Calls = append(toolRound.Calls, ToolCall{
+				ID:   tu.ID,
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      tu.Name,
+					Arguments: string(tu.Input),
+				},
+			})
+		}
+		toolRound.Results = s.processToolCalls(withChat(ctx, chat), toolUses, emit)
+		result.Rounds = append(result.Rounds, toolRound)
+
+		var toolResults []anthropic.Content
+		for i, tu := range toolUses {
+			toolResults = append(toolResults, &anthropic.ToolResultContent{
+				ToolUseID: tu.ID,
+				Content:   toolRound.Results[i],
+			})
+		}
+		currentMessages = append(currentMessages,
+			anthropic.NewMessage("assistant", assistantContent),
+			anthropic.NewMessage("user", toolResults),
+		)
+	}
+
+	result.Usage.FinishReason = "max_tool_rounds"
+	emit(StreamEvent{Type: StreamEventFinish, FinishReason: result.Usage.FinishReason})
+
+	return result, nil
+}
+
+// outputTokens returns max_tokens and the thinking budget of a request,
+// within the model's output limit. Thinking leaves at least a quarter of the
+// output to the answer and is off when the budget left is below the minimum.
+func outputTokens(chat *Chat, model *AiModel) (maxTokens, budget int) {
+	limit := model.MaxOutputTokens
+	if limit <= 0 {
+		limit = defaultMaxOutputTokens
+	}
+
+	budget = thinkingBudget(chat, model)
+	maxTokens = min(budget+maxResponseTokens, limit)
+	if budget = min(budget, maxTokens*3/4); budget < minThinkingBudget {
+		return min(maxResponseTokens, limit), 0
+	}
+
+	return maxTokens, budget
+}
+
+// thinkingBudget returns the extended thinking budget for the chat, 0 when
+// the model doesn't think. Only Anthropic reasoning models support it.
+func thinkingBudget(chat *Chat, model *AiModel) int {
+	if !model.Reasoning || (model.Provider != "" && model.Provider != providerAnthropic) {
+		return 0
+	}
+	if chat.ThinkingBudget > 0 {
+		return chat.ThinkingBudget
+	}
+	if model.ThinkingBudget > 0 {
+		return model.ThinkingBudget
+	}
+
+	return defaultThinkingBudget
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestOutputTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		model      AiModel
+		budget     int
+		wantMax    int
+		wantBudget int
+	}{
+		{"no reasoning", AiModel{}, 0, maxResponseTokens, 0},
+		{"small model", AiModel{MaxOutputTokens: 8192}, 0, 8192, 0},
+		{"default budget", AiModel{Reasoning: true}, 0, 8192 + maxResponseTokens, 8192},
+		{"within limit", AiModel{Reasoning: true, MaxOutputTokens: 64000}, 40000, 56384, 40000},
+		{"thread budget clamped", AiModel{Reasoning: true}, 64000, 32000, 24000},
+		{"model budget clamped", AiModel{Reasoning: true, ThinkingBudget: 16000, MaxOutputTokens: 8192}, 0, 8192, 6144},
+		{"no room to think", AiModel{Reasoning: true, MaxOutputTokens: 1024}, 0, 1024, 0},
+		{"openai", AiModel{Reasoning: true, Provider: providerOpenAI}, 0, maxResponseTokens, 0},
+	}
+	for _, tt := range tests {
+		maxTokens, budget := outputTokens(&Chat{ThinkingBudget: tt.budget}, &tt.model)
+		if maxTokens != tt.wantMax || budget != tt.wantBudget {
+			t.Errorf("%s: outputTokens = %d, %d, want %d, %d", tt.name, maxTokens, budget, tt.wantMax, tt.wantBudget)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	sttGeneric    = "generic"
+	sttOpenAI     = "openai"
+	sttWhisperCpp = "whispercpp"
+
+	defaultSTTModel = "whisper-1"
+	// Whisper only looks at the last 224 tokens of a prompt
+	maxSTTPromptLength = 400
+)
+
+// SpeechToText is a transcription backend taking 16 kHz mono WAV
+type SpeechToText interface {
+	Transcribe(ctx context.Context, wav io.Reader, opts TranscribeOptions) (*Transcription, error)
+}
+
+// TranscribeOptions are hints passed to the backend when it supports them
+type TranscribeOptions struct {
+	// Language is an ISO-639-1 code, empty to auto-detect
+	Language string
+	// Prompt is text preceding the audio, such as the previous chunk's transcript
+	Prompt string
+}
+
+// Transcription is the text of a recording, with timed segments when the
+// backend provides them
+type Transcription struct {
+	Text     string
+	Language string
+	Segments []TranscriptSegment
+}
+
+// TranscriptSegment is a piece of the transcript, times relative to the audio start
+type TranscriptSegment struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// getSTT returns the configured speech to text backend
+func (s *Server) getSTT() SpeechToText {
+	switch s.conf.STTProvider {
+	case sttOpenAI:
+		model := s.conf.STTModel
+		if model == "" {
+			model = defaultSTTModel
+		}
+		return &OpenAISTT{url: endpointURL(s.conf.WhisperEndpoint, "/audio/transcriptions"), apiKey: s.conf.STTAPIKey, model: model}
+	case sttWhisperCpp:
+		return &WhisperCppSTT{url: endpointURL(s.conf.WhisperEndpoint, "/inference")}
+	default:
+		return &GenericSTT{url: s.conf.WhisperEndpoint}
+	}
+}
+
+// endpointURL appends the API path unless the configured URL already has it
+func endpointURL(base, path string) string {
+	base = strings.TrimSuffix(base, "/")
+	if strings.HasSuffix(base, path) {
+		return base
+	}
+	return base + path
+}
+
+// sttLanguage turns a Telegram language code such as "pt-br" into the
+// ISO-639-1 code Whisper expects
+func sttLanguage(lang string) string {
+	lang, _, _ = strings.Cut(strings.ToLower(lang), "-")
+	if len(lang) != 2 {
+		return ""
+	}
+	return lang
+}
+
+// sttPrompt keeps the end of the previous text as context for the next chunk
+func sttPrompt(text string) string {
+	runes := []rune(text)
+	if len(runes) <= maxSTTPromptLength {
+		return text
+	}
+	return string(runes[len(runes)-maxSTTPromptLength:])
+}
+
+// normalizeTranscript lowercases a transcript and drops punctuation, for
+// matching spoken commands
+func normalizeTranscript(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return ' '
+		}
+		return unicode.ToLower(r)
+	}, text)
+
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// GenericSTT posts the file to an endpoint answering with {"text": ...} or
+// plain text
+type GenericSTT struct {
+	url string
+}
+
+func (t *GenericSTT) Transcribe(ctx context.Context, wav io.Reader, opts TranscribeOptions) (*Transcription, error) {
+	fields := map[string]string{}
+	if opts.Language != "" {
+		fields["language"] = opts.Language
+	}
+	body, err := postAudio(ctx, t.url, "", fields, wav)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		// Fallback: treat as plain text
+		return &Transcription{Text: strings.TrimSpace(string(body))}, nil
+	}
+
+	return &Transcription{Text: strings.TrimSpace(result.Text)}, nil
+}
+
+// OpenAISTT calls an OpenAI-compatible /v1/audio/transcriptions endpoint
+type OpenAISTT struct {
+	url    string
+	apiKey string
+	model  string
+}
+
+func (t *OpenAISTT) Transcribe(ctx context.Context, wav io.Reader, opts TranscribeOptions) (*Transcription, error) {
+	fields := map[string]string{
+		"model":                     t.model,
+		"response_format":           "verbose_json",
+		"timestamp_granularities[]": "segment",
+	}
+	if opts.Language != "" {
+		fields["language"] = opts.Language
+	}
+	if opts.Prompt != "" {
+		fields["prompt"] = opts.Prompt
+	}
+	body, err := postAudio(ctx, t.url, t.apiKey, fields, wav)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVerboseTranscription(body)
+}
+
+// WhisperCppSTT calls the /inference endpoint of whisper.cpp's server
+type WhisperCppSTT struct {
+	url string
+}
+
+func (t *WhisperCppSTT) Transcribe(ctx context.Context, wav io.Reader, opts TranscribeOptions) (*Transcription, error) {
+	fields := map[string]string{
+		"response_format": "verbose_json",
+		"temperature":     "0.0",
+		// whisper.cpp defaults to English instead of detecting
+		"language": "auto",
+	}
+	if opts.Language != "" {
+		fields["language"] = opts.Language
+	}
+	if opts.Prompt != "" {
+		fields["prompt"] = opts.Prompt
+	}
+	body, err := postAudio(ctx, t.url, "", fields, wav)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVerboseTranscription(body)
+}
+
+// parseVerboseTranscription reads the verbose_json format shared by OpenAI
+// and whisper.cpp, segment times are in seconds
+func parseVerboseTranscription(body []byte) (*Transcription, error) {
+	var result struct {
+		Text     string `json:"text"`
+		Language string `json:"language"`
+		Segments []struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+			Text  string  `json:"text"`
+		} `json:"segments"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse transcription: %w", err)
+	}
+
+	t := &Transcription{Text: strings.TrimSpace(result.Text), Language: result.Language}
+	for _, seg := range result.Segments {
+		text := strings.TrimSpace(seg.Text)
+		if text == "" {
+			continue
+		}
+		t.Segments = append(t.Segments, TranscriptSegment{
+			Start: time.Duration(seg.Start * float64(time.Second)),
+			End:   time.Duration(seg.End * float64(time.Second)),
+			Text:  text,
+		})
+	}
+
+	return t, nil
+}
+
+// postAudio streams a multipart form with the WAV as "file" and returns the
+// response body
+func postAudio(ctx context.Context, url, apiKey string, fields map[string]string, wav io.Reader) ([]byte, error) {
+	if url == "" {
+		return nil, fmt.Errorf("whisper_endpoint not configured")
+	}
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		var err error
+		for name, value := range fields {
+			if err = form.WriteField(name, value); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			var part io.Writer
+			part, err = form.CreateFormFile("file", "audio.wav")
+			if err == nil {
+				_, err = io.Copy(part, wav)
+			}
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("whisper request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("whisper returned %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return respBody, nil
+}
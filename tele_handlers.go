@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/tectiv3/chatgpt-bot/i18n"
+	"github.com/tectiv3/chatgpt-bot/markdown"
 	tele "gopkg.in/telebot.v3"
 )
 
@@ -25,9 +26,14 @@ func (s *Server) onDocument(c tele.Context) {
 		WithField("size", c.Message().Document.FileSize).
 		Info("Got a file")
 
+	if isAudioDocument(c.Message().Document) {
+		s.handleAudioFile(c, c.Message().Document.File)
+		return
+	}
+
 	// Validate file size
 	if err := ValidateFileSize(c.Message().Document.FileSize); err != nil {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		_ = c.Reply(
 			c.Message(),
 			chat.t("File too large: {{.error}}", &i18n.Replacements{"error": err.Error()}),
@@ -42,7 +48,7 @@ func (s *Server) onDocument(c tele.Context) {
 	}
 
 	if c.Message().Document.MIME != "text/plain" {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		_ = c.Reply(
 			c.Message(),
 			chat.t("Please provide a text file"),
@@ -87,19 +93,9 @@ func (s *Server) onDocument(c tele.Context) {
 	if len(response) == 0 {
 		return
 	}
-	// only if len response > 4kb then reply as a file but generate filename using mini
-	if len(response) > 4000 {
-		file := tele.FromReader(strings.NewReader(response))
-		fileName := fmt.Sprintf("answer_%d.md", time.Now().Unix())
-		_ = c.Send(&tele.Document{File: file, FileName: fileName, MIME: "text/plain"})
-		return
+	if _, err := sendAnswer(c, response, nil, nil); err != nil {
+		Log.Warn(err)
 	}
-	_ = c.Reply(
-		c.Message(),
-		response,
-		"text",
-		&tele.SendOptions{ParseMode: tele.ModeMarkdown},
-	)
 }
 
 func (s *Server) onText(c tele.Context) {
@@ -113,16 +109,19 @@ func (s *Server) onText(c tele.Context) {
 	if len(message) == 0 {
 		message = strings.TrimSpace(c.Message().Text)
 	}
+	if isGroup(c.Chat()) {
+		message = s.stripMention(message)
+	}
 
 	// Basic validation for message length
 	if len(message) == 0 {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		_ = c.Reply(c.Message(), chat.t("Please provide a message"))
 		return
 	}
 
 	if len(message) > MaxPromptLength {
-		chat := s.getChat(c.Chat(), c.Sender())
+		chat := s.getChat(c)
 		_ = c.Reply(
 			c.Message(),
 			chat.t("Message too long. Maximum length is {{.max}} characters", &i18n.Replacements{"max": fmt.Sprintf("%d", MaxPromptLength)}),
@@ -133,6 +132,109 @@ func (s *Server) onText(c tele.Context) {
 	s.complete(c, message)
 }
 
+// onEdited answers an edited text message again. An edit of the latest
+// question replaces it and its answer, an edit of an older one branches the
+// conversation when the chat allows it, the original question and its
+// answers stay in the history as a sibling.
+func (s *Server) onEdited(c tele.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
+		}
+	}()
+
+	message := strings.TrimSpace(c.Message().Text)
+	if isGroup(c.Chat()) {
+		message = s.stripMention(message)
+	}
+	if len(message) == 0 || strings.HasPrefix(message, "/") || len(message) > MaxPromptLength {
+		return
+	}
+
+	chat := s.getChat(c)
+	if i := chat.lastQuestion(); i >= 0 && chat.History[i].TelegramMessageID != nil && *chat.History[i].TelegramMessageID == c.Message().ID {
+		s.reanswer(c, chat, i, message)
+		return
+	}
+	if !chat.BranchEdits {
+		return
+	}
+
+	var original ChatMessage
+	err := s.db.Where("chat_id = ? AND role = ? AND telegram_message_id = ?", chat.historyID(), "user", c.Message().ID).
+		Order("id DESC").
+		First(&original).Error
+	if err != nil {
+		// not part of the stored conversation, e.g. a reset happened since
+		return
+	}
+
+	var all []ChatMessage
+	s.db.Where("chat_id = ?", chat.historyID()).Order("id ASC").Find(&all)
+	chat.ActiveLeafID = original.ParentID
+	chat.History = chat.activeBranch(all)
+
+	Log.WithField("user", c.Sender().Username).Info("Message edited, branching conversation")
+	s.getStreamingAnswer(chat, c, &message)
+}
+
+// reanswer replaces the question at index i of the history with its edited
+// text, drops what followed it and answers again, editing the old answer
+func (s *Server) reanswer(c tele.Context, chat *Chat, i int, message string) {
+	question := chat.History[i]
+	var dropped []uint
+	var answer []tele.Editable
+	for _, h := range chat.History[i+1:] {
+		dropped = append(dropped, h.ID)
+		if h.Role == "assistant" && h.TelegramMessageID != nil {
+			answer = h.sentMessages(c.Chat().ID)
+		}
+	}
+	if len(dropped) > 0 {
+		s.db.Where("chat_id = ? AND id IN ?", chat.historyID(), dropped).Delete(&ChatMessage{})
+	}
+	chat.History = chat.History[:i+1]
+
+	content := s.quoteReply(c, chat, message)
+	chat.History[i].Content = &content
+	s.db.Model(&ChatMessage{}).Where("id = ?", question.ID).Update("content", content)
+	chat.ActiveLeafID = &question.ID
+	s.db.Model(&Chat{}).Where("id = ?", chat.ID).Update("active_leaf_id", question.ID)
+
+	Log.WithField("user", c.Sender().Username).Info("Latest message edited, answering again")
+	if answer != nil {
+		c = &answerContext{Context: c, answer: answer}
+	}
+	s.getStreamingAnswer(chat, c, nil)
+}
+
+// sentAs links an answer to the Telegram messages it was sent as
+func (m *ChatMessage) sentAs(messages []*tele.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	m.TelegramMessageIDs = make(MessageIDs, len(messages))
+	for i, msg := range messages {
+		m.TelegramMessageIDs[i] = msg.ID
+	}
+	m.TelegramMessageID = &m.TelegramMessageIDs[len(messages)-1]
+}
+
+// sentMessages returns the Telegram messages an answer was sent as. Older
+// answers only know their last message.
+func (m *ChatMessage) sentMessages(chatID int64) []tele.Editable {
+	ids := m.TelegramMessageIDs
+	if len(ids) == 0 && m.TelegramMessageID != nil {
+		ids = MessageIDs{*m.TelegramMessageID}
+	}
+	messages := make([]tele.Editable, len(ids))
+	for i, id := range ids {
+		messages[i] = &tele.StoredMessage{MessageID: strconv.Itoa(id), ChatID: chatID}
+	}
+
+	return messages
+}
+
 func (s *Server) onVoice(c tele.Context) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -146,6 +248,32 @@ func (s *Server) onVoice(c tele.Context) {
 	s.handleVoice(c)
 }
 
+func (s *Server) onAudio(c tele.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
+		}
+	}()
+
+	Log.WithField("user", c.Sender().Username).
+		Info("Got an audio, filesize=", c.Message().Audio.FileSize)
+
+	s.handleAudioFile(c, c.Message().Audio.File)
+}
+
+func (s *Server) onVideoNote(c tele.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
+		}
+	}()
+
+	Log.WithField("user", c.Sender().Username).
+		Info("Got a video note, filesize=", c.Message().VideoNote.FileSize)
+
+	s.handleVoice(c)
+}
+
 func (s *Server) onPhoto(c tele.Context) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -196,7 +324,8 @@ func (s *Server) onGetUsers(c tele.Context) {
 	}()
 
 	users := s.getUsers()
-	text := "Users:\n"
+	text := &markdown.Formatted{}
+	text.Append("Users:\n", 0)
 	for _, user := range users {
 		threads := user.Threads
 		var historyLen int64
@@ -215,18 +344,22 @@ func (s *Server) onGetUsers(c tele.Context) {
 			}
 		}
 
-		text += fmt.Sprintf(
-			"*%s*, last used: *%s*, history: *%d*, usage: *%d*, model: *%s*, role: *%s*\n",
-			user.Username,
-			updatedAt.Format("2006/01/02 15:04"),
-			historyLen,
-			totalTokens,
-			model,
-			role,
-		)
+		// usernames and roles are sent as they are, the values are only bolded
+		text.Append(user.Username, markdown.Bold)
+		text.Append(", last used: ", 0)
+		text.Append(updatedAt.Format("2006/01/02 15:04"), markdown.Bold)
+		text.Append(", history: ", 0)
+		text.Append(strconv.FormatInt(historyLen, 10), markdown.Bold)
+		text.Append(", usage: ", 0)
+		text.Append(strconv.Itoa(totalTokens), markdown.Bold)
+		text.Append(", model: ", 0)
+		text.Append(model, markdown.Bold)
+		text.Append(", role: ", 0)
+		text.Append(role, markdown.Bold)
+		text.Append("\n", 0)
 	}
 
-	_ = c.Send(text, "text", &tele.SendOptions{ReplyTo: c.Message(), ParseMode: tele.ModeMarkdown})
+	_, _ = sendFormatted(c, text, nil, nil)
 }
 
 func (s *Server) onState(c tele.Context) {
@@ -236,7 +369,7 @@ func (s *Server) onState(c tele.Context) {
 		}
 	}()
 
-	chat := s.getChat(c.Chat(), c.Sender())
+	chat := s.getChat(c)
 	user := chat.User
 	state := user.State
 	step := findEmptyStep(&state.FirstStep)
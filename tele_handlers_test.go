@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tectiv3/chatgpt-bot/markdown"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestReanswerMultipart(t *testing.T) {
+	part := strings.Repeat("word ", 700) + "end."
+
+	tests := []struct {
+		name string
+		old  MessageIDs
+		// the new answer has this many parts
+		parts int
+		calls []string
+		ids   MessageIDs
+	}{
+		{
+			name:  "shorter",
+			old:   MessageIDs{10, 11, 12},
+			parts: 2,
+			calls: []string{"editMessageText 10", "editMessageText 11", "deleteMessage 12"},
+			ids:   MessageIDs{10, 11},
+		},
+		{
+			name:  "longer",
+			old:   MessageIDs{10, 11},
+			parts: 3,
+			calls: []string{"editMessageText 10", "editMessageText 11", "sendMessage 100"},
+			ids:   MessageIDs{10, 11, 100},
+		},
+		{
+			name:  "last message only",
+			parts: 2,
+			calls: []string{"editMessageText 12", "sendMessage 100"},
+			ids:   MessageIDs{12, 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t, &Chat{}, &ChatMessage{})
+			s := &Server{db: db}
+			bot, api := testBot(t)
+
+			// the old answer comes back from the database
+			last := 12
+			if len(tt.old) > 0 {
+				last = tt.old[len(tt.old)-1]
+			}
+			old := ChatMessage{Role: "assistant", TelegramMessageID: &last, TelegramMessageIDs: tt.old}
+			db.Create(&old)
+			var stored ChatMessage
+			db.First(&stored, old.ID)
+
+			chat := &Chat{ChatID: 1}
+			c := &answerContext{
+				Context: bot.NewContext(tele.Update{Message: &tele.Message{
+					ID:     5,
+					Chat:   &tele.Chat{ID: 1, Type: tele.ChatPrivate},
+					Sender: &tele.User{ID: 1},
+				}}),
+				answer: stored.sentMessages(1),
+			}
+			text := markdown.Format(strings.TrimSpace(strings.Repeat(part+"\n\n", tt.parts)))
+
+			var answer ChatMessage
+			answer.sentAs(s.sendReply(chat, c, text, replyMenu))
+
+			if !reflect.DeepEqual(api.calls, tt.calls) {
+				t.Errorf("calls = %q, want %q", api.calls, tt.calls)
+			}
+			if !reflect.DeepEqual(answer.TelegramMessageIDs, tt.ids) || *answer.TelegramMessageID != tt.ids[len(tt.ids)-1] {
+				t.Errorf("answer sent as %v, last %d, want %v", answer.TelegramMessageIDs, *answer.TelegramMessageID, tt.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tectiv3/chatgpt-bot/i18n"
+	tele "gopkg.in/telebot.v3"
+)
+
+// Threads are the conversations of the web app. A Telegram chat talks in its
+// own history until a thread is picked with /threads or started with /new,
+// in a forum supergroup every topic is a thread of its own.
+
+const (
+	// newThreadTitle is replaced by a generated title after the first question
+	newThreadTitle   = "New Thread"
+	maxThreadButtons = 10
+	// btnThread data switching back to the Telegram chat's own history
+	mainThread = "main"
+)
+
+var btnThread = tele.Btn{Unique: "btnThread"}
+
+// topicContext answers in a forum topic instead of where the command was sent
+type topicContext struct {
+	tele.Context
+	message *tele.Message
+}
+
+func (c *topicContext) Message() *tele.Message {
+	return c.message
+}
+
+// newThreadChatID returns a ChatID for a thread's messages, out of the range
+// of Telegram chat IDs
+func newThreadChatID() int64 {
+	return time.Now().UnixNano()
+}
+
+// newThread prepares a thread with the settings of the Telegram chat
+func newThread(chat *Chat, title string) *Chat {
+	threadID := uuid.New().String()
+	thread := &Chat{
+		UserID:         chat.UserID,
+		ChatID:         newThreadChatID(),
+		ThreadID:       &threadID,
+		ThreadTitle:    &title,
+		RoleID:         chat.RoleID,
+		Lang:           chat.Lang,
+		Temperature:    chat.Temperature,
+		ModelName:      chat.ModelName,
+		MasterPrompt:   chat.MasterPrompt,
+		Stream:         true,
+		Voice:          chat.Voice,
+		ContextLimit:   chat.ContextLimit,
+		EnabledTools:   chat.EnabledTools,
+		ThinkingBudget: chat.ThinkingBudget,
+	}
+	if thread.ContextLimit == 0 {
+		thread.ContextLimit = 4000
+	}
+
+	return thread
+}
+
+// getThread returns a thread of the user that is not archived, nil if there is none
+func (s *Server) getThread(userID uint, threadID string) *Chat {
+	var thread Chat
+	err := s.db.Preload("User").Preload("User.Roles").Preload("Role").
+		Where("user_id = ? AND thread_id = ? AND archived_at IS NULL", userID, threadID).
+		First(&thread).Error
+	if err != nil {
+		return nil
+	}
+	s.loadThreadHistory(&thread)
+
+	return &thread
+}
+
+// getTopicThread returns the thread of a forum topic, created for topics the
+// bot has not seen yet
+func (s *Server) getTopicThread(chat *Chat, m *tele.Message) *Chat {
+	var thread Chat
+	err := s.db.Preload("User").Preload("User.Roles").Preload("Role").
+		Where("telegram_chat_id = ? AND topic_id = ?", chat.ChatID, m.ThreadID).
+		First(&thread).Error
+	if err == nil {
+		s.loadThreadHistory(&thread)
+		return &thread
+	}
+
+	title := newThreadTitle
+	if m.ReplyTo != nil && m.ReplyTo.TopicCreated != nil {
+		title = m.ReplyTo.TopicCreated.Name
+	}
+	created := newThread(chat, title)
+	created.TelegramChatID = &chat.ChatID
+	created.TopicID = &m.ThreadID
+	if err := s.db.Create(created).Error; err != nil {
+		Log.WithField("error", err).Error("Failed to create topic thread")
+		return chat
+	}
+	created.User = chat.User
+	created.Role = chat.Role
+
+	return created
+}
+
+// loadThreadHistory keeps the live messages of the thread's active branch,
+// as the web app sends them to the model
+func (s *Server) loadThreadHistory(thread *Chat) {
+	all, err := s.loadThreadMessages(s.db, thread)
+	if err != nil {
+		Log.WithField("error", err).Warn("Failed to load thread messages")
+	}
+	thread.History = nil
+	for _, msg := range thread.activeBranch(all) {
+		if msg.IsLive {
+			thread.History = append(thread.History, msg)
+		}
+	}
+}
+
+func (s *Server) setActiveThread(chat *Chat, threadID *string) {
+	chat.ActiveThreadID = threadID
+	s.db.Model(&Chat{}).Where("id = ?", chat.ID).Update("active_thread_id", threadID)
+}
+
+// nameThread replaces the placeholder title of a thread and its topic with
+// one generated from the first question
+func (s *Server) nameThread(thread *Chat, question string) {
+	title, err := s.generateThreadTitle(thread, question)
+	if err != nil {
+		Log.WithField("error", err).Warn("Failed to generate thread title")
+		return
+	}
+	thread.ThreadTitle = &title
+	s.db.Model(&Chat{}).Where("id = ?", thread.ID).Update("thread_title", title)
+
+	if thread.TopicID != nil && thread.TelegramChatID != nil {
+		topic := &tele.Topic{ThreadID: *thread.TopicID, Name: title}
+		if err := s.bot.EditTopic(&tele.Chat{ID: *thread.TelegramChatID}, topic); err != nil {
+			Log.WithField("error", err).Warn("Failed to rename topic")
+		}
+	}
+}
+
+// onNewThread starts a thread, /new [question]. In a forum it gets a topic
+// of its own, a private chat switches to it. Other groups share one history
+// and have no threads.
+func (s *Server) onNewThread(c tele.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			Log.WithField("error", err).Error("panic: ", string(debug.Stack()))
+		}
+	}()
+
+	chat := s.getTelegramChat(c.Chat(), c.Sender())
+	forum := s.isForum(c.Chat())
+	if isGroup(c.Chat()) && !forum {
+		_ = c.Reply(c.Message(), chat.t("This command only works in a private chat with the bot"))
+		return
+	}
+	question := strings.TrimSpace(c.Message().Payload)
+	if len(question) > MaxPromptLength {
+		_ = c.Reply(c.Message(), chat.t("Message too long. Maximum length is {{.max}} characters", &i18n.Replacements{"max": MaxPromptLength}))
+		return
+	}
+
+	title := newThreadTitle
+	if question != "" {
+		if generated, err := s.generateThreadTitle(chat, question); err == nil {
+			title = generated
+		}
+	}
+	thread := newThread(chat, title)
+
+	if !forum {
+		if err := s.db.Create(thread).Error; err != nil {
+			Log.WithField("error", err).Error("Failed to create thread")
+			return
+		}
+		s.setActiveThread(chat, thread.ThreadID)
+		Log.WithField("user", c.Sender().Username).Info("New thread ", title)
+		if question == "" {
+			_ = c.Reply(c.Message(), chat.t("New thread started"))
+			return
+		}
+		s.complete(c, question)
+		return
+	}
+
+	topic, err := c.Bot().CreateTopic(c.Chat(), &tele.Topic{Name: title})
+	if err != nil {
+		_ = c.Reply(c.Message(), chat.t("Could not create a topic: {{.error}}", &i18n.Replacements{"error": err.Error()}))
+		return
+	}
+	thread.TelegramChatID = &chat.ChatID
+	thread.TopicID = &topic.ThreadID
+	if err := s.db.Create(thread).Error; err != nil {
+		Log.WithField("error", err).Error("Failed to create thread")
+		return
+	}
+	Log.WithField("user", c.Sender().Username).Info("New topic thread ", title)
+
+	// the question is repeated in the topic and answered there
+	text := chat.t("New thread started")
+	if question != "" {
+		text = question
+	}
+	note, err := c.Bot().Send(c.Chat(), text, &tele.SendOptions{ThreadID: topic.ThreadID})
+	if err != nil || question == "" {
+		return
+	}
+	note.ThreadID = topic.ThreadID
+	note.TopicMessage = true
+	s.complete(&topicContext{Context: c, message: note}, question)
+}
+
+// onThreads lists the recent threads to continue one of them in Telegram.
+// Threads are private, groups talk in their own history and topics.
+func (s *Server) onThreads(c tele.Context) error {
+	chat := s.getTelegramChat(c.Chat(), c.Sender())
+
+	var threads []Chat
+	s.db.Where("user_id = ? AND thread_id IS NOT NULL AND archived_at IS NULL", chat.UserID).
+		Order("updated_at DESC").
+		Limit(maxThreadButtons).
+		Find(&threads)
+
+	markup := &tele.ReplyMarkup{}
+	mark := ""
+	if chat.ActiveThreadID == nil {
+		mark = "✅ "
+	}
+	rows := []tele.Row{markup.Row(tele.Btn{Text: mark + chat.t("Main chat"), Unique: btnThread.Unique, Data: mainThread})}
+	for i := range threads {
+		t := &threads[i]
+		mark := ""
+		if chat.ActiveThreadID != nil && *chat.ActiveThreadID == *t.ThreadID {
+			mark = "✅ "
+		}
+		rows = append(rows, markup.Row(tele.Btn{Text: mark + threadTitle(t), Unique: btnThread.Unique, Data: *t.ThreadID}))
+	}
+	markup.Inline(rows...)
+
+	return c.Reply(c.Message(), chat.t("Select a thread"), markup)
+}
+
+// onThreadSelected switches the chat to a thread
+func (s *Server) onThreadSelected(c tele.Context) error {
+	chat := s.getTelegramChat(c.Chat(), c.Sender())
+	if c.Data() == mainThread {
+		s.setActiveThread(chat, nil)
+		return c.Edit(chat.t("Switched to the main chat"))
+	}
+
+	thread := s.getThread(chat.UserID, c.Data())
+	if thread == nil {
+		return c.Edit(chat.t("Thread not found"))
+	}
+	title := threadTitle(thread)
+	Log.WithField("user", c.Sender().Username).Info("Selected thread ", title)
+	s.setActiveThread(chat, thread.ThreadID)
+
+	return c.Edit(chat.t("Switched to {{.title}}", &i18n.Replacements{"title": title}))
+}
+
+// isForum reports whether the chat is a forum supergroup, a flag the chat of
+// an update does not carry
+func (s *Server) isForum(chat *tele.Chat) bool {
+	if chat.Type != tele.ChatSuperGroup {
+		return false
+	}
+	data, err := s.bot.Raw("getChat", map[string]string{"chat_id": chat.Recipient()})
+	if err != nil {
+		Log.WithField("error", err).Warn("Failed to get chat")
+		return false
+	}
+	var resp struct {
+		Result struct {
+			IsForum bool `json:"is_forum"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return false
+	}
+
+	return resp.Result.IsForum
+}
+
+func threadTitle(thread *Chat) string {
+	if thread.ThreadTitle == nil || *thread.ThreadTitle == "" {
+		return newThreadTitle
+	}
+	return *thread.ThreadTitle
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tectiv3/chatgpt-bot/audio"
+	"github.com/tectiv3/chatgpt-bot/opus"
+	tele "gopkg.in/telebot.v3"
+)
+
+const (
+	// Opus always runs at 48 kHz here, 20 ms frames
+	voiceSampleRate = 48000
+	voiceFrameSize  = 960
+	voiceBitrate    = 32000
+	// maxSpeechLength caps the text sent to TTS, in runes
+	maxSpeechLength = 4000
+)
+
+var (
+	speechCodeBlockRegex = regexp.MustCompile("(?s)```.*?```")
+	speechLinkRegex      = regexp.MustCompile(`\[([^\]]+)\]\([^\)]+\)`)
+	speechURLRegex       = regexp.MustCompile(`https?://\S+`)
+	speechMarkupRegex    = regexp.MustCompile("[*_`#>|~]+")
+)
+
+// speechText strips the markdown that TTS would otherwise read out loud.
+// Code blocks are dropped entirely, links keep their text.
+func speechText(md string) string {
+	text := speechCodeBlockRegex.ReplaceAllString(md, "")
+	text = speechLinkRegex.ReplaceAllString(text, "$1")
+	text = speechURLRegex.ReplaceAllString(text, "")
+	text = speechMarkupRegex.ReplaceAllString(text, "")
+	text = strings.TrimSpace(text)
+
+	if runes := []rune(text); len(runes) > maxSpeechLength {
+		text = string(runes[:maxSpeechLength])
+	}
+
+	return text
+}
+
+// synthesize sends text to the configured TTS endpoint and returns WAV audio
+func (s *Server) synthesize(text string) ([]byte, error) {
+	if s.conf.TTSEndpoint == "" {
+		return nil, fmt.Errorf("tts_endpoint not configured")
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Post(s.conf.TTSEndpoint, "text/plain; charset=utf-8", strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("tts request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tts response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tts returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
+
+// encodeVoice encodes 48 kHz mono samples into an Ogg Opus voice note
+func encodeVoice(samples []float32) ([]byte, error) {
+	enc, err := opus.NewEncoder(voiceSampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.SetBitrate(voiceBitrate); err != nil {
+		return nil, err
+	}
+	if err := enc.SetDTX(true); err != nil {
+		return nil, err
+	}
+
+	lookahead, err := enc.Lookahead()
+	if err != nil {
+		return nil, err
+	}
+
+	output := new(bytes.Buffer)
+	ogg, err := opus.NewOggWriter(output, voiceSampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := ogg.SetPreSkip(lookahead); err != nil {
+		return nil, err
+	}
+
+	// the decoder drops the lookahead from the start, pad the end to keep the tail
+	samples = append(samples, make([]float32, lookahead)...)
+
+	frame := make([]float32, voiceFrameSize)
+	packet := make([]byte, 4000)
+	for start := 0; start < len(samples); start += voiceFrameSize {
+		// the last frame is padded with silence
+		n := copy(frame, samples[start:])
+		clear(frame[n:])
+
+		size, err := enc.EncodeFloat32(frame, packet)
+		if err != nil {
+			return nil, err
+		}
+		if err := ogg.WritePacket(packet[:size], voiceFrameSize); err != nil {
+			return nil, err
+		}
+	}
+	if err := ogg.Close(); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
+}
+
+// textToVoice turns a reply into an Ogg Opus voice note and its duration in seconds
+func (s *Server) textToVoice(answer string) ([]byte, int, error) {
+	text := speechText(answer)
+	if text == "" {
+		return nil, 0, fmt.Errorf("nothing to speak")
+	}
+
+	wav, err := s.synthesize(text)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err := audio.NewReader(bytes.NewReader(wav))
+	if err != nil {
+		return nil, 0, err
+	}
+	samples, err := r.ReadAll()
+	if err != nil {
+		return nil, 0, err
+	}
+	samples, err = audio.Resample(audio.Downmix(samples, r.Format.Channels), r.Format.SampleRate, voiceSampleRate)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ogg, err := encodeVoice(samples)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ogg, (len(samples) + voiceSampleRate - 1) / voiceSampleRate, nil
+}
+
+// sendVoiceReply sends the reply as a voice note when voice mode is on
+func (s *Server) sendVoiceReply(chat *Chat, answer string, c tele.Context) {
+	if !chat.Voice || s.conf.TTSEndpoint == "" {
+		return
+	}
+	_ = c.Notify(tele.RecordingAudio)
+
+	ogg, duration, err := s.textToVoice(answer)
+	if err != nil {
+		Log.WithField("user", c.Sender().Username).Warn("Voice reply failed: ", err)
+		return
+	}
+
+	voice := &tele.Voice{
+		File:     tele.FromReader(bytes.NewReader(ogg)),
+		Duration: duration,
+		MIME:     "audio/ogg",
+	}
+	if _, err := c.Bot().Send(c.Chat(), voice, replyOptions(c, "")); err != nil {
+		Log.Warn("Failed to send voice reply: ", err)
+	}
+}
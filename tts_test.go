@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/tectiv3/chatgpt-bot/opus"
+)
+
+func TestEncodeVoice(t *testing.T) {
+	enc, err := opus.NewEncoder(voiceSampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookahead, err := enc.Lookahead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, length := range []int{1, voiceFrameSize, voiceSampleRate + 123} {
+		voice, err := encodeVoice(make([]float32, length))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stream, err := opus.NewStream(bytes.NewReader(voice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := 0
+		pcm := make([]int16, 5760)
+		for {
+			n, err := stream.Read(pcm)
+			decoded += n
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = stream.Close()
+
+		// the tail is kept, padded to a whole frame
+		frames := (length + lookahead + voiceFrameSize - 1) / voiceFrameSize
+		if want := frames*voiceFrameSize - lookahead; decoded != want {
+			t.Errorf("%d samples decoded to %d, want %d", length, decoded, want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tectiv3/chatgpt-bot/i18n"
+)
+
+// ModelPricing holds model prices in USD per million tokens
+type ModelPricing struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cache_read,omitempty"`
+	CacheWrite float64 `json:"cache_write,omitempty"`
+}
+
+// Cost returns the price of the usage in USD
+func (p ModelPricing) Cost(usage *TokenUsage) float64 {
+	return (float64(usage.InputTokens)*p.Input +
+		float64(usage.OutputTokens)*p.Output +
+		float64(usage.CacheReadTokens)*p.CacheRead +
+		float64(usage.CacheCreationTokens)*p.CacheWrite) / 1_000_000
+}
+
+// UsageRecord is a ledger entry for a single API call
+type UsageRecord struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	// ChatID is 0 for calls made outside a chat, like inline queries and the
+	// titles of threads not created yet
+	UserID              uint    `gorm:"index" json:"user_id"`
+	ChatID              int64   `gorm:"index" json:"chat_id"`
+	ThreadID            *string `json:"thread_id,omitempty"`
+	ModelName           string  `gorm:"size:100" json:"model"`
+	InputTokens         int     `json:"input_tokens"`
+	OutputTokens        int     `json:"output_tokens"`
+	CacheReadTokens     int     `json:"cache_read_tokens"`
+	CacheCreationTokens int     `json:"cache_creation_tokens"`
+	Cost                float64 `json:"cost"`
+}
+
+// UsageTotals aggregates usage records
+type UsageTotals struct {
+	Calls               int     `json:"calls"`
+	InputTokens         int     `json:"input_tokens"`
+	OutputTokens        int     `json:"output_tokens"`
+	CacheReadTokens     int     `json:"cache_read_tokens"`
+	CacheCreationTokens int     `json:"cache_creation_tokens"`
+	Cost                float64 `json:"cost"`
+}
+
+func (t *UsageTotals) add(r UsageRecord) {
+	t.Calls++
+	t.InputTokens += r.InputTokens
+	t.OutputTokens += r.OutputTokens
+	t.CacheReadTokens += r.CacheReadTokens
+	t.CacheCreationTokens += r.CacheCreationTokens
+	t.Cost += r.Cost
+}
+
+type ModelUsage struct {
+	Model string `json:"model"`
+	UsageTotals
+}
+
+type DayUsage struct {
+	Day string `json:"day"`
+	UsageTotals
+}
+
+// UsageSummary is the spend of a user in a period, by model and by day
+type UsageSummary struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	Total   UsageTotals  `json:"total"`
+	Budget  float64      `json:"budget"` // 0 means unlimited
+	ByModel []ModelUsage `json:"by_model"`
+	ByDay   []DayUsage   `json:"by_day"`
+}
+
+// recordUsage stores a ledger entry for one API call of the chat
+func (s *Server) recordUsage(chat *Chat, model *AiModel, usage *TokenUsage) {
+	record := UsageRecord{
+		ModelName:           model.Name,
+		InputTokens:         usage.InputTokens,
+		OutputTokens:        usage.OutputTokens,
+		CacheReadTokens:     usage.CacheReadTokens,
+		CacheCreationTokens: usage.CacheCreationTokens,
+		Cost:                model.Pricing.Cost(usage),
+	}
+	if chat != nil {
+		record.UserID = chat.payerID()
+		record.ChatID = chat.ChatID
+		record.ThreadID = chat.ThreadID
+	}
+
+	if err := s.db.Create(&record).Error; err != nil {
+		Log.WithField("error", err).Error("Failed to record usage")
+	}
+}
+
+// startOfMonth returns midnight of the first day of t's month
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// getUserBudget returns the monthly budget of the user in USD, 0 means unlimited
+func (s *Server) getUserBudget(userID uint) float64 {
+	var user User
+	if err := s.db.First(&user, userID).Error; err == nil && user.MonthlyBudget != nil {
+		return *user.MonthlyBudget
+	}
+
+	return s.conf.MonthlyBudget
+}
+
+// getMonthlySpend returns the user's spend in USD since the start of the month
+func (s *Server) getMonthlySpend(userID uint) float64 {
+	var spend float64
+	s.db.Model(&UsageRecord{}).
+		Where("user_id = ? AND created_at >= ?", userID, startOfMonth(time.Now())).
+		Select("COALESCE(SUM(cost), 0)").
+		Scan(&spend)
+
+	return spend
+}
+
+// checkBudget returns an error when the user has used up the monthly budget
+func (s *Server) checkBudget(userID uint) error {
+	budget := s.getUserBudget(userID)
+	if budget <= 0 {
+		return nil
+	}
+
+	if spend := s.getMonthlySpend(userID); spend >= budget {
+		return fmt.Errorf("monthly budget of $%.2f exceeded (spent $%.2f)", budget, spend)
+	}
+
+	return nil
+}
+
+// getUsageSummary aggregates the user's ledger between from and to,
+// limited to one chat or thread when chatID is not 0
+func (s *Server) getUsageSummary(userID uint, chatID int64, from, to time.Time) UsageSummary {
+	var records []UsageRecord
+	query := s.db.Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, from, to)
+	if chatID != 0 {
+		query = query.Where("chat_id = ?", chatID)
+	}
+	query.Order("created_at ASC").Find(&records)
+
+	summary := UsageSummary{
+		From:    from,
+		To:      to,
+		Budget:  s.getUserBudget(userID),
+		ByModel: []ModelUsage{},
+		ByDay:   []DayUsage{},
+	}
+	models := make(map[string]*ModelUsage)
+	days := make(map[string]*DayUsage)
+	for _, r := range records {
+		summary.Total.add(r)
+
+		if models[r.ModelName] == nil {
+			models[r.ModelName] = &ModelUsage{Model: r.ModelName}
+		}
+		models[r.ModelName].add(r)
+
+		day := r.CreatedAt.In(from.Location()).Format("2006-01-02")
+		if days[day] == nil {
+			days[day] = &DayUsage{Day: day}
+		}
+		days[day].add(r)
+	}
+
+	for _, m := range models {
+		summary.ByModel = append(summary.ByModel, *m)
+	}
+	sort.Slice(summary.ByModel, func(i, j int) bool {
+		return summary.ByModel[i].Cost > summary.ByModel[j].Cost
+	})
+	for _, d := range days {
+		summary.ByDay = append(summary.ByDay, *d)
+	}
+	sort.Slice(summary.ByDay, func(i, j int) bool {
+		return summary.ByDay[i].Day < summary.ByDay[j].Day
+	})
+
+	return summary
+}
+
+// formatUsage renders a usage summary for Telegram
+func (s *Server) formatUsage(chat *Chat, summary UsageSummary) string {
+	var b strings.Builder
+	b.WriteString(chat.t("Usage since {{.date}}", &i18n.Replacements{"date": summary.From.Format("2006-01-02")}))
+	b.WriteString(fmt.Sprintf("\n$%.4f", summary.Total.Cost))
+	if summary.Budget > 0 {
+		b.WriteString(fmt.Sprintf(" / $%.2f", summary.Budget))
+	}
+	b.WriteString(fmt.Sprintf(" (%d)\n", summary.Total.Calls))
+
+	if len(summary.ByModel) > 0 {
+		b.WriteString("\n" + chat.t("By model:") + "\n")
+		for _, m := range summary.ByModel {
+			b.WriteString(fmt.Sprintf("%s: $%.4f, in %d / out %d\n", m.Model, m.Cost, m.InputTokens+m.CacheReadTokens+m.CacheCreationTokens, m.OutputTokens))
+		}
+	}
+	if len(summary.ByDay) > 0 {
+		b.WriteString("\n" + chat.t("By day:") + "\n")
+		for _, d := range summary.ByDay {
+			b.WriteString(fmt.Sprintf("%s: $%.4f (%d)\n", d.Day, d.Cost, d.Calls))
+		}
+	}
+
+	return b.String()
+}
+
+// getUsage returns the user's spend for a month, by model and by day.
+// The month defaults to the current one and can be set with ?month=YYYY-MM,
+// ?thread_id= limits the summary to one thread.
+func (s *Server) getUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	user := getUserFromContext(r)
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	from := startOfMonth(time.Now())
+	if month := r.URL.Query().Get("month"); month != "" {
+		parsed, err := time.ParseInLocation("2006-01", month, time.Local)
+		if err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, "Invalid month, expected YYYY-MM")
+			return
+		}
+		from = parsed
+	}
+
+	var chatID int64
+	if threadID := r.URL.Query().Get("thread_id"); threadID != "" {
+		var chat Chat
+		if err := s.db.Where("user_id = ? AND thread_id = ?", user.ID, threadID).First(&chat).Error; err != nil {
+			s.writeJSONError(w, http.StatusNotFound, "Thread not found")
+			return
+		}
+		chatID = chat.ChatID
+	}
+
+	s.writeJSON(w, http.StatusOK, s.getUsageSummary(user.ID, chatID, from, from.AddDate(0, 1, 0)))
+}
@@ -126,6 +126,42 @@ func ValidateTemperature(tempStr string) (float64, error) {
 	return temp, nil
 }
 
+// ValidateBudget validates a monthly budget in USD, 0 means unlimited
+func ValidateBudget(budgetStr string) (float64, error) {
+	if budgetStr == "" {
+		return 0, fmt.Errorf("%w: budget cannot be empty", ErrInvalidInput)
+	}
+
+	budget, err := strconv.ParseFloat(budgetStr, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: budget must be a number", ErrInvalidFormat)
+	}
+
+	if budget < 0 {
+		return 0, fmt.Errorf("%w: budget cannot be negative", ErrInvalidRange)
+	}
+
+	return budget, nil
+}
+
+// ValidateThinkingBudget validates an extended thinking budget in tokens, 0 means model default
+func ValidateThinkingBudget(budgetStr string) (int, error) {
+	if budgetStr == "" {
+		return 0, fmt.Errorf("%w: thinking budget cannot be empty", ErrInvalidInput)
+	}
+
+	budget, err := strconv.Atoi(budgetStr)
+	if err != nil {
+		return 0, fmt.Errorf("%w: thinking budget must be a number", ErrInvalidFormat)
+	}
+
+	if budget != 0 && (budget < minThinkingBudget || budget > maxThinkingBudget) {
+		return 0, fmt.Errorf("%w: thinking budget must be 0 or between %d and %d", ErrInvalidRange, minThinkingBudget, maxThinkingBudget)
+	}
+
+	return budget, nil
+}
+
 // ValidateLanguageCode validates language code input
 func ValidateLanguageCode(lang string) error {
 	if lang == "" {
@@ -1,200 +1,461 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
-	"net/http"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/tectiv3/chatgpt-bot/audio"
+	"github.com/tectiv3/chatgpt-bot/i18n"
 	"github.com/tectiv3/chatgpt-bot/opus"
 	tele "gopkg.in/telebot.v3"
 )
 
-func convertToWav(r io.Reader) ([]byte, error) {
-	output := new(bytes.Buffer)
-	wavWriter, err := newWavWriter(output, 48000, 1, 16)
-	if err != nil {
-		return nil, err
+const (
+	// whisperSampleRate is the rate Whisper models work at, servers resample
+	// anything else themselves
+	whisperSampleRate = 16000
+	// transcriptionChunk is the length long recordings are split into for
+	// transcribe, each cut moved to the quietest point of chunkSearchWindow
+	// before it so words are not split
+	transcriptionChunk = 5 * time.Minute
+	chunkSearchWindow  = 5 * time.Second
+	// transcripts longer than this are sent as a file
+	maxInlineTranscript = 3500
+	// Bot API downloads are limited to 20MB, a local server has no such limit
+	maxAudioFileSize      = 20 * 1024 * 1024
+	maxLocalAudioFileSize = 1024 * 1024 * 1024
+)
+
+var (
+	errNoFFmpeg         = errors.New("ffmpeg is required for this audio format")
+	errUnsupportedAudio = errors.New("unsupported audio format")
+)
+
+// audioExtensions are documents transcribed instead of read as text
+var audioExtensions = []string{".mp3", ".m4a", ".aac", ".ogg", ".oga", ".opus", ".wav", ".flac", ".webm", ".mp4", ".mov"}
+
+// transcriptPart is the text of a recording starting at Start
+type transcriptPart struct {
+	Start time.Duration
+	Text  string
+}
+
+// isAudioDocument reports whether a document should be transcribed
+func isAudioDocument(doc *tele.Document) bool {
+	if strings.HasPrefix(doc.MIME, "audio/") || strings.HasPrefix(doc.MIME, "video/") {
+		return true
 	}
+	return in_array(strings.ToLower(filepath.Ext(doc.FileName)), audioExtensions)
+}
 
-	s, err := opus.NewStream(r)
-	if err != nil {
-		return nil, err
+// handleVoice transcribes a voice message or video note and answers it, or
+// runs it when it is a voice command
+func (s *Server) handleVoice(c tele.Context) {
+	var file tele.File
+	switch {
+	case c.Message().Voice != nil:
+		file = c.Message().Voice.File
+	case c.Message().VideoNote != nil:
+		file = c.Message().VideoNote.File
+	}
+	if file.FileSize == 0 {
+		return
 	}
-	defer s.Close()
 
-	pcmbuf := make([]float32, 16384)
-	for {
-		n, err := s.ReadFloat32(pcmbuf)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		pcm := pcmbuf[:n*1]
+	transcript, ok := s.handleAudio(c, file)
+	if !ok {
+		return
+	}
 
-		err = wavWriter.WriteSamples(pcm)
-		if err != nil {
-			return nil, err
-		}
+	// Forwarded voice — transcript only, no AI reply
+	if c.Message().IsForwarded() {
+		return
 	}
 
-	// Patch WAV header sizes now that we know the total data length
-	buf := output.Bytes()
-	dataSize := uint32(len(buf) - 44) // 44 = WAV header size
-	binary.LittleEndian.PutUint32(buf[4:8], dataSize+36)
-	binary.LittleEndian.PutUint32(buf[40:44], dataSize)
+	chat := s.getChat(c)
+	if cmd, arg := chat.matchVoiceCommand(transcript); cmd != nil && s.runVoiceCommand(c, chat, cmd, arg) {
+		return
+	}
+
+	s.complete(c, transcript)
+}
+
+// handleAudioFile transcribes an audio file or document. A caption is taken as
+// a question about the recording.
+func (s *Server) handleAudioFile(c tele.Context, file tele.File) {
+	transcript, ok := s.handleAudio(c, file)
+	if !ok || c.Message().Caption == "" || c.Message().IsForwarded() {
+		return
+	}
 
-	return buf, nil
+	s.complete(c, c.Message().Caption+"\n\n"+transcript)
 }
 
-func newWavWriter(w io.Writer, sampleRate int, numChannels int, bitsPerSample int) (*wavWriter, error) {
-	var header wavHeader
+// handleAudio downloads and transcribes a recording, replying with the
+// transcript. It returns the plain transcript and false when it failed.
+func (s *Server) handleAudio(c tele.Context, file tele.File) (string, bool) {
+	chat := s.getChat(c)
+	logger := Log.WithField("user", c.Sender().Username)
 
-	header.RIFFID = [4]byte{'R', 'I', 'F', 'F'}
-	header.WAVEID = [4]byte{'W', 'A', 'V', 'E'}
-	header.FMTID = [4]byte{'f', 'm', 't', ' '}
-	header.Subchunk1Size = 16
-	header.AudioFormat = 1
-	header.NumChannels = uint16(numChannels)
-	header.SampleRate = uint32(sampleRate)
-	header.BitsPerSample = uint16(bitsPerSample)
-	header.ByteRate = uint32(sampleRate * numChannels * bitsPerSample / 8)
-	header.BlockAlign = uint16(numChannels * bitsPerSample / 8)
-	header.DataID = [4]byte{'d', 'a', 't', 'a'}
+	limit := int64(maxAudioFileSize)
+	if s.conf.TelegramServerURL != "" {
+		limit = maxLocalAudioFileSize
+	}
+	if file.FileSize > limit {
+		_ = c.Reply(c.Message(), chat.t("Audio file too large, the limit is {{.size}} MB", &i18n.Replacements{"size": limit / 1024 / 1024}))
+		return "", false
+	}
+	_ = c.Notify(tele.Typing)
 
-	err := binary.Write(w, binary.LittleEndian, &header)
+	path, cleanup, err := s.downloadFile(c, file)
 	if err != nil {
-		return nil, err
+		logger.Warn("Error downloading audio: ", err)
+		_ = c.Send("Voice error: failed to download audio")
+		return "", false
+	}
+	defer cleanup()
+
+	parts, err := s.transcribeFile(path, chat.Lang)
+	if err != nil {
+		logger.Warn("failed to transcribe: ", err)
+		if errors.Is(err, errNoFFmpeg) || errors.Is(err, errUnsupportedAudio) {
+			_ = c.Reply(c.Message(), chat.t("Unsupported audio format"))
+		} else {
+			_ = c.Send("Voice error: transcription failed")
+		}
+		return "", false
+	}
+	if len(parts) == 0 {
+		_ = c.Reply(c.Message(), chat.t("No speech recognized"))
+		return "", false
 	}
 
-	return &wavWriter{w: w}, nil
+	texts := make([]string, len(parts))
+	for i, p := range parts {
+		texts[i] = p.Text
+	}
+	transcript := strings.Join(texts, " ")
+
+	if len(transcript) > maxInlineTranscript {
+		// Long recordings get a timestamped transcript file
+		var b strings.Builder
+		for _, p := range parts {
+			b.WriteString(fmt.Sprintf("[%s] %s\n\n", formatTimestamp(p.Start), p.Text))
+		}
+		_, _ = c.Bot().Send(c.Recipient(), &tele.Document{
+			File:     tele.FromReader(strings.NewReader(b.String())),
+			FileName: fmt.Sprintf("transcript_%d.txt", time.Now().Unix()),
+			MIME:     "text/plain",
+			Caption:  chat.t("Transcript"),
+		}, &tele.SendOptions{ReplyTo: c.Message()})
+	} else {
+		// Always show transcript as a separate reply
+		transcriptText := fmt.Sprintf("_Transcript:_\n\n%s", transcript)
+		_, _ = c.Bot().Send(c.Recipient(), transcriptText, "text", &tele.SendOptions{
+			ReplyTo:   c.Message(),
+			ParseMode: tele.ModeMarkdown,
+		})
+	}
+
+	return transcript, true
 }
 
-func (ww *wavWriter) WriteSamples(samples []float32) error {
-	int16Samples := make([]int16, len(samples))
-	for i, s := range samples {
-		if s > 1.0 {
-			s = 1.0
-		} else if s < -1.0 {
-			s = -1.0
+// downloadFile makes a Telegram file available locally, the cleanup function
+// removes it unless it belongs to the local Bot API server
+func (s *Server) downloadFile(c tele.Context, file tele.File) (string, func(), error) {
+	if s.conf.TelegramServerURL != "" {
+		f, err := c.Bot().FileByID(file.FileID)
+		if err != nil {
+			return "", nil, err
 		}
-		int16Samples[i] = int16(s * 32767)
+		return f.FilePath, func() {}, nil
+	}
+
+	out, err := os.CreateTemp("", "audio-*")
+	if err != nil {
+		return "", nil, err
+	}
+	out.Close()
+	cleanup := func() { os.Remove(out.Name()) }
+	if err := c.Bot().Download(&file, out.Name()); err != nil {
+		cleanup()
+		return "", nil, err
 	}
-	return binary.Write(ww.w, binary.LittleEndian, &int16Samples)
+
+	return out.Name(), cleanup, nil
 }
 
-func (s *Server) handleVoice(c tele.Context) {
-	if c.Message().Voice.FileSize == 0 {
-		return
+// formatTimestamp renders an offset as h:mm:ss, or m:ss under an hour
+func formatTimestamp(d time.Duration) string {
+	sec := int(d.Seconds())
+	if sec >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", sec/3600, sec/60%60, sec%60)
 	}
-	audioFile := c.Message().Voice.File
-	var reader io.ReadCloser
-	var err error
+	return fmt.Sprintf("%d:%02d", sec/60, sec%60)
+}
 
-	if s.conf.TelegramServerURL != "" {
-		f, err := c.Bot().FileByID(audioFile.FileID)
+// transcribeFile decodes a recording and transcribes it chunk by chunk.
+// Segment times are made relative to the start of the recording; backends
+// without segments give one part per chunk.
+func (s *Server) transcribeFile(path, lang string) ([]transcriptPart, error) {
+	stt := s.getSTT()
+	opts := TranscribeOptions{Language: sttLanguage(lang)}
+	var parts []transcriptPart
+	chunker := &audioChunker{emit: func(samples []float32, start time.Duration) error {
+		t, err := s.transcribeSamples(stt, samples, opts)
 		if err != nil {
-			Log.Warn("Error getting file ID", "error=", err)
-			_ = c.Send("Voice error: failed to get file ID")
-			return
+			return err
 		}
-		reader, err = os.Open(f.FilePath)
-		if err != nil {
-			Log.Warn("Error opening file", "error=", err)
-			_ = c.Send("Voice error: failed to open audio file")
-			return
+		if t.Text == "" {
+			return nil
 		}
-	} else {
-		reader, err = c.Bot().File(&audioFile)
-		if err != nil {
-			Log.Warn("Error getting file content", "error=", err)
-			_ = c.Send("Voice error: failed to download audio")
-			return
+		// the previous chunk gives context across the cut
+		opts.Prompt = sttPrompt(t.Text)
+
+		if len(t.Segments) == 0 {
+			parts = append(parts, transcriptPart{Start: start, Text: t.Text})
 		}
+		for _, seg := range t.Segments {
+			parts = append(parts, transcriptPart{Start: start + seg.Start, Text: seg.Text})
+		}
+		return nil
+	}}
+
+	if err := s.decodeAudioFile(path, chunker.Write); err != nil {
+		return nil, err
+	}
+	if err := chunker.Close(); err != nil {
+		return nil, err
 	}
-	defer reader.Close()
 
-	wav, err := convertToWav(reader)
+	return parts, nil
+}
+
+// transcribeSamples writes 16 kHz samples to a WAV temp file for the backend
+func (s *Server) transcribeSamples(stt SpeechToText, samples []float32, opts TranscribeOptions) (*Transcription, error) {
+	f, err := os.CreateTemp("", "voice-*.wav")
 	if err != nil {
-		Log.Warn("failed to convert to wav", "error=", err)
-		_ = c.Send("Voice error: failed to convert audio")
-		return
+		return nil, err
 	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
-	transcript, err := s.transcribe(wav)
+	wav, err := audio.NewWriter(f, whisperSampleRate, 1)
 	if err != nil {
-		Log.Warn("failed to transcribe", "error=", err)
-		_ = c.Send("Voice error: transcription failed")
-		return
+		return nil, err
+	}
+	if err := wav.Write(samples); err != nil {
+		return nil, err
+	}
+	if err := wav.Close(); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
 
-	if strings.HasPrefix(strings.ToLower(transcript), "reset") {
-		chat := s.getChat(c.Chat(), c.Sender())
-		s.deleteHistory(chat.ID)
-		return
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	return stt.Transcribe(ctx, f, opts)
+}
+
+// decodeAudioFile streams a recording as 16 kHz mono samples into write.
+// Ogg Opus and WAV are decoded in process, anything else goes through ffmpeg.
+func (s *Server) decodeAudioFile(path string, write func([]float32) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	// Always show transcript as a separate reply
-	transcriptText := fmt.Sprintf("_Transcript:_\n\n%s", transcript)
-	_, _ = c.Bot().Send(c.Recipient(), transcriptText, "text", &tele.SendOptions{
-		ReplyTo:   c.Message(),
-		ParseMode: tele.ModeMarkdown,
-	})
+	magic := make([]byte, 12)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 
-	// Forwarded voice — transcript only, no AI reply
-	if c.Message().IsForwarded() {
-		return
+	switch {
+	case len(magic) >= 4 && string(magic[:4]) == "OggS":
+		// Vorbis and other codecs in Ogg fall back to ffmpeg
+		if err := decodeOpus(f, write); !errors.Is(err, errNotOpus) {
+			return err
+		}
+	case len(magic) >= 12 && string(magic[:4]) == "RIFF" && string(magic[8:12]) == "WAVE":
+		return decodeWav(f, write)
 	}
 
-	s.complete(c, transcript)
+	return s.decodeFFmpeg(path, write)
 }
 
-// transcribe sends WAV audio to the configured whisper endpoint
-func (s *Server) transcribe(wav []byte) (string, error) {
-	if s.conf.WhisperEndpoint == "" {
-		return "", fmt.Errorf("whisper_endpoint not configured")
+var errNotOpus = errors.New("not an Ogg Opus stream")
+
+func decodeOpus(r io.Reader, write func([]float32) error) error {
+	stream, err := opus.NewStream(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotOpus, err)
 	}
+	defer stream.Close()
 
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-	part, err := writer.CreateFormFile("file", "audio.wav")
+	resampler, err := audio.NewResampler(48000, whisperSampleRate)
 	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
+		return err
 	}
-	if _, err := part.Write(wav); err != nil {
-		return "", fmt.Errorf("failed to write audio: %w", err)
+
+	pcmbuf := make([]float32, 16384)
+	for {
+		n, err := stream.ReadFloat32(pcmbuf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		channels := stream.Channels()
+		if err := write(resampler.Process(audio.Downmix(pcmbuf[:n*channels], channels))); err != nil {
+			return err
+		}
 	}
-	writer.Close()
 
-	resp, err := http.Post(s.conf.WhisperEndpoint, writer.FormDataContentType(), &body)
+	return write(resampler.Flush())
+}
+
+func decodeWav(r io.Reader, write func([]float32) error) error {
+	wav, err := audio.NewReader(bufio.NewReader(r))
 	if err != nil {
-		return "", fmt.Errorf("whisper request failed: %w", err)
+		return err
+	}
+	resampler, err := audio.NewResampler(wav.Format.SampleRate, whisperSampleRate)
+	if err != nil {
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("whisper returned %d: %s", resp.StatusCode, string(respBody))
+	pcmbuf := make([]float32, 8192*wav.Format.Channels)
+	for {
+		n, err := wav.Read(pcmbuf)
+		if n > 0 {
+			if err := write(resampler.Process(audio.Downmix(pcmbuf[:n], wav.Format.Channels))); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
 	}
 
-	var result struct {
-		Text string `json:"text"`
+	return write(resampler.Flush())
+}
+
+// decodeFFmpeg converts any format ffmpeg knows, video included, to 16 kHz
+// mono WAV on its stdout
+func (s *Server) decodeFFmpeg(path string, write func([]float32) error) error {
+	bin := s.conf.FFmpegPath
+	if bin == "" {
+		bin = "ffmpeg"
 	}
-	respBody, err := io.ReadAll(resp.Body)
+	bin, err := exec.LookPath(bin)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return errNoFFmpeg
 	}
 
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		// Fallback: treat as plain text
-		return strings.TrimSpace(string(respBody)), nil
+	cmd := exec.Command(bin, "-nostdin", "-loglevel", "error", "-i", path,
+		"-vn", "-ac", "1", "-ar", fmt.Sprint(whisperSampleRate), "-f", "wav", "-")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	decodeErr := decodeWav(stdout, write)
+	if decodeErr != nil {
+		// unblock ffmpeg if we stopped reading early
+		_ = cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+
+	switch {
+	case errors.Is(decodeErr, audio.ErrNotWav):
+		// ffmpeg produced no output
+		return fmt.Errorf("%w: %s", errUnsupportedAudio, strings.TrimSpace(stderr.String()))
+	case decodeErr != nil:
+		return decodeErr
+	case waitErr != nil:
+		return fmt.Errorf("ffmpeg failed: %v: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// audioChunker splits a 16 kHz mono stream into transcriptionChunk pieces
+type audioChunker struct {
+	buf []float32
+	// samples emitted before buf[0]
+	offset int64
+	emit   func(samples []float32, start time.Duration) error
+}
+
+func (ac *audioChunker) Write(samples []float32) error {
+	ac.buf = append(ac.buf, samples...)
+	limit := int(transcriptionChunk.Seconds()) * whisperSampleRate
+	for len(ac.buf) >= limit {
+		window := int(chunkSearchWindow.Seconds()) * whisperSampleRate
+		if err := ac.flush(quietestPoint(ac.buf[:limit], window)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close emits the rest of the stream
+func (ac *audioChunker) Close() error {
+	if len(ac.buf) == 0 {
+		return nil
+	}
+	return ac.flush(len(ac.buf))
+}
+
+func (ac *audioChunker) flush(n int) error {
+	start := time.Duration(ac.offset) * time.Second / whisperSampleRate
+	if err := ac.emit(ac.buf[:n], start); err != nil {
+		return err
+	}
+	ac.offset += int64(n)
+	ac.buf = append(ac.buf[:0], ac.buf[n:]...)
+
+	return nil
+}
+
+// quietestPoint returns the middle of the 50 ms frame with the least energy
+// within the last window samples
+func quietestPoint(samples []float32, window int) int {
+	const frame = whisperSampleRate / 20
+	best, bestEnergy := len(samples), math.MaxFloat64
+	for start := max(0, len(samples)-window); start+frame <= len(samples); start += frame {
+		var energy float64
+		for _, s := range samples[start : start+frame] {
+			energy += float64(s) * float64(s)
+		}
+		if energy < bestEnergy {
+			best, bestEnergy = start+frame/2, energy
+		}
 	}
 
-	return result.Text, nil
+	return best
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tectiv3/chatgpt-bot/i18n"
+	tele "gopkg.in/telebot.v3"
+)
+
+// voice command actions
+const (
+	voiceNewConversation = "new"
+	voiceSwitchModel     = "model"
+	voiceSwitchRole      = "role"
+	voiceTranslate       = "translate"
+	voiceRepeat          = "repeat"
+)
+
+// voiceCommand maps spoken phrases to a bot action. Phrases is an i18n key
+// listing the English phrases separated by "|", its translation lists the
+// phrases for the chat language. English phrases work in every language.
+type voiceCommand struct {
+	action  string
+	phrases string
+	// commands with an argument match a phrase followed by more words
+	arg bool
+}
+
+var voiceCommands = []voiceCommand{
+	{action: voiceNewConversation, phrases: "new conversation|new chat|start over|reset"},
+	{action: voiceSwitchModel, phrases: "switch model to|switch to model|change model to|use model", arg: true},
+	{action: voiceSwitchRole, phrases: "switch role to|switch to role|change role to|use role", arg: true},
+	{action: voiceTranslate, phrases: "translate last answer to|translate the last answer to|translate the answer to|translate to", arg: true},
+	{action: voiceRepeat, phrases: "repeat|say again|say it again|repeat last answer|repeat the last answer"},
+}
+
+var (
+	btnVoiceConfirm = tele.Btn{Unique: "btnVoiceCmd"}
+	btnVoiceCancel  = tele.Btn{Unique: "btnVoiceCmd", Data: "cancel"}
+)
+
+// voicePhrases returns the normalized phrases of a command in English and
+// the chat language, longest first
+func (c *Chat) voicePhrases(cmd voiceCommand) []string {
+	var phrases []string
+	for _, p := range strings.Split(cmd.phrases+"|"+c.t(cmd.phrases), "|") {
+		if p = normalizeTranscript(p); p != "" && !in_array(p, phrases) {
+			phrases = append(phrases, p)
+		}
+	}
+	sort.Slice(phrases, func(i, j int) bool { return len(phrases[i]) > len(phrases[j]) })
+
+	return phrases
+}
+
+// matchVoiceCommand finds the command a transcript consists of and its argument
+func (c *Chat) matchVoiceCommand(transcript string) (*voiceCommand, string) {
+	text := normalizeTranscript(transcript)
+	for i, cmd := range voiceCommands {
+		for _, p := range c.voicePhrases(cmd) {
+			if !cmd.arg && text == p {
+				return &voiceCommands[i], ""
+			}
+			if arg, ok := strings.CutPrefix(text, p+" "); cmd.arg && ok {
+				return &voiceCommands[i], arg
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// lastAnswer returns the latest assistant reply in the conversation
+func (c *Chat) lastAnswer() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := len(c.History) - 1; i >= 0; i-- {
+		h := c.History[i]
+		if h.Role == "assistant" && h.Content != nil && *h.Content != "" {
+			return *h.Content
+		}
+	}
+
+	return ""
+}
+
+// runVoiceCommand carries out a spoken command. It returns false when the
+// argument names nothing known, so the transcript goes to the model instead.
+func (s *Server) runVoiceCommand(c tele.Context, chat *Chat, cmd *voiceCommand, arg string) bool {
+	logger := Log.WithField("user", c.Sender().Username)
+
+	switch cmd.action {
+	case voiceNewConversation:
+		// destructive, needs confirmation
+		confirm := btnVoiceConfirm
+		confirm.Text = chat.t("Yes")
+		confirm.Data = voiceNewConversation
+		cancel := btnVoiceCancel
+		cancel.Text = chat.t("Cancel")
+		markup := &tele.ReplyMarkup{}
+		markup.Inline(markup.Row(confirm, cancel))
+		_ = c.Reply(c.Message(), chat.t("Start a new conversation? The history will be deleted."), markup)
+
+	case voiceSwitchModel:
+		var model *AiModel
+		for i, m := range s.conf.Models {
+			if normalizeTranscript(m.Name) == arg || normalizeTranscript(m.ModelID) == arg {
+				model = &s.conf.Models[i]
+				break
+			}
+		}
+		if model == nil {
+			return false
+		}
+		logger.Info("Voice command: model ", model.Name)
+		chat.ModelName = model.Name
+		s.db.Model(&Chat{}).Where("id = ?", chat.ID).Update("model_name", model.Name)
+		_ = c.Reply(c.Message(), chat.t("Model set to {{.model}}", &i18n.Replacements{"model": model.Name}))
+
+	case voiceSwitchRole:
+		var role *Role
+		for i, r := range chat.User.Roles {
+			if normalizeTranscript(r.Name) == arg {
+				role = &chat.User.Roles[i]
+				break
+			}
+		}
+		switch {
+		case role != nil:
+			logger.Info("Voice command: role ", role.Name)
+			s.setChatRole(&role.ID, chat.ChatID)
+			_ = c.Reply(c.Message(), chat.t("Role set to {{.role}}", &i18n.Replacements{"role": role.Name}))
+		case arg == "default" || arg == normalizeTranscript(chat.t("default")):
+			logger.Info("Voice command: default role")
+			s.setChatRole(nil, chat.ChatID)
+			_ = c.Reply(c.Message(), chat.t("Role set to {{.role}}", &i18n.Replacements{"role": chat.t("default")}))
+		default:
+			return false
+		}
+
+	case voiceTranslate:
+		if chat.lastAnswer() == "" {
+			_ = c.Reply(c.Message(), chat.t("Nothing to translate"))
+			return true
+		}
+		logger.Info("Voice command: translate to ", arg)
+		s.complete(c, fmt.Sprintf("Translate your last answer to %s. Reply with the translation only.", arg))
+
+	case voiceRepeat:
+		answer := chat.lastAnswer()
+		if answer == "" {
+			_ = c.Reply(c.Message(), chat.t("Nothing to repeat"))
+			return true
+		}
+		logger.Info("Voice command: repeat")
+		s.sendFinalReply(chat, answer, nil, c)
+		s.sendVoiceReply(chat, answer, c)
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// onVoiceCommandConfirm handles the confirmation buttons of destructive voice commands
+func (s *Server) onVoiceCommandConfirm(c tele.Context) error {
+	chat := s.getChat(c)
+
+	switch c.Data() {
+	case voiceNewConversation:
+		Log.WithField("user", c.Sender().Username).Info("Voice command: new conversation")
+		s.deleteHistory(chat)
+		s.setChatLastMessageID(nil, chat.ChatID)
+		return c.Edit(chat.t("Conversation reset"))
+	default:
+		return c.Delete()
+	}
+}
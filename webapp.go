@@ -31,6 +31,8 @@ type ThreadSettings struct {
 	MasterPrompt string   `json:"master_prompt"`
 	ContextLimit int      `json:"context_limit"`
 	EnabledTools []string `json:"enabled_tools"`
+	// ThinkingBudget overrides the model's extended thinking budget, 0 means model default
+	ThinkingBudget int `json:"thinking_budget"`
 }
 
 // API request/response structures
@@ -93,6 +95,12 @@ type MessageResponse struct {
 	FinishReason   *string `json:"finish_reason,omitempty"`
 
 	Citations Citations `json:"citations,omitempty"`
+	Thinking  string    `json:"thinking,omitempty"`
+
+	// ParentID and Siblings let the frontend switch between branches,
+	// Siblings includes the message itself and is set only when there are alternatives
+	ParentID *uint  `json:"parent_id,omitempty"`
+	Siblings []uint `json:"siblings,omitempty"`
 }
 
 type ChatWithThreadResponse struct {
@@ -101,8 +109,17 @@ type ChatWithThreadResponse struct {
 }
 
 type ModelResponse struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+	Reasoning bool   `json:"reasoning"`
+}
+
+type ToolResponse struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`
+	Icon    string `json:"icon"`
+	Default bool   `json:"default"`
 }
 
 type RoleResponse struct {
@@ -134,13 +151,17 @@ func (s *Server) setupWebServer() *http.ServeMux {
 
 	mux.HandleFunc("/api/threads", s.apiMiddleware(s.handleThreads))
 	mux.HandleFunc("/api/threads/archived", s.apiMiddleware(s.getArchivedThreads))
+	mux.HandleFunc("/api/threads/import", s.apiMiddleware(s.importThread))
 	mux.HandleFunc("/api/messages", s.apiMiddleware(s.handleDraftMessages)) // Direct messages endpoint for draft threads
 	mux.HandleFunc("/api/threads/", s.apiMiddleware(s.handleThreadsWithID))
 	mux.HandleFunc("/api/models", s.apiMiddleware(s.getAvailableModels))
+	mux.HandleFunc("/api/tools", s.apiMiddleware(s.getAvailableTools))
 	mux.HandleFunc("/api/roles", s.apiMiddleware(s.handleRoles))
 	mux.HandleFunc("/api/roles/", s.apiMiddleware(s.handleRolesWithID))
 	mux.HandleFunc("/api/messages/", s.apiMiddleware(s.handleMessagesWithID)) // Message operations (delete, etc.)
 	mux.HandleFunc("/api/user", s.apiMiddleware(s.getUserInfo))
+	mux.HandleFunc("/api/usage", s.apiMiddleware(s.getUsage))
+	mux.HandleFunc("/api/search", s.apiMiddleware(s.getSearch))
 	mux.HandleFunc("/api/upload-image", s.apiMiddleware(s.handleImageUpload))
 
 	return mux
@@ -214,8 +235,20 @@ type contextKey string
 const (
 	userContextKey   contextKey = "user"
 	loggerContextKey contextKey = "logger"
+	chatContextKey   contextKey = "chat"
 )
 
+// withChat passes the chat a tool runs for to its executor
+func withChat(ctx context.Context, chat *Chat) context.Context {
+	return context.WithValue(ctx, chatContextKey, chat)
+}
+
+// chatFromContext returns the chat a tool runs for, nil when there is none
+func chatFromContext(ctx context.Context) *Chat {
+	chat, _ := ctx.Value(chatContextKey).(*Chat)
+	return chat
+}
+
 // Helper function to get logger from context
 func getLogger(ctx context.Context) *log.Entry {
 	if logger, ok := ctx.Value(loggerContextKey).(*log.Entry); ok {
@@ -363,6 +396,8 @@ func (s *Server) listThreads(w http.ResponseWriter, r *http.Request) {
 			MasterPrompt: cc.Chat.MasterPrompt,
 			ContextLimit: cc.Chat.ContextLimit,
 			EnabledTools: cc.Chat.GetEnabledToolsArray(),
+
+			ThinkingBudget: cc.Chat.ThinkingBudget,
 		}
 
 		threads[i] = ThreadResponse{
@@ -413,6 +448,8 @@ func (s *Server) getArchivedThreads(w http.ResponseWriter, r *http.Request) {
 			MasterPrompt: cc.Chat.MasterPrompt,
 			ContextLimit: cc.Chat.ContextLimit,
 			EnabledTools: cc.Chat.GetEnabledToolsArray(),
+
+			ThinkingBudget: cc.Chat.ThinkingBudget,
 		}
 
 		threads[i] = ThreadResponse{
@@ -482,7 +519,7 @@ func (s *Server) createThread(w http.ResponseWriter, r *http.Request) {
 	} else {
 		// Generate title from actual message
 		var err error
-		title, err = s.generateThreadTitle(req.InitialMessage)
+		title, err = s.generateThreadTitle(&Chat{UserID: user.ID}, req.InitialMessage)
 		if err != nil {
 			title = "New Thread" // Fallback
 		}
@@ -491,7 +528,7 @@ func (s *Server) createThread(w http.ResponseWriter, r *http.Request) {
 	// Create new chat with thread
 	chat := Chat{
 		UserID:       user.ID,
-		ChatID:       int64(user.ID)*1000 + time.Now().Unix()%1000, // Unique chat ID
+		ChatID:       newThreadChatID(),
 		ThreadID:     &threadID,
 		ThreadTitle:  &title,
 		Temperature:  1.0, // Default values
@@ -522,7 +559,12 @@ func (s *Server) createThread(w http.ResponseWriter, r *http.Request) {
 		if req.Settings.ContextLimit > 0 {
 			chat.ContextLimit = req.Settings.ContextLimit
 		}
-		chat.SetEnabledToolsFromArray(req.Settings.EnabledTools)
+		if req.Settings.ThinkingBudget > 0 {
+			chat.ThinkingBudget = req.Settings.ThinkingBudget
+		}
+		chat.SetEnabledToolsFromArray(s.tools.FilterKeys(req.Settings.EnabledTools))
+	} else {
+		chat.SetEnabledToolsFromArray(s.tools.DefaultEnabled())
 	}
 
 	if err := s.db.Create(&chat).Error; err != nil {
@@ -605,6 +647,17 @@ func (s *Server) handleThreadsWithID(w http.ResponseWriter, r *http.Request) {
 		default:
 			s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		}
+	case subPath == "/export":
+		if threadID == "" {
+			s.writeJSONError(w, http.StatusBadRequest, "Thread ID required for export")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.exportThread(w, r, threadID)
+		default:
+			s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
 	case subPath == "/archive":
 		if threadID == "" {
 			s.writeJSONError(w, http.StatusBadRequest, "Thread ID required for archive")
@@ -650,18 +703,23 @@ func (s *Server) getThreadMessages(w http.ResponseWriter, r *http.Request, threa
 		return
 	}
 
-	// Get messages
-	var messages []ChatMessage
-	query := s.db.Where("chat_id = ?", chat.ChatID)
-
-	err = query.Order("created_at ASC").Find(&messages).Error
+	messages, err := s.loadThreadMessages(s.db, &chat)
 	if err != nil {
 		s.writeJSONError(w, http.StatusInternalServerError, "Failed to fetch messages")
 		return
 	}
 
-	response := make([]MessageResponse, len(messages))
-	for i, msg := range messages {
+	s.writeJSON(w, http.StatusOK, map[string][]MessageResponse{"messages": branchMessageResponses(&chat, messages)})
+}
+
+// branchMessageResponses converts the chat's active branch for the frontend,
+// listing the alternatives of messages that have any
+func branchMessageResponses(chat *Chat, messages []ChatMessage) []MessageResponse {
+	children := messageChildren(messages)
+	branch := chat.activeBranch(messages)
+
+	response := make([]MessageResponse, len(branch))
+	for i, msg := range branch {
 		var imageData *string
 		if msg.ImagePath != nil && *msg.ImagePath != "" {
 			// Convert file path to URL path for frontend display
@@ -691,10 +749,15 @@ func (s *Server) getThreadMessages(w http.ResponseWriter, r *http.Request, threa
 			FinishReason:   msg.FinishReason,
 
 			Citations: msg.Citations,
+			Thinking:  msg.Thinking.Text(),
+			ParentID:  msg.ParentID,
+		}
+		if siblings := siblingIDs(children, msg); len(siblings) > 1 {
+			response[i].Siblings = siblings
 		}
 	}
 
-	s.writeJSON(w, http.StatusOK, map[string][]MessageResponse{"messages": response})
+	return response
 }
 
 func (s *Server) chatInThread(w http.ResponseWriter, r *http.Request, threadID string) {
@@ -711,6 +774,12 @@ func (s *Server) chatInThread(w http.ResponseWriter, r *http.Request, threadID s
 		return
 	}
 
+	if err := s.checkBudget(user.ID); err != nil {
+		logger.WithField("error", err).Warn("Budget check failed")
+		s.writeJSONError(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
+
 	// Enhanced request structure to support thread settings
 	var req struct {
 		ChatRequest
@@ -746,7 +815,7 @@ func (s *Server) chatInThread(w http.ResponseWriter, r *http.Request, threadID s
 
 		// Generate thread ID and title using first message
 		newThreadID := uuid.New().String()
-		title, err := s.generateThreadTitle(req.Message)
+		title, err := s.generateThreadTitle(&Chat{UserID: user.ID}, req.Message)
 		if err != nil {
 			title = "New Conversation" // Fallback
 		}
@@ -754,7 +823,7 @@ func (s *Server) chatInThread(w http.ResponseWriter, r *http.Request, threadID s
 		// Create new chat with thread
 		chat = Chat{
 			UserID:          user.ID,
-			ChatID:          int64(user.ID)*1000 + time.Now().Unix()%1000, // Unique chat ID
+			ChatID:          newThreadChatID(),
 			ThreadID:        &newThreadID,
 			ThreadTitle:     &title,
 			Temperature:     1.0, // Default values
@@ -784,7 +853,12 @@ func (s *Server) chatInThread(w http.ResponseWriter, r *http.Request, threadID s
 			if req.Settings.ContextLimit > 0 {
 				chat.ContextLimit = req.Settings.ContextLimit
 			}
-			chat.SetEnabledToolsFromArray(req.Settings.EnabledTools)
+			if req.Settings.ThinkingBudget > 0 {
+				chat.ThinkingBudget = req.Settings.ThinkingBudget
+			}
+			chat.SetEnabledToolsFromArray(s.tools.FilterKeys(req.Settings.EnabledTools))
+		} else {
+			chat.SetEnabledToolsFromArray(s.tools.DefaultEnabled())
 		}
 
 		if err := s.db.Create(&chat).Error; err != nil {
@@ -853,7 +927,7 @@ func (s *Server) chatInThread(w http.ResponseWriter, r *http.Request, threadID s
 	userMessage.InputTokens = &inputTokenEstimate
 
 	// Save user message to database immediately
-	if err := s.db.Create(&userMessage).Error; err != nil {
+	if err := s.appendMessage(s.db, &chat, &userMessage); err != nil {
 		logger.WithField("error", err).Error("Failed to save user message")
 		s.writeJSONError(w, http.StatusInternalServerError, "Failed to save message")
 		return
@@ -909,10 +983,12 @@ func (s *Server) updateThreadSettings(w http.ResponseWriter, r *http.Request, th
 		"lang":          settings.Lang,
 		"master_prompt": settings.MasterPrompt,
 		"context_limit": settings.ContextLimit,
+
+		"thinking_budget": settings.ThinkingBudget,
 	}
 
-	enabledToolsStr := strings.Join(settings.EnabledTools, ",")
-	updates["enabled_tools"] = enabledToolsStr
+	chat.SetEnabledToolsFromArray(s.tools.FilterKeys(settings.EnabledTools))
+	updates["enabled_tools"] = chat.EnabledTools
 
 	if err := s.db.Model(&chat).Updates(updates).Error; err != nil {
 		s.writeJSONError(w, http.StatusInternalServerError, "Failed to update settings")
@@ -1057,7 +1133,7 @@ func (s *Server) generateAndUpdateThreadTitle(w http.ResponseWriter, r *http.Req
 	}
 
 	// Generate title from conversation
-	title, err := s.generateThreadTitleFromConversation(titleReq.Question, titleReq.Response)
+	title, err := s.generateThreadTitleFromConversation(&chat, titleReq.Question, titleReq.Response)
 	if err != nil {
 		s.writeJSONError(w, http.StatusInternalServerError, "Failed to generate title")
 		return
@@ -1127,15 +1203,36 @@ func (s *Server) updateThreadTitle(w http.ResponseWriter, r *http.Request, threa
 func (s *Server) getAvailableModels(w http.ResponseWriter, r *http.Request) {
 	models := make([]ModelResponse, 0, len(s.conf.Models))
 	for _, model := range s.conf.Models {
+		provider := model.Provider
+		if provider == "" {
+			provider = providerAnthropic
+		}
 		models = append(models, ModelResponse{
-			ID:   model.ModelID,
-			Name: model.Name,
+			ID:        model.ModelID,
+			Name:      model.Name,
+			Provider:  provider,
+			Reasoning: model.Reasoning,
 		})
 	}
 
 	s.writeJSON(w, http.StatusOK, map[string][]ModelResponse{"models": models})
 }
 
+func (s *Server) getAvailableTools(w http.ResponseWriter, r *http.Request) {
+	registered := s.tools.All()
+	tools := make([]ToolResponse, 0, len(registered))
+	for _, tool := range registered {
+		tools = append(tools, ToolResponse{
+			Key:     tool.EnableKey,
+			Name:    tool.DisplayName,
+			Icon:    tool.Icon,
+			Default: tool.Default,
+		})
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string][]ToolResponse{"tools": tools})
+}
+
 // Handle /api/roles (GET and POST)
 func (s *Server) handleRoles(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -1309,7 +1406,8 @@ func (s *Server) handleDraftMessages(w http.ResponseWriter, r *http.Request) {
 	s.chatInThread(w, r, "")
 }
 
-// Handle /api/messages/{id} (DELETE) - for message operations
+// Handle /api/messages/{id} (DELETE, PUT), /api/messages/{id}/regenerate (POST),
+// /api/messages/{id}/branches (GET) and /api/messages/{id}/activate (POST)
 func (s *Server) handleMessagesWithID(w http.ResponseWriter, r *http.Request) {
 	messageIDStr := extractPathParam(r.URL.Path, "/api/messages")
 	if messageIDStr == "" {
@@ -1323,12 +1421,298 @@ func (s *Server) handleMessagesWithID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch r.Method {
-	case http.MethodDelete:
-		s.deleteMessage(w, r, uint(messageID))
+	subPath := strings.TrimPrefix(r.URL.Path, "/api/messages/"+messageIDStr)
+	switch {
+	case subPath == "/branches":
+		switch r.Method {
+		case http.MethodGet:
+			s.getMessageBranches(w, r, uint(messageID))
+		default:
+			s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case subPath == "/activate":
+		switch r.Method {
+		case http.MethodPost:
+			s.activateBranch(w, r, uint(messageID))
+		default:
+			s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case subPath == "/regenerate":
+		switch r.Method {
+		case http.MethodPost:
+			s.regenerateMessage(w, r, uint(messageID))
+		default:
+			s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	case subPath == "" || subPath == "/":
+		switch r.Method {
+		case http.MethodDelete:
+			s.deleteMessage(w, r, uint(messageID))
+		case http.MethodPut:
+			s.editMessage(w, r, uint(messageID))
+		default:
+			s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
 	default:
-		s.writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		s.writeJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// EditMessageRequest replaces the content of a user message. Mode "truncate"
+// (default) drops the message and everything after it, "branch" adds the
+// edited message as a sibling and keeps the original as another branch.
+type EditMessageRequest struct {
+	Content string `json:"content"`
+	Mode    string `json:"mode"`
+}
+
+// findUserChatMessage loads a message and its chat, verifying ownership through the chat
+func (s *Server) findUserChatMessage(tx *gorm.DB, userID, messageID uint) (*ChatMessage, *Chat, error) {
+	var message ChatMessage
+	err := tx.Joins("JOIN chats ON chat_messages.chat_id = chats.chat_id").
+		Where("chat_messages.id = ? AND chats.user_id = ?", messageID, userID).
+		First(&message).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var chat Chat
+	if err := tx.Where("chat_id = ?", message.ChatID).First(&chat).Error; err != nil {
+		return nil, nil, err
 	}
+
+	return &message, &chat, nil
+}
+
+// pruneSubtree permanently deletes the message and everything that follows it
+// on any branch, subtracting their tokens from the thread counters like
+// deleteMessage does
+func (s *Server) pruneSubtree(tx *gorm.DB, chat *Chat, messageID uint) error {
+	all, err := s.loadThreadMessages(tx, chat)
+	if err != nil {
+		return err
+	}
+
+	ids := subtreeIDs(messageChildren(all), messageID)
+	removed := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+
+	for _, msg := range all {
+		if !removed[msg.ID] {
+			continue
+		}
+		if msg.InputTokens != nil {
+			chat.TotalInputTokens = max(0, chat.TotalInputTokens-*msg.InputTokens)
+		}
+		if msg.OutputTokens != nil {
+			chat.TotalOutputTokens = max(0, chat.TotalOutputTokens-*msg.OutputTokens)
+		}
+	}
+
+	if err := tx.Model(chat).UpdateColumns(map[string]interface{}{
+		"total_input_tokens":  chat.TotalInputTokens,
+		"total_output_tokens": chat.TotalOutputTokens,
+	}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("id IN ?", ids).Delete(&ChatMessage{}).Error
+}
+
+// Regenerate an assistant answer, or the answer to a user message, from the preceding context.
+// The new answer is streamed as a sibling of the previous one, which stays available as a branch.
+func (s *Server) regenerateMessage(w http.ResponseWriter, r *http.Request, messageID uint) {
+	user := getUserFromContext(r)
+	logger := getLogger(r.Context())
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	if !s.rateLimiter.Allow(user.ID) {
+		s.writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded. Please wait before sending another message")
+		return
+	}
+
+	if err := s.checkBudget(user.ID); err != nil {
+		logger.WithField("error", err).Warn("Budget check failed")
+		s.writeJSONError(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
+
+	// The answer is streamed after the commit, so panics are passed on
+	tx := s.db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	message, chat, err := s.findUserChatMessage(tx, user.ID, messageID)
+	if err != nil {
+		tx.Rollback()
+		if err == gorm.ErrRecordNotFound {
+			s.writeJSONError(w, http.StatusNotFound, "Message not found")
+		} else {
+			s.writeJSONError(w, http.StatusInternalServerError, "Failed to find message")
+		}
+		return
+	}
+
+	all, err := s.loadThreadMessages(tx, chat)
+	if err != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to fetch messages")
+		return
+	}
+	byID := make(map[uint]ChatMessage, len(all))
+	for _, msg := range all {
+		byID[msg.ID] = msg
+	}
+
+	// The user message the new answer replies to, found by walking up the message's branch
+	var userMessage *ChatMessage
+	for msg, ok := *message, true; ok; {
+		if msg.Role == "user" && msg.ToolCallID == nil {
+			userMessage = &msg
+			break
+		}
+		if msg.ParentID == nil {
+			break
+		}
+		msg, ok = byID[*msg.ParentID]
+	}
+	if userMessage == nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusBadRequest, "No user message to answer")
+		return
+	}
+
+	if err := s.setActiveLeaf(tx, chat, &userMessage.ID); err != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to switch branch")
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to commit changes")
+		return
+	}
+
+	s.handleStreamingResponse(w, r, chat, userMessage, false)
+}
+
+// Edit a user message and stream a new answer to it
+func (s *Server) editMessage(w http.ResponseWriter, r *http.Request, messageID uint) {
+	user := getUserFromContext(r)
+	logger := getLogger(r.Context())
+	if user == nil {
+		s.writeJSONError(w, http.StatusUnauthorized, "User not found")
+		return
+	}
+
+	if !s.rateLimiter.Allow(user.ID) {
+		s.writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded. Please wait before sending another message")
+		return
+	}
+
+	if err := s.checkBudget(user.ID); err != nil {
+		logger.WithField("error", err).Warn("Budget check failed")
+		s.writeJSONError(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
+
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+
+	content, err := validateChatMessage(req.Content)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid message: %v", err))
+		return
+	}
+
+	switch req.Mode {
+	case "", "truncate", "branch":
+	default:
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid mode, expected truncate or branch")
+		return
+	}
+
+	// The answer is streamed after the commit, so panics are passed on
+	tx := s.db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	message, chat, err := s.findUserChatMessage(tx, user.ID, messageID)
+	if err != nil {
+		tx.Rollback()
+		if err == gorm.ErrRecordNotFound {
+			s.writeJSONError(w, http.StatusNotFound, "Message not found")
+		} else {
+			s.writeJSONError(w, http.StatusInternalServerError, "Failed to find message")
+		}
+		return
+	}
+
+	if message.Role != "user" || message.ToolCallID != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusBadRequest, "Only user messages can be edited")
+		return
+	}
+
+	if req.Mode != "branch" {
+		if err := s.pruneSubtree(tx, chat, message.ID); err != nil {
+			tx.Rollback()
+			s.writeJSONError(w, http.StatusInternalServerError, "Failed to remove messages")
+			return
+		}
+	}
+
+	// The edited message continues from the original's parent
+	if err := s.setActiveLeaf(tx, chat, message.ParentID); err != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to switch branch")
+		return
+	}
+	inputTokenEstimate := s.estimateTokenCount(content)
+	edited := ChatMessage{
+		ChatID:      chat.ChatID,
+		Role:        "user",
+		Content:     &content,
+		ImagePath:   message.ImagePath,
+		Filename:    message.Filename,
+		IsLive:      true,
+		MessageType: message.MessageType,
+		CreatedAt:   time.Now(),
+		ModelUsed:   &chat.ModelName,
+		InputTokens: &inputTokenEstimate,
+	}
+	if err := s.appendMessage(tx, chat, &edited); err != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to save message")
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to commit changes")
+		return
+	}
+
+	if err := s.updateThreadTokens(chat.ChatID, inputTokenEstimate, 0); err != nil {
+		logger.WithField("error", err).Warn("Failed to update thread tokens for user message")
+	}
+
+	s.handleStreamingResponse(w, r, chat, &edited, false)
 }
 
 // Permanently delete a message
@@ -1379,6 +1763,18 @@ func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request, messageID
 		chat.TotalOutputTokens = max(0, chat.TotalOutputTokens-*message.OutputTokens)
 	}
 
+	// Keep the branch connected: replies move up to the message's parent
+	if err := tx.Model(&ChatMessage{}).
+		Where("chat_id = ? AND parent_id = ?", chat.ChatID, message.ID).
+		UpdateColumn("parent_id", message.ParentID).Error; err != nil {
+		tx.Rollback()
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to delete message")
+		return
+	}
+	if chat.ActiveLeafID != nil && *chat.ActiveLeafID == message.ID {
+		chat.ActiveLeafID = message.ParentID
+	}
+
 	// Save updated chat
 	if err := tx.Save(&chat).Error; err != nil {
 		tx.Rollback()
@@ -1426,8 +1822,9 @@ func (s *Server) updateThreadTokens(chatID int64, inputTokens, outputTokens int)
 		}).Error
 }
 
-func (s *Server) generateThreadTitle(initialMessage string) (string, error) {
+func (s *Server) generateThreadTitle(chat *Chat, initialMessage string) (string, error) {
 	result, err := s.generateSimple(
+		chat,
 		"Generate a short, descriptive title (max 50 chars) for this conversation based on the user's first message. Reply with just the title, no quotes or extra text.",
 		initialMessage,
 		s.conf.Models[0].ModelID,
@@ -1447,9 +1844,10 @@ func (s *Server) generateThreadTitle(initialMessage string) (string, error) {
 	return title, nil
 }
 
-func (s *Server) generateThreadTitleFromConversation(question, response string) (string, error) {
+func (s *Server) generateThreadTitleFromConversation(chat *Chat, question, response string) (string, error) {
 	prompt := fmt.Sprintf("User: %s\nAssistant: %s\n\nGenerate a title for this conversation.", question, response)
 	result, err := s.generateSimple(
+		chat,
 		"Generate a short, descriptive title (max 50 chars) for this conversation based on the user's question and AI response. Reply with just the title, no quotes or extra text.",
 		prompt,
 		s.conf.Models[0].ModelID,
@@ -1469,178 +1867,41 @@ func (s *Server) generateThreadTitleFromConversation(question, response string)
 	return title, nil
 }
 
-// TokenUsage holds token usage information
-type TokenUsage struct {
-	InputTokens  int
-	OutputTokens int
-	TotalTokens  int
-	FinishReason string
-}
-
 // generateResponseWithStreamingUpdates streams an Anthropic response via SSE to the webapp client
 func (s *Server) generateResponseWithStreamingUpdates(ctx context.Context, chat *Chat, messages []*anthropic.Message, assistantMsg *ChatMessage, w http.ResponseWriter, flusher http.Flusher) (string, *TokenUsage, error) {
 	logger := getLogger(ctx)
-	model := s.getModel(chat.ModelName)
-	if model == nil {
-		return "", nil, fmt.Errorf("model %s not found", chat.ModelName)
-	}
+	notifier := &WebappToolCallNotifier{chat: chat, msg: assistantMsg, w: w, flusher: flusher}
+	var content strings.Builder
 
-	system := chat.MasterPrompt
-	if chat.RoleID != nil {
-		system = chat.Role.Prompt
-	}
-	system += fmt.Sprintf("\n\nCurrent date: %s", time.Now().Format("2006-01-02"))
-
-	// Build tools list
-	var tools []anthropic.ToolInterface
-	enabledTools := chat.GetEnabledToolsArray()
-	enabledToolsMap := make(map[string]bool)
-	for _, tool := range enabledTools {
-		enabledToolsMap[tool] = true
-	}
-
-	if enabledToolsMap["search"] && model.WebSearch {
-		tools = append(tools, anthropic.NewWebSearchTool(anthropic.WebSearchToolOptions{MaxUses: 5}))
-	}
-	if enabledToolsMap["summary"] {
-		tools = append(tools, s.getTools()...)
-	}
-
-	// Create a fresh client per request to avoid shared state
-	client := anthropic.New(
-		anthropic.WithAPIKey(s.conf.AnthropicAPIKey),
-		anthropic.WithModel(model.ModelID),
-		anthropic.WithSystemPrompt(system),
-		anthropic.WithMaxTokens(16384),
-	)
-
-	caching := true
-	client.Caching = &caching
-	if !model.Reasoning {
-		temp := chat.Temperature
-		client.Temperature = &temp
-	}
-
-	if len(tools) > 0 {
-		client.Apply(anthropic.WithTools(tools...))
-	}
-
-	var result strings.Builder
-	var usage *TokenUsage
-
-	// Streaming loop with tool-use continuation
-	maxToolRounds := 10
-	currentMessages := messages
-	exhausted := true
-	for round := 0; round < maxToolRounds; round++ {
-		stream, err := client.Stream(ctx, currentMessages)
-		if err != nil {
-			return result.String(), usage, fmt.Errorf("%s", friendlyAPIError(err))
-		}
-
-		accumulator := anthropic.NewResponseAccumulator()
-
-		for stream.Next() {
-			select {
-			case <-ctx.Done():
-				stream.Close()
-				return result.String(), usage, ctx.Err()
-			default:
-			}
-
-			event := stream.Event()
-			accumulator.AddEvent(event)
-
-			switch event.Type {
-			case anthropic.EventTypeContentBlockStart:
-				if event.ContentBlock != nil {
-					if event.ContentBlock.Type == anthropic.ContentTypeServerToolUse &&
-						event.ContentBlock.Name == "web_search" {
-						// Notify client about web search
-						statusContent := chat.t("Web search started, please wait...")
-						statusResponse := MessageResponse{
-							ID:          assistantMsg.ID,
-							Role:        "assistant",
-							Content:     &statusContent,
-							CreatedAt:   assistantMsg.CreatedAt,
-							IsLive:      true,
-							MessageType: "normal",
-						}
-						jsonData, _ := json.Marshal(statusResponse)
-						fmt.Fprintf(w, "data: %s\n\n", jsonData)
-						flusher.Flush()
-					} else if event.ContentBlock.Type == anthropic.ContentTypeToolUse {
-						logger.WithField("function", event.ContentBlock.Name).Info("Function call started")
-					}
-				}
-
-			case anthropic.EventTypeContentBlockDelta:
-				if event.Delta != nil && event.Delta.Type == anthropic.EventDeltaTypeText {
-					result.WriteString(event.Delta.Text)
-
-					if w != nil && flusher != nil {
-						currentContent := result.String()
-						updatedResponse := MessageResponse{
-							ID:          assistantMsg.ID,
-							Role:        "assistant",
-							Content:     &currentContent,
-							CreatedAt:   assistantMsg.CreatedAt,
-							IsLive:      true,
-							MessageType: "normal",
-						}
-						jsonData, _ := json.Marshal(updatedResponse)
-						fmt.Fprintf(w, "data: %s\n\n", jsonData)
-						flusher.Flush()
-					}
-				}
-			}
-		}
-
-		stream.Close()
-
-		if err := stream.Err(); err != nil {
-			return result.String(), usage, fmt.Errorf("%s", friendlyAPIError(err))
-		}
-
-		if !accumulator.IsComplete() {
-			return result.String(), usage, fmt.Errorf("incomplete response from Anthropic")
-		}
-
-		response := accumulator.Response()
-
-		// Extract usage
-		accUsage := accumulator.Usage()
-		if accUsage.InputTokens > 0 || accUsage.OutputTokens > 0 {
-			if usage == nil {
-				usage = &TokenUsage{}
-			}
-			usage.InputTokens += accUsage.InputTokens
-			usage.OutputTokens += accUsage.OutputTokens
-			usage.TotalTokens = usage.InputTokens + usage.OutputTokens
-		}
-		if response.StopReason != "" {
-			if usage == nil {
-				usage = &TokenUsage{}
+	result, err := s.streamAnswer(ctx, chat, messages, func(event StreamEvent) {
+		switch event.Type {
+		case StreamEventThinkingDelta:
+			if w != nil && flusher != nil {
+				writeSSE(w, flusher, map[string]interface{}{
+					"type":     "thinking",
+					"id":       assistantMsg.ID,
+					"thinking": event.Text,
+				})
 			}
-			usage.FinishReason = string(response.StopReason)
-		}
-
-		// Extract citations from text blocks
-		var citations []Citation
-		for _, content := range response.Content {
-			if tc, ok := content.(*anthropic.TextContent); ok {
-				for _, cit := range tc.Citations {
-					citations = append(citations, extractCitation(cit))
+		case StreamEventTextDelta:
+			content.WriteString(event.Text)
+			_ = notifier.SendMessage(content.String())
+		case StreamEventToolStart:
+			if event.Server {
+				if event.Tool == "web_search" {
+					_ = notifier.SendMessage(chat.t("Web search started, please wait..."))
 				}
+				return
 			}
-		}
-
-		if len(citations) > 0 {
-			s.StoreCitations(assistantMsg, citations)
-
+			logger.WithField("function", event.Tool).Info("Function call started")
+			notifier.OnFunctionCall(event.DisplayName, event.Input)
+		case StreamEventToolResult:
+			notifier.OnFunctionResult(event.DisplayName, event.Result)
+		case StreamEventCitation:
+			s.StoreCitations(assistantMsg, append(assistantMsg.Citations, event.Citations...))
 			if w != nil && flusher != nil {
-				currentContent := result.String()
-				citationResponse := MessageResponse{
+				currentContent := content.String()
+				writeSSE(w, flusher, MessageResponse{
 					ID:          assistantMsg.ID,
 					Role:        "assistant",
 					Content:     &currentContent,
@@ -1648,77 +1909,34 @@ func (s *Server) generateResponseWithStreamingUpdates(ctx context.Context, chat
 					IsLive:      true,
 					MessageType: "normal",
 					Citations:   assistantMsg.Citations,
-				}
-				jsonData, _ := json.Marshal(citationResponse)
-				fmt.Fprintf(w, "data: %s\n\n", jsonData)
-				flusher.Flush()
+				})
 			}
-		}
-
-		// Check for tool use
-		var toolUses []*anthropic.ToolUseContent
-		for _, content := range response.Content {
-			if tuc, ok := content.(*anthropic.ToolUseContent); ok {
-				toolUses = append(toolUses, tuc)
+		case StreamEventFinish:
+			if event.FinishReason == "max_tool_rounds" {
+				logger.Warn("Max tool call rounds exceeded")
 			}
 		}
+	})
 
-		if len(toolUses) == 0 {
-			exhausted = false
-			break
-		}
+	var usage *TokenUsage
+	if result.Usage.TotalTokens > 0 || result.Usage.FinishReason != "" {
+		usage = &result.Usage
+	}
 
-		// Execute tool calls and continue the conversation
-		logger.WithField("count", len(toolUses)).Info("Processing tool calls")
-
-		// Save assistant message with tool call info
-		assistantMsgContent := result.String()
-		var toolCalls ToolCalls
-		for _, tu := range toolUses {
-			toolCalls = append(toolCalls, ToolCall{
-				ID:   tu.ID,
-				Type: "function",
-				Function: ToolCallFunction{
-					Name:      tu.Name,
-					Arguments: string(tu.Input),
-				},
-			})
-		}
-		assistantMsg.ToolCalls = toolCalls
-		assistantMsg.Content = &assistantMsgContent
-		s.db.Save(assistantMsg)
-
-		// Build the assistant response message for continuation
-		var assistantContent []anthropic.Content
-		for _, content := range response.Content {
-			if content == nil {
-				continue
-			}
-			assistantContent = append(assistantContent, content)
-		}
-		currentMessages = append(currentMessages, anthropic.NewMessage("assistant", assistantContent))
-
-		// Execute each tool and collect results
-		notifier := &WebappToolCallNotifier{}
-		var toolResults []anthropic.Content
-		for _, tu := range toolUses {
-			toolResult, err := s.executeToolCall(tu, notifier)
-			if err != nil {
-				logger.WithField("error", err).WithField("tool", tu.Name).Error("Tool call failed")
-				toolResult = fmt.Sprintf("Error: %v", err)
-			}
-			toolResults = append(toolResults, &anthropic.ToolResultContent{
-				ToolUseID: tu.ID,
-				Content:   toolResult,
-			})
+	if err != nil {
+		if ctx.Err() != nil {
+			return result.Text, usage, ctx.Err()
 		}
-
-		// Add tool results as a user message
-		currentMessages = append(currentMessages, anthropic.NewMessage("user", toolResults))
+		return result.Text, usage, fmt.Errorf("%s", friendlyAPIError(err))
 	}
-	if exhausted {
-		logger.Warn("Max tool call rounds exceeded")
+
+	// Keep the tool calls on the message for reference; their results are
+	// not stored, so getDialog won't replay them
+	for _, round := range result.Rounds {
+		assistantMsg.ToolCalls = append(assistantMsg.ToolCalls, round.Calls...)
+		assistantMsg.Thinking = append(assistantMsg.Thinking, round.Thinking...)
 	}
+	assistantMsg.Thinking = append(assistantMsg.Thinking, result.Thinking...)
 
 	if usage != nil {
 		logger.WithFields(map[string]interface{}{
@@ -1728,7 +1946,7 @@ func (s *Server) generateResponseWithStreamingUpdates(ctx context.Context, chat
 		}).Debug("Streaming complete")
 	}
 
-	return result.String(), usage, nil
+	return result.Text, usage, nil
 }
 
 // Handle image upload with enhanced security and validation
@@ -1878,33 +2096,45 @@ func (s *Server) handleImageUpload(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) checkAndSummarizeContext(chat *Chat) error {
-	// Count live messages
-	var liveCount int64
-	s.db.Model(&ChatMessage{}).Where("chat_id = ? AND is_live = ?", chat.ChatID, true).Count(&liveCount)
+	all, err := s.loadThreadMessages(s.db, chat)
+	if err != nil {
+		return err
+	}
+
+	// Count live messages of the active branch
+	var liveCount int
+	for _, msg := range chat.activeBranch(all) {
+		if msg.IsLive {
+			liveCount++
+		}
+	}
 
 	// If we're approaching the context limit, summarize old messages
-	if liveCount > int64(float64(chat.ContextLimit)*0.8) { // 80% of limit
-		return s.summarizeOldMessages(chat)
+	if liveCount > int(float64(chat.ContextLimit)*0.8) { // 80% of limit
+		return s.summarizeOldMessages(chat, all)
 	}
 
 	return nil
 }
 
-func (s *Server) summarizeOldMessages(chat *Chat) error {
-	// Get oldest live messages (first half)
+func (s *Server) summarizeOldMessages(chat *Chat, all []ChatMessage) error {
+	// Get oldest live messages of the active branch (first half)
 	var messages []ChatMessage
-	err := s.db.Where("chat_id = ? AND is_live = ? AND message_type = ?",
-		chat.ChatID, true, "normal").
-		Order("created_at ASC").
-		Limit(chat.ContextLimit / 2).
-		Find(&messages).Error
+	for _, msg := range chat.activeBranch(all) {
+		if len(messages) >= chat.ContextLimit/2 {
+			break
+		}
+		if msg.IsLive && msg.MessageType == "normal" {
+			messages = append(messages, msg)
+		}
+	}
 
-	if err != nil || len(messages) == 0 {
-		return err
+	if len(messages) == 0 {
+		return nil
 	}
 
 	// Create summary of old messages
-	summary, err := s.createMessagesSummary(messages)
+	summary, err := s.createMessagesSummary(chat, messages)
 	if err != nil {
 		return err
 	}
@@ -1928,10 +2158,10 @@ func (s *Server) summarizeOldMessages(chat *Chat) error {
 		MessageType: "summary",
 	}
 
-	return s.db.Create(&summaryMessage).Error
+	return s.appendMessage(s.db, chat, &summaryMessage)
 }
 
-func (s *Server) createMessagesSummary(messages []ChatMessage) (string, error) {
+func (s *Server) createMessagesSummary(chat *Chat, messages []ChatMessage) (string, error) {
 	var conversation strings.Builder
 	for _, msg := range messages {
 		if msg.Content != nil {
@@ -1940,12 +2170,20 @@ func (s *Server) createMessagesSummary(messages []ChatMessage) (string, error) {
 	}
 
 	return s.generateSimple(
+		chat,
 		"Summarize this conversation concisely, preserving key information and context. Focus on important decisions, facts, and ongoing topics.",
 		conversation.String(),
 		s.conf.Models[0].ModelID,
 	)
 }
 
+// writeSSE sends one Server-Sent Events data frame
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, data interface{}) {
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(w, "data: %s\n\n", jsonData)
+	flusher.Flush()
+}
+
 // Handle streaming response with Server-Sent Events
 func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request, chat *Chat, userMessage *ChatMessage, isNewThread bool) {
 	logger := getLogger(r.Context())
@@ -1968,11 +2206,18 @@ func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request,
 	// Load chat with full relationships
 	s.db.Preload("User").Preload("Role").First(chat, chat.ID)
 
-	// Get live messages for context and convert to Anthropic format
+	// Get live messages of the active branch for context and convert to Anthropic format
+	all, err := s.loadThreadMessages(s.db, chat)
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to load messages")
+		return
+	}
 	var dbMessages []ChatMessage
-	s.db.Where("chat_id = ? AND is_live = ?", chat.ChatID, true).
-		Order("created_at ASC").
-		Find(&dbMessages)
+	for _, msg := range chat.activeBranch(all) {
+		if msg.IsLive {
+			dbMessages = append(dbMessages, msg)
+		}
+	}
 
 	// Store messages in chat.History so getDialog can convert them
 	chat.History = dbMessages
@@ -1987,7 +2232,7 @@ func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request,
 		MessageType: "normal",
 	}
 
-	if err := s.db.Create(&assistantMsg).Error; err != nil {
+	if err := s.appendMessage(s.db, chat, &assistantMsg); err != nil {
 		logger.WithField("error", err).Error("Failed to create assistant message")
 		return
 	}
@@ -2067,6 +2312,8 @@ func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request,
 			MasterPrompt: chat.MasterPrompt,
 			ContextLimit: chat.ContextLimit,
 			EnabledTools: chat.GetEnabledToolsArray(),
+
+			ThinkingBudget: chat.ThinkingBudget,
 		}
 
 		threadResponse := ThreadResponse{
@@ -2106,6 +2353,7 @@ func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request,
 		ResponseTimeMs: assistantMsg.ResponseTimeMs,
 		FinishReason:   assistantMsg.FinishReason,
 		Citations:      assistantMsg.Citations,
+		Thinking:       assistantMsg.Thinking.Text(),
 	}
 	jsonData, _ = json.Marshal(finalResponse)
 	fmt.Fprintf(w, "data: %s\n\n", jsonData)
@@ -2156,6 +2404,12 @@ func validateThreadSettings(settings *ThreadSettings) error {
 		return fmt.Errorf("context limit must be between 100 and 100000")
 	}
 
+	// Validate thinking budget
+	if settings.ThinkingBudget != 0 &&
+		(settings.ThinkingBudget < minThinkingBudget || settings.ThinkingBudget > maxThinkingBudget) {
+		return fmt.Errorf("thinking budget must be 0 or between %d and %d", minThinkingBudget, maxThinkingBudget)
+	}
+
 	return nil
 }
 
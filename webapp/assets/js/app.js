@@ -136,10 +136,16 @@ createApp({
             sidebarOpen: false,
             sidebarCollapsed: false, // Desktop sidebar collapse state
 
+            // Full-text search, searchResults is null when not searching
+            searchQuery: '',
+            searchResults: null,
+            searchTimer: null,
+
             // Shared data
             threads: [],
             archivedThreads: [],
             models: [],
+            tools: [],
             roles: [],
 
             // Split pane management
@@ -434,7 +440,8 @@ createApp({
                 master_prompt:
                     "You are a helpful assistant. You always try to answer truthfully. If you don't know the answer, just say that you don't know, don't try to make up an answer. Don't explain yourself. Do not introduce yourself, just answer the user concisely.",
                 context_limit: 40000,
-                enabled_tools: ['search'],
+                enabled_tools: this.tools.filter(t => t.default).map(t => t.key),
+                thinking_budget: 0,
             }
         },
 
@@ -953,16 +960,18 @@ createApp({
 
         async loadInitialData() {
             try {
-                const [threadsResponse, modelsResponse, rolesResponse, archivedResponse] =
+                const [threadsResponse, modelsResponse, toolsResponse, rolesResponse, archivedResponse] =
                     await Promise.all([
                         this.apiCall('/api/threads'),
                         this.apiCall('/api/models'),
+                        this.apiCall('/api/tools'),
                         this.apiCall('/api/roles'),
                         this.apiCall('/api/threads/archived'),
                     ])
 
                 this.threads = threadsResponse.threads || []
                 this.models = modelsResponse.models || []
+                this.tools = toolsResponse.tools || []
                 this.roles = rolesResponse.roles || []
                 this.archivedThreads = archivedResponse.threads || []
 
@@ -971,6 +980,15 @@ createApp({
 
                 // Initialize and restore pane layout
                 await this.restorePaneLayout()
+
+                // Open a thread linked from the bot, e.g. a /search result
+                const params = new URLSearchParams(window.location.search)
+                if (params.get('thread')) {
+                    await this.openSearchResult({
+                        thread_id: params.get('thread'),
+                        message_id: Number(params.get('message')) || null,
+                    })
+                }
             } catch (error) {
                 this.showError('Failed to load data.')
             }
@@ -1385,6 +1403,15 @@ createApp({
                                 return
                             }
 
+                            // Thinking deltas are appended to the streaming message
+                            if (data.type === 'thinking') {
+                                const message = pane.messages.find(m => m.id === data.id)
+                                if (message) {
+                                    message.thinking = (message.thinking || '') + data.thinking
+                                }
+                                continue
+                            }
+
                             // Handle streaming message updates
                             if (data.role === 'assistant' && data.content !== undefined) {
                                 if (!streamingMessageId) {
@@ -1834,6 +1861,61 @@ createApp({
             return html
         },
 
+        // Debounced search as the user types
+        onSearchInput() {
+            clearTimeout(this.searchTimer)
+            const query = this.searchQuery.trim()
+            if (!query) {
+                this.searchResults = null
+                return
+            }
+
+            this.searchTimer = setTimeout(async () => {
+                try {
+                    const response = await this.apiCall(`/api/search?q=${encodeURIComponent(query)}`)
+                    this.searchResults = response.results || []
+                } catch (error) {
+                    this.showError('Search failed')
+                }
+            }, 300)
+        },
+
+        clearSearch() {
+            clearTimeout(this.searchTimer)
+            this.searchQuery = ''
+            this.searchResults = null
+        },
+
+        // Render a search snippet with its highlight offsets marked
+        highlightSnippet(result) {
+            const chars = Array.from(result.snippet || '')
+            let html = ''
+            let pos = 0
+            for (const [start, end] of result.highlights || []) {
+                html += this.escapeHtml(chars.slice(pos, start).join(''))
+                html += `<mark>${this.escapeHtml(chars.slice(start, end).join(''))}</mark>`
+                pos = end
+            }
+            return html + this.escapeHtml(chars.slice(pos).join(''))
+        },
+
+        // Open the thread of a search result and scroll to the matched message
+        async openSearchResult(result) {
+            const exists =
+                this.threads.find(t => t.id === result.thread_id) ||
+                this.archivedThreads.find(t => t.id === result.thread_id)
+            if (!exists) return
+
+            await this.selectThread(result.thread_id)
+            if (result.message_id) {
+                this.$nextTick(() => {
+                    document
+                        .querySelector(`[data-message-id="${result.message_id}"]`)
+                        ?.scrollIntoView({ block: 'center' })
+                })
+            }
+        },
+
         escapeHtml(text) {
             const div = document.createElement('div')
             div.textContent = text
@@ -2523,6 +2605,23 @@ createApp({
             }
         },
 
+        // Switch a message to its previous (-1) or next (1) alternative branch
+        async switchBranch(paneId, message, direction) {
+            const siblings = message.siblings || []
+            const index = siblings.indexOf(message.id) + direction
+            if (index < 0 || index >= siblings.length) return
+
+            try {
+                await this.apiCall(`/api/messages/${siblings[index]}/activate`, {
+                    method: 'POST',
+                })
+                await this.loadPaneMessages(paneId)
+            } catch (error) {
+                console.error('Failed to switch branch:', error)
+                this.showError('Failed to switch branch')
+            }
+        },
+
         // Format response time for display
         formatResponseTime(ms) {
             if (ms < 1000) {